@@ -0,0 +1,276 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/sink"
+)
+
+// Options configure, when alerts are raised. Alerts are always logged and
+// additionally posted to the webhook, if one is given.
+type Options struct {
+	// Offline raises an alert, if an inverter hasn't answered for this long.
+	// 0 disables it.
+	Offline time.Duration `yaml:"offline"`
+	// Temperature raises an alert, if the temperature of an inverter exceeds
+	// this value in °C. 0 disables it.
+	Temperature float32 `yaml:"temperature"`
+	// Errors raises an alert for every new entry in the error memory.
+	Errors bool `yaml:"errors"`
+	// Webhook is the URL, to which the alerts are posted as JSON.
+	Webhook string `yaml:"webhook"`
+}
+
+// Enabled returns true, if any alert is enabled.
+func (o Options) Enabled() bool {
+	return o.Offline > 0 || o.Temperature > 0 || o.Errors
+}
+
+// Validate checks the webhook URL and the thresholds.
+func (o Options) Validate() error {
+	if o.Offline < 0 {
+		return fmt.Errorf("Invalid offline alert %v\n", o.Offline)
+	}
+	if o.Webhook != "" {
+		u, err := url.Parse(o.Webhook)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("Unsupported webhook %s, use http or https\n", o.Webhook)
+		}
+	}
+	return nil
+}
+
+// The types of alerts.
+const (
+	Offline     = "offline"
+	Temperature = "temperature"
+	Error       = "error"
+)
+
+// temperatureHysteresis is how far the temperature must drop below the
+// threshold, before the alert is resolved.
+const temperatureHysteresis = 2
+
+// Alert is raised, when something is wrong with an inverter. Once it's
+// fixed, the same alert is sent again with Resolved set.
+type Alert struct {
+	Date     time.Time
+	Inverter protocol.Inverter
+	Type     string
+	Message  string
+	Resolved bool
+}
+
+// state is what is known about one inverter.
+type state struct {
+	lastSeen time.Time
+	offline  bool
+	hot      bool
+	// lastError is the date of the newest entry of the error memory.
+	lastError time.Time
+	// errorsRead is set, once the error memory has been read.
+	errorsRead bool
+}
+
+// Alerter is a sink, that raises alerts.
+type Alerter struct {
+	options Options
+	client  *http.Client
+	// Now returns the current time, it can be replaced in tests.
+	Now func() time.Time
+
+	mu     sync.Mutex
+	states map[protocol.Inverter]*state
+	done   chan struct{}
+}
+
+// New returns an alerter for the given inverters.
+func New(options Options, inverters []protocol.Inverter) (*Alerter, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	a := &Alerter{
+		options: options,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		Now:     time.Now,
+		states:  make(map[protocol.Inverter]*state),
+		done:    make(chan struct{}),
+	}
+	for _, inverter := range inverters {
+		a.states[inverter] = &state{}
+	}
+	return a, nil
+}
+
+// Start checks regularly, whether the inverters are offline, until Close is
+// called.
+func (a *Alerter) Start() {
+	a.mu.Lock()
+	now := a.Now()
+	for _, s := range a.states {
+		s.lastSeen = now
+	}
+	a.mu.Unlock()
+	if a.options.Offline <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.done:
+				return
+			case <-ticker.C:
+				a.Check()
+			}
+		}
+	}()
+}
+
+// Close stops checking.
+func (a *Alerter) Close() error {
+	select {
+	case <-a.done:
+	default:
+		close(a.done)
+	}
+	return nil
+}
+
+// Data resolves the offline alert and checks the temperature.
+func (a *Alerter) Data(inverter protocol.Inverter, data protocol.DataPoint) {
+	var alerts []Alert
+	a.mu.Lock()
+	s := a.state(inverter)
+	s.lastSeen = a.Now()
+	if s.offline {
+		s.offline = false
+		alerts = append(alerts, Alert{Type: Offline, Message: "Inverter answers again", Resolved: true})
+	}
+	if threshold := a.options.Temperature; threshold > 0 {
+		if !s.hot && data.Temperature > threshold {
+			s.hot = true
+			alerts = append(alerts, Alert{Type: Temperature, Message: fmt.Sprintf("Temperature %.1f °C is above %.1f °C", data.Temperature, threshold)})
+		} else if s.hot && data.Temperature <= threshold-temperatureHysteresis {
+			s.hot = false
+			alerts = append(alerts, Alert{Type: Temperature, Message: fmt.Sprintf("Temperature %.1f °C is normal again", data.Temperature), Resolved: true})
+		}
+	}
+	a.mu.Unlock()
+
+	a.raise(inverter, alerts)
+}
+
+// Failure checks, whether the inverter has been offline for too long.
+func (a *Alerter) Failure(inverter protocol.Inverter, err error) {
+	a.Check()
+}
+
+// Info raises an alert for every entry of the error memory, that is newer
+// than the newest entry, when the error memory has been read the first time.
+func (a *Alerter) Info(inverter protocol.Inverter, info sink.Info) {
+	if !a.options.Errors || info.Errors == nil {
+		return
+	}
+
+	var alerts []Alert
+	a.mu.Lock()
+	s := a.state(inverter)
+	newest := s.lastError
+	for _, e := range info.Errors {
+		if e.Date.IsZero() {
+			continue
+		}
+		if s.errorsRead && e.Date.After(s.lastError) {
+			fault := e.Fault()
+			alerts = append(alerts, Alert{Date: e.Date, Type: Error, Message: fmt.Sprintf("%s (0x%02x, %s): %s", fault.Name(), e.Code, fault.Severity, fault.Description)})
+		}
+		if e.Date.After(newest) {
+			newest = e.Date
+		}
+	}
+	s.lastError = newest
+	s.errorsRead = true
+	a.mu.Unlock()
+
+	a.raise(inverter, alerts)
+}
+
+// Check raises an alert for every inverter, that hasn't answered for too
+// long.
+func (a *Alerter) Check() {
+	if a.options.Offline <= 0 {
+		return
+	}
+	now := a.Now()
+	alerts := make(map[protocol.Inverter]Alert)
+	a.mu.Lock()
+	for inverter, s := range a.states {
+		if !s.offline && !s.lastSeen.IsZero() && now.Sub(s.lastSeen) >= a.options.Offline {
+			s.offline = true
+			alerts[inverter] = Alert{Type: Offline, Message: fmt.Sprintf("Inverter hasn't answered since %s", s.lastSeen.Format(time.RFC3339))}
+		}
+	}
+	a.mu.Unlock()
+
+	for inverter, alert := range alerts {
+		a.raise(inverter, []Alert{alert})
+	}
+}
+
+func (a *Alerter) state(inverter protocol.Inverter) *state {
+	s, ok := a.states[inverter]
+	if !ok {
+		s = &state{lastSeen: a.Now()}
+		a.states[inverter] = s
+	}
+	return s
+}
+
+func (a *Alerter) raise(inverter protocol.Inverter, alerts []Alert) {
+	for _, alert := range alerts {
+		alert.Inverter = inverter
+		if alert.Date.IsZero() {
+			alert.Date = a.Now()
+		}
+		if alert.Resolved {
+			log.Printf("Alert resolved for %s: %s\n", inverter.Name, alert.Message)
+		} else {
+			log.Printf("Alert for %s: %s\n", inverter.Name, alert.Message)
+		}
+		if a.options.Webhook != "" {
+			if err := a.post(alert); err != nil {
+				log.Printf("Couldn't post alert: %v\n", err)
+			}
+		}
+	}
+}
+
+func (a *Alerter) post(alert Alert) error {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	response, err := a.client.Post(a.options.Webhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("Webhook returned %s\n", response.Status)
+	}
+	return nil
+}
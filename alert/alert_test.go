@@ -0,0 +1,195 @@
+package alert_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/alert"
+	"github.com/adangel/nt5000-serial/emulator"
+	"github.com/adangel/nt5000-serial/poller"
+	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/serial"
+	"github.com/adangel/nt5000-serial/sink"
+)
+
+// webhook records all posted alerts.
+type webhook struct {
+	mu     sync.Mutex
+	alerts []alert.Alert
+}
+
+func (h *webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var a alert.Alert
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.alerts = append(h.alerts, a)
+}
+
+func (h *webhook) received() []alert.Alert {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]alert.Alert(nil), h.alerts...)
+}
+
+// clock is a fake time, that only moves when told to.
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func setup(t *testing.T, options alert.Options) (*alert.Alerter, *webhook, *clock) {
+	h := &webhook{}
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	options.Webhook = ts.URL
+
+	a, err := alert.New(options, []protocol.Inverter{protocol.NewInverter(1)})
+	if err != nil {
+		t.Fatalf("Couldn't create alerter: %v\n", err)
+	}
+	c := &clock{now: time.Date(2022, 4, 10, 12, 0, 0, 0, time.UTC)}
+	a.Now = c.Now
+	a.Start()
+	t.Cleanup(func() { a.Close() })
+	return a, h, c
+}
+
+func TestOffline(t *testing.T) {
+	a, h, c := setup(t, alert.Options{Offline: 10 * time.Minute})
+	inverter := protocol.NewInverter(1)
+
+	c.now = c.now.Add(5 * time.Minute)
+	a.Failure(inverter, errors.New("timeout"))
+	if n := len(h.received()); n != 0 {
+		t.Fatalf("Expected no alert yet, got %v\n", n)
+	}
+
+	c.now = c.now.Add(5 * time.Minute)
+	a.Failure(inverter, errors.New("timeout"))
+	a.Check()
+	alerts := h.received()
+	if len(alerts) != 1 || alerts[0].Type != alert.Offline || alerts[0].Resolved || alerts[0].Inverter != inverter {
+		t.Fatalf("Expected one offline alert, got %+v\n", alerts)
+	}
+
+	a.Data(inverter, protocol.DataPoint{})
+	alerts = h.received()
+	if len(alerts) != 2 || alerts[1].Type != alert.Offline || !alerts[1].Resolved {
+		t.Fatalf("Expected resolved offline alert, got %+v\n", alerts)
+	}
+}
+
+func TestTemperature(t *testing.T) {
+	a, h, _ := setup(t, alert.Options{Temperature: 70})
+	inverter := protocol.NewInverter(1)
+
+	for _, temperature := range []float32{65, 71, 75, 69, 67, 72} {
+		a.Data(inverter, protocol.DataPoint{Temperature: temperature})
+	}
+	alerts := h.received()
+	if len(alerts) != 3 {
+		t.Fatalf("Expected 3 alerts, got %+v\n", alerts)
+	}
+	if alerts[0].Resolved || !alerts[1].Resolved || alerts[2].Resolved {
+		t.Fatalf("Expected raised, resolved, raised, got %+v\n", alerts)
+	}
+	if !strings.Contains(alerts[0].Message, "71.0") {
+		t.Fatalf("Wrong message: %v\n", alerts[0].Message)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	a, h, _ := setup(t, alert.Options{Errors: true})
+	inverter := protocol.NewInverter(1)
+	old := protocol.Error{Date: time.Date(2022, 4, 1, 10, 0, 0, 0, time.UTC), Code: 0x11}
+	current := protocol.Error{Date: time.Date(2022, 4, 10, 10, 0, 0, 0, time.UTC), Code: 0x11}
+
+	// the entries at startup are known already
+	a.Info(inverter, sink.Info{Errors: []protocol.Error{old, {}}})
+	if n := len(h.received()); n != 0 {
+		t.Fatalf("Expected no alert for old errors, got %v\n", n)
+	}
+	// error memory couldn't be read
+	a.Info(inverter, sink.Info{})
+
+	a.Info(inverter, sink.Info{Errors: []protocol.Error{current, old}})
+	alerts := h.received()
+	if len(alerts) != 1 || alerts[0].Type != alert.Error || !alerts[0].Date.Equal(current.Date) {
+		t.Fatalf("Expected one error alert, got %+v\n", alerts)
+	}
+
+	a.Info(inverter, sink.Info{Errors: []protocol.Error{current, old}})
+	if n := len(h.received()); n != 1 {
+		t.Fatalf("Expected no alert for known errors, got %v\n", n)
+	}
+}
+
+func TestErrorsWhileConnected(t *testing.T) {
+	device := emulator.NewDevice()
+	emulator.SetDevice(device)
+	t.Cleanup(func() { emulator.SetDevice(emulator.NewDevice()) })
+
+	a, h, _ := setup(t, alert.Options{Errors: true})
+	f := sink.New(a)
+	p := poller.New(func() (serial.Transport, error) {
+		return serial.NewMemoryTransport(emulator.Respond), nil
+	}, nil, time.Millisecond)
+	p.ErrorInterval = time.Millisecond
+	f.Attach(p)
+	connected := make(chan struct{})
+	onConnect := p.OnConnect
+	p.OnConnect = func(inverter protocol.Inverter, client *serial.Client) {
+		onConnect(inverter, client)
+		close(connected)
+	}
+	p.Start()
+	defer f.Close()
+	defer p.Close()
+
+	// the fault happens after the error memory has been read on connect
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Not connected\n")
+	}
+	if n := len(h.received()); n != 0 {
+		t.Fatalf("Expected no alert for old errors, got %v\n", n)
+	}
+
+	fault := protocol.Error{Date: time.Now().Truncate(time.Minute), Code: 0x17}
+	device.AddError(fault)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(h.received()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("No alert for a new error without reconnect\n")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if alerts := h.received(); alerts[0].Type != alert.Error || !alerts[0].Date.Equal(fault.Date) {
+		t.Fatalf("Wrong alert: %+v\n", alerts[0])
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, options := range []alert.Options{
+		{Offline: -time.Minute},
+		{Webhook: "ftp://localhost"},
+	} {
+		if _, err := alert.New(options, nil); err == nil {
+			t.Fatalf("Expected error for %+v\n", options)
+		}
+	}
+}
@@ -1,13 +1,26 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"strings"
 	"time"
 
+	"github.com/adangel/nt5000-serial/alert"
+	"github.com/adangel/nt5000-serial/config"
 	"github.com/adangel/nt5000-serial/emulator"
+	"github.com/adangel/nt5000-serial/history"
+	"github.com/adangel/nt5000-serial/influx"
+	"github.com/adangel/nt5000-serial/mqtt"
+	"github.com/adangel/nt5000-serial/poller"
+	"github.com/adangel/nt5000-serial/prometheus"
 	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/pvoutput"
 	"github.com/adangel/nt5000-serial/serial"
+	"github.com/adangel/nt5000-serial/sink"
+	"github.com/adangel/nt5000-serial/sunspec"
 	"github.com/adangel/nt5000-serial/web"
 	"github.com/atomicgo/cursor"
 	"github.com/spf13/cobra"
@@ -22,88 +35,43 @@ var cmdWeb = &cobra.Command{
 	Use:   "web",
 	Short: "start web server",
 	Run: func(c *cobra.Command, args []string) {
-		web.StartWebServer(Port, checkAndGetPollInterval(), SerialPort, Emulate)
+		if err := cfg.Validate(); err != nil {
+			log.Fatalf("Invalid configuration:\n%v", err)
+		}
+		store := openHistory()
+		web.StartWebServer(cfg.Web.Listen, cfg.Web.Poll, opener(), cfg.Inverters, store, sinks(store))
 	},
 }
 
 var cmdSerial = &cobra.Command{
 	Use:   "serial",
 	Short: "list serial ports",
-	Run:   serial.ListSerialPorts,
+	RunE:  serial.ListSerialPorts,
 }
 
 var cmdDatetime = &cobra.Command{
 	Use:   "datetime",
 	Short: "Get or set the current time",
 	Run: func(cmd *cobra.Command, args []string) {
-		log.Printf("Using serial port %s", SerialPort)
-
 		settime, _ := cmd.Flags().GetBool("set")
 
+		client := connect()
+		defer client.Close()
+
 		if settime {
 			now := time.Now().Local()
 			log.Printf("Setting date to %s\n", now.Format(time.ANSIC))
 
-			serial.Connect(SerialPort)
-
-			buff := make([]byte, 5)
-			buff[0] = 0x00
-			buff[1] = 0xff
-
-			// year
-			buff[2] = 0x32
-			buff[3] = byte(now.Year() - 2000)
-			protocol.CalculateChecksum(buff)
-			serial.Send(buff)
-
-			// month
-			buff[2] = 0x33
-			buff[3] = byte(now.Month())
-			protocol.CalculateChecksum(buff)
-			serial.Send(buff)
-
-			// day
-			buff[2] = 0x34
-			buff[3] = byte(now.Day())
-			protocol.CalculateChecksum(buff)
-			serial.Send(buff)
-
-			// hour
-			buff[2] = 0x35
-			buff[3] = byte(now.Hour() + 1)
-			protocol.CalculateChecksum(buff)
-			serial.Send(buff)
-
-			// minute
-			buff[2] = 0x36
-			buff[3] = byte(now.Minute() + 1)
-			protocol.CalculateChecksum(buff)
-			serial.Send(buff)
-
-			serial.Disconnect()
+			err := client.SetTime(now)
+			if err != nil {
+				log.Fatal(err)
+			}
 		} else {
-			var err error
-			buff := make([]byte, 13)
-
 			log.Println("Reading current date...")
-			if Emulate {
-				buff = emulator.CurrentTimeBytes()
-			} else {
-				serial.Connect(SerialPort)
-				serial.Send([]byte("\x00\x01\x06\x01\x08"))
-				buff, err = serial.Receive()
-				if err != nil {
-					log.Print(err)
-				}
-				serial.Disconnect()
-			}
-
-			err = protocol.VerifyChecksum(buff)
+			t, err := client.ReadTime()
 			if err != nil {
-				log.Print(err)
+				log.Fatal(err)
 			}
-
-			t := time.Date(int(buff[0])+2000, time.Month(buff[1]), int(buff[2]), int(buff[3]), int(buff[4]), 0, 0, time.Local)
 			log.Printf("Current time: %s\n", t.Local().Format(time.ANSIC))
 		}
 	},
@@ -113,21 +81,22 @@ var cmdErrors = &cobra.Command{
 	Use:   "errors",
 	Short: "Read error memory",
 	Run: func(cmd *cobra.Command, args []string) {
-		log.Printf("Using serial port %s", SerialPort)
+		client := connect()
+		defer client.Close()
 
 		log.Println("Reading error memory...")
-		if !Emulate {
-			serial.Connect(SerialPort)
-		}
-		errors := serial.ReadErrors(Emulate)
-		if !Emulate {
-			serial.Disconnect()
+		errors, err := client.ReadErrors()
+		if err != nil {
+			log.Fatal(err)
 		}
 
 		count := 0
 		for i, v := range errors {
 			if !v.Date.IsZero() {
-				log.Printf("Error %02d: Date: %v Code: 0x%02x\n", i+1, v.Date.Format(time.ANSIC), v.Code)
+				fault := v.Fault()
+				log.Printf("Error %02d: Date: %v Code: 0x%02x (%s, %s): %s\n", i+1, v.Date.Format(time.ANSIC), v.Code,
+					fault.Name(), fault.Severity, fault.Description)
+				log.Printf("          %s\n", fault.Action)
 				count++
 			}
 		}
@@ -137,28 +106,70 @@ var cmdErrors = &cobra.Command{
 	},
 }
 
+var cmdScan = &cobra.Command{
+	Use:   "scan",
+	Short: "Find all inverters on the bus",
+	Run: func(cmd *cobra.Command, args []string) {
+		from, _ := cmd.Flags().GetUint8("from")
+		to, _ := cmd.Flags().GetUint8("to")
+
+		transport, err := opener()()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer transport.Close()
+
+		log.Printf("Scanning addresses %v to %v...\n", from, to)
+		found := 0
+		for address := int(from); address <= int(to) && address < int(protocol.BroadcastAddress); address++ {
+			client := serial.NewClientWithAddress(transport, byte(address))
+			serialnumber, err := client.ReadSerialNumber()
+			if err != nil {
+				continue
+			}
+			fmt.Printf("Address %3d: serial number %s\n", address, serialnumber)
+			found++
+		}
+		fmt.Printf("Found %v inverters\n", found)
+	},
+}
+
 var cmdDisplay = &cobra.Command{
 	Use:   "display",
 	Short: "Display current reading on the command line",
 	Run: func(cmd *cobra.Command, args []string) {
 		log.Println("Displaying...")
-		checkAndGetPollInterval()
+		if cfg.Web.Poll <= 0 {
+			log.Fatalf("Invalid poll interval %v\n", cfg.Web.Poll)
+		}
 
-		serial.SetupCloseHandler()
+		client := connect()
+		serial.SetupCloseHandler(client)
 
 		area := cursor.NewArea()
 		area.Clear()
 
-		if !Emulate {
-			log.Printf("Querying serial port %s", SerialPort)
-			serial.Connect(SerialPort)
+		serialnumber, err := client.ReadSerialNumber()
+		if err != nil {
+			log.Print(err)
+		}
+		protocol, firmware, err := client.ReadProtocolAndFirmware()
+		if err != nil {
+			log.Print(err)
 		}
-
-		serialnumber := serial.ReadSerialNumber(Emulate)
-		protocol, firmware := serial.ReadProtocolAndFirmware(Emulate)
 
 		for {
-			data := serial.GetDataPoint(Emulate)
+			data, err := client.GetDataPoint()
+			if err != nil {
+				area.Update(fmt.Sprintf(`
+Couldn't read data: %v
+
+Retrying in %v. Abort with Ctlr+C
+`, err, cfg.Web.Poll))
+				time.Sleep(cfg.Web.Poll)
+				continue
+			}
+
 			disp := fmt.Sprintf(`
 Date: %v
 
@@ -177,16 +188,16 @@ wtot: % 8.1f kWh
 temp: % 8.1f °C
 flux: % 8.1f W/m^2
 
-Polling every %v seconds. Abort with Ctlr+C
+Polling every %v. Abort with Ctlr+C
 `, data.Date, serialnumber, protocol, firmware,
 				data.DC.Voltage, data.DC.Current, data.DC.Power,
 				data.AC.Voltage, data.AC.Current, data.AC.Power,
 				data.EnergyDay, data.EnergyTotal, data.Temperature,
 				data.HeatFlux,
-				PollInterval)
+				cfg.Web.Poll)
 
 			area.Update(disp)
-			time.Sleep(time.Second * time.Duration(PollInterval))
+			time.Sleep(cfg.Web.Poll)
 		}
 
 	},
@@ -196,94 +207,113 @@ var cmdEmulator = &cobra.Command{
 	Use:   "emulator",
 	Short: "Emulate a NT5000 at the given serial port",
 	Run: func(cmd *cobra.Command, args []string) {
-		log.Printf("Emulating on port %s\n", SerialPort)
+		setupEmulator()
 
-		serial.Connect(SerialPort)
-
-		serial.SetupCloseHandler()
-
-		buff := make([]byte, 5)
+		if listen, _ := cmd.Flags().GetString("listen"); listen != "" {
+			emulateOnNetwork(listen)
+			return
+		}
 
-		for {
-			var err error
-			buff, err = serial.Receive()
+		var transport serial.Transport
+		if pty, _ := cmd.Flags().GetBool("pty"); pty {
+			p, err := serial.OpenPTY()
 			if err != nil {
-				// ignore incomplete or no data
-				continue
+				log.Fatal(err)
 			}
-			err = protocol.VerifyChecksum(buff)
+			log.Printf("Emulating on pseudo-terminal %s\n", p.Path)
+			fmt.Println(p.Path)
+			transport = p
+		} else {
+			log.Printf("Emulating on port %s\n", cfg.Serial.Port)
+			var err error
+			transport, err = serial.Open(cfg.Serial.Port)
 			if err != nil {
-				log.Print(err)
-			}
-
-			var response []byte = nil
-
-			switch buff[2] {
-			case 0x02: // read data
-				log.Printf("Read data\n")
-				response = protocol.ConvertToByte(emulator.ProduceDataPoint())
-
-			case 0x06: // read time
-				log.Printf("Read time\n")
-				response = emulator.CurrentTimeBytes()
-			case 0x32: // set year
-				log.Printf("Set year --> %v\n", int(buff[3])+2000)
-			case 0x33: // set month
-				log.Printf("Set month --> %v\n", int(buff[3]))
-			case 0x34: // set day
-				log.Printf("Set day --> %v\n", int(buff[3]))
-			case 0x35: // set hour
-				log.Printf("Set hour --> %v\n", int(buff[3])-1)
-			case 0x36: // set minute
-				log.Printf("Set minute --> %v\n", int(buff[3])-1)
-			case 0x08: // read serial
-				log.Printf("Read serial number\n")
-				response = []byte("1533A5012345\x00")
-			case 0x09: // read protocol + firmware
-				log.Printf("Read protocol + firmware\n")
-				response = []byte("111-23\x00\x00\x00\x00\x00\x00\x00")
-			case 0x01: // read errors
-				log.Printf("Read errors\n")
-				response = make([]byte, 13)
-				for i := 0; i < 12; i++ {
-					response[i] = 0x0d
-				}
-			default:
-				log.Printf("Unknown command: %v\n", buff)
+				log.Fatal(err)
 			}
+		}
 
-			if response != nil {
-				if len(response) != 13 {
-					log.Fatalf("Response array has length %v, expected 13\n", len(response))
-				}
-
-				protocol.CalculateChecksum(response)
-				serial.Send(response)
-			}
+		serial.SetupCloseHandler(transport)
 
+		if err := emulator.Serve(transport); err != nil {
+			log.Fatal(err)
 		}
 	},
 }
 
+// cfg contains all settings. The flags are bound to it, the config file and
+// the environment are applied by loadConfig.
+var cfg = config.Default()
+
+// ConfigFile is the path of the config file.
+var ConfigFile string
+
+// Port, PollInterval and Addresses are flags, that are converted to cfg.
 var Port string
-var SerialPort string
-var Emulate bool
-var PollInterval uint8
+var PollInterval uint
+var Addresses []string
 
 func init() {
 	ports := serial.List()
-	defaultPort := "/dev/ttyUSB0"
 	if len(ports) > 0 {
-		defaultPort = ports[0]
+		cfg.Serial.Port = ports[0]
 	}
 
-	rootCmd.PersistentFlags().StringVarP(&SerialPort, "tty", "t", defaultPort, "Serial port")
-	rootCmd.PersistentFlags().BoolVarP(&Emulate, "emulate", "e", false, "Don't use serial port at all, use fake data")
+	rootCmd.PersistentPreRunE = loadConfig
+	rootCmd.PersistentFlags().StringVarP(&ConfigFile, "config", "c", "", "YAML config file, can also be given via the environment variable NT5000_CONFIG")
+	rootCmd.PersistentFlags().StringVarP(&cfg.Serial.Port, "tty", "t", cfg.Serial.Port, "Serial port")
+	rootCmd.PersistentFlags().BoolVarP(&cfg.Serial.Emulate, "emulate", "e", false, "Don't use serial port at all, use fake data")
+	rootCmd.PersistentFlags().StringVar(&cfg.Emulator.Scenario, "scenario", "", "YAML file with events, that let the emulator misbehave, used by emulator and --emulate")
+	rootCmd.PersistentFlags().StringVar(&cfg.Emulator.State, "emulator-state", "", "File, that keeps the clock and the error memory of the emulator across restarts")
+	rootCmd.PersistentFlags().StringSliceVarP(&Addresses, "address", "a", []string{"1"}, "Addresses of the inverters on the bus, optionally with a name, e.g. garage=1,roof=2")
 
 	cmdWeb.Flags().StringVarP(&Port, "port", "p", "8080", "TCP port to listen on")
 	cmdDatetime.Flags().BoolP("set", "s", false, "Sets the date and time")
-	cmdDisplay.Flags().Uint8VarP(&PollInterval, "poll", "n", 5, "Poll every n seconds")
-	cmdWeb.Flags().Uint8VarP(&PollInterval, "poll", "n", 5, "Poll every n seconds")
+	cmdEmulator.Flags().String("listen", "", "Emulate a serial port server on this address instead of --tty, e.g. tcp://:2000 or rfc2217://:2000")
+	cmdEmulator.Flags().Bool("pty", false, "Emulate on a new pseudo-terminal instead of --tty and print its path (Linux only)")
+	cmdScan.Flags().Uint8("from", 1, "First address to scan")
+	cmdScan.Flags().Uint8("to", 32, "Last address to scan")
+	cmdDisplay.Flags().UintVarP(&PollInterval, "poll", "n", 5, "Poll every n seconds")
+	cmdWeb.Flags().UintVarP(&PollInterval, "poll", "n", 5, "Poll every n seconds")
+	cmdWeb.Flags().StringVar(&cfg.Serial.USBID, "usb-id", "", "Find the serial port by USB vendor and product id (VID:PID) instead of --tty")
+	cmdWeb.Flags().StringVar(&cfg.Serial.USBSerial, "usb-serial", "", "Find the serial port by USB serial number instead of --tty")
+	cmdWeb.Flags().StringVar(&cfg.History.Dir, "history", cfg.History.Dir, "Directory to store the history in, empty to disable")
+	cmdWeb.Flags().DurationVar(&cfg.History.RawRetention, "history-raw-retention", cfg.History.RawRetention, "How long to keep all data points, before they are downsampled, 0 to keep them forever")
+	cmdWeb.Flags().DurationVar(&cfg.History.Resolution, "history-resolution", cfg.History.Resolution, "Interval of the downsampled data points")
+	cmdWeb.Flags().DurationVar(&cfg.History.Retention, "history-retention", cfg.History.Retention, "How long to keep the history at all, 0 to keep it forever")
+	cmdWeb.Flags().StringVar(&cfg.MQTT.Broker, "mqtt-broker", "", "Publish the data to this MQTT broker, e.g. tcp://localhost:1883 or ssl://localhost:8883")
+	cmdWeb.Flags().StringVar(&cfg.MQTT.TopicPrefix, "mqtt-topic", cfg.MQTT.TopicPrefix, "Prefix of all MQTT topics")
+	cmdWeb.Flags().StringVar(&cfg.MQTT.ClientID, "mqtt-client-id", cfg.MQTT.ClientID, "MQTT client id")
+	cmdWeb.Flags().StringVar(&cfg.MQTT.Username, "mqtt-username", "", "MQTT username")
+	cmdWeb.Flags().StringVar(&cfg.MQTT.Password, "mqtt-password", "", "MQTT password, can also be given via the environment variable NT5000_MQTT_PASSWORD")
+	cmdWeb.Flags().Uint8Var(&cfg.MQTT.QoS, "mqtt-qos", 0, "MQTT quality of service (0, 1 or 2)")
+	cmdWeb.Flags().BoolVar(&cfg.MQTT.HomeAssistant, "mqtt-homeassistant", false, "Publish discovery configs for Home Assistant")
+	cmdWeb.Flags().StringVar(&cfg.MQTT.DiscoveryPrefix, "mqtt-discovery-prefix", cfg.MQTT.DiscoveryPrefix, "Discovery prefix of Home Assistant")
+	cmdWeb.Flags().StringVar(&cfg.MQTT.CAFile, "mqtt-ca", "", "PEM file with the CA certificates of the MQTT broker")
+	cmdWeb.Flags().StringVar(&cfg.MQTT.CertFile, "mqtt-cert", "", "PEM file with the client certificate")
+	cmdWeb.Flags().StringVar(&cfg.MQTT.KeyFile, "mqtt-key", "", "PEM file with the key of the client certificate")
+	cmdWeb.Flags().BoolVar(&cfg.MQTT.Insecure, "mqtt-insecure", false, "Don't verify the certificate of the MQTT broker")
+	cmdWeb.Flags().StringVar(&cfg.Influx.URL, "influx-url", "", "Write the data to InfluxDB at this URL, e.g. http://localhost:8086 or udp://localhost:8089")
+	cmdWeb.Flags().IntVar(&cfg.Influx.Version, "influx-version", cfg.Influx.Version, "InfluxDB API version (1 or 2)")
+	cmdWeb.Flags().StringVar(&cfg.Influx.Org, "influx-org", "", "InfluxDB v2 organization")
+	cmdWeb.Flags().StringVar(&cfg.Influx.Bucket, "influx-bucket", "", "InfluxDB v2 bucket")
+	cmdWeb.Flags().StringVar(&cfg.Influx.Token, "influx-token", "", "InfluxDB v2 token, can also be given via the environment variable NT5000_INFLUX_TOKEN")
+	cmdWeb.Flags().StringVar(&cfg.Influx.Database, "influx-database", "", "InfluxDB v1 database")
+	cmdWeb.Flags().StringVar(&cfg.Influx.Username, "influx-username", "", "InfluxDB v1 username")
+	cmdWeb.Flags().StringVar(&cfg.Influx.Password, "influx-password", "", "InfluxDB v1 password, can also be given via the environment variable NT5000_INFLUX_PASSWORD")
+	cmdWeb.Flags().StringVar(&cfg.Influx.Measurement, "influx-measurement", cfg.Influx.Measurement, "InfluxDB measurement")
+	cmdWeb.Flags().DurationVar(&cfg.Influx.FlushInterval, "influx-flush-interval", cfg.Influx.FlushInterval, "Write the data to InfluxDB at least this often")
+	cmdWeb.Flags().StringVar(&cfg.Influx.BufferDir, "influx-buffer", "", "Directory to buffer the data in, while InfluxDB is unreachable")
+	cmdWeb.Flags().StringVar(&cfg.PVOutput.APIKey, "pvoutput-api-key", "", "Upload the data to PVOutput with this API key, can also be given via the environment variable NT5000_PVOUTPUT_API_KEY")
+	cmdWeb.Flags().StringVar(&cfg.PVOutput.SystemID, "pvoutput-system-id", "", "PVOutput system id")
+	cmdWeb.Flags().StringVar(&cfg.PVOutput.BaseURL, "pvoutput-url", cfg.PVOutput.BaseURL, "URL of the PVOutput API")
+	cmdWeb.Flags().DurationVar(&cfg.PVOutput.Interval, "pvoutput-interval", cfg.PVOutput.Interval, "Status interval of the PVOutput system (5m, 10m or 15m)")
+	cmdWeb.Flags().DurationVar(&cfg.PVOutput.Backfill, "pvoutput-backfill", cfg.PVOutput.Backfill, "Upload missed statuses from the history up to this far back (at most 14 days)")
+	cmdWeb.Flags().StringVar(&cfg.SunSpec.Listen, "modbus-listen", "", "Serve the data as SunSpec via Modbus TCP on this address, e.g. :502")
+	cmdWeb.Flags().Uint16Var(&cfg.SunSpec.Model, "sunspec-model", cfg.SunSpec.Model, "SunSpec inverter model, 101 (single phase) or 103 (three phase)")
+	cmdWeb.Flags().DurationVar(&cfg.Alerts.Offline, "alert-offline", 0, "Alert, if an inverter hasn't answered for this long, 0 to disable")
+	cmdWeb.Flags().Float32Var(&cfg.Alerts.Temperature, "alert-temperature", 0, "Alert, if the temperature exceeds this value in °C, 0 to disable")
+	cmdWeb.Flags().BoolVar(&cfg.Alerts.Errors, "alert-errors", false, "Alert on new entries in the error memory")
+	cmdWeb.Flags().StringVar(&cfg.Alerts.Webhook, "alert-webhook", "", "Post the alerts as JSON to this URL")
 
 	rootCmd.AddCommand(cmdWeb)
 	rootCmd.AddCommand(cmdSerial)
@@ -291,6 +321,10 @@ func init() {
 	rootCmd.AddCommand(cmdDisplay)
 	rootCmd.AddCommand(cmdEmulator)
 	rootCmd.AddCommand(cmdErrors)
+	rootCmd.AddCommand(cmdMonthly)
+	rootCmd.AddCommand(cmdYearly)
+	rootCmd.AddCommand(cmdScan)
+	rootCmd.AddCommand(cmdConfig)
 }
 
 func Execute(version string) error {
@@ -298,10 +332,204 @@ func Execute(version string) error {
 	return rootCmd.Execute()
 }
 
-func checkAndGetPollInterval() uint8 {
-	if PollInterval < 1 || PollInterval > 100 {
-		log.Printf("Invalid poll interval %v specified, using default\n", PollInterval)
-		PollInterval = 5
+// connect returns a client for the first configured inverter. In emulation
+// mode, the client talks to the built-in emulator instead.
+func connect() *serial.Client {
+	transport, err := opener()()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(cfg.Inverters) > 1 {
+		log.Printf("Using only the first inverter %s\n", cfg.Inverters[0].Name)
+	}
+	return serial.NewClientWithAddress(transport, cfg.Inverters[0].Address)
+}
+
+// opener returns a function, that opens the configured serial port. If a USB
+// id or serial number has been given, the port is looked up every time, so
+// that an adapter, that has been plugged in again, is found under its new name.
+func opener() poller.Opener {
+	if cfg.Serial.Emulate {
+		setupEmulator()
+		return func() (serial.Transport, error) {
+			transport := serial.NewMemoryTransport(emulator.Handle)
+			transport.Timeout = serial.DefaultTimeout
+			return transport, nil
+		}
+	}
+	return func() (serial.Transport, error) {
+		port := cfg.Serial.Port
+		if cfg.Serial.USBID != "" || cfg.Serial.USBSerial != "" {
+			vid, pid, _ := strings.Cut(cfg.Serial.USBID, ":")
+			var err error
+			port, err = serial.FindPort(vid, pid, cfg.Serial.USBSerial)
+			if err != nil {
+				return nil, err
+			}
+		}
+		log.Printf("Using serial port %s", port)
+		return serial.Open(port)
+	}
+}
+
+// sinks returns all outputs, that have been enabled. The metrics for
+// Prometheus are always recorded.
+func sinks(store *history.Store) []sink.Sink {
+	result := []sink.Sink{prometheus.Sink{}}
+	if store != nil {
+		result = append(result, store)
+	}
+	if publisher := connectMQTT(); publisher != nil {
+		result = append(result, publisher)
+	}
+	if writer := newInfluxWriter(); writer != nil {
+		result = append(result, writer)
+	}
+	if uploader := newPVOutputUploader(store); uploader != nil {
+		result = append(result, uploader)
+	}
+	if server := listenSunSpec(); server != nil {
+		result = append(result, server)
+	}
+	if alerter := newAlerter(); alerter != nil {
+		result = append(result, alerter)
+	}
+	return result
+}
+
+// openHistory opens the history store, if it has been enabled.
+func openHistory() *history.Store {
+	if cfg.History.Dir == "" {
+		return nil
+	}
+	store, err := history.Open(cfg.History.Dir, cfg.History.Policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return store
+}
+
+// connectMQTT connects to the MQTT broker, if one has been configured.
+func connectMQTT() *mqtt.Publisher {
+	if cfg.MQTT.Broker == "" {
+		return nil
+	}
+	options := cfg.MQTT.Options
+	if !cfg.MQTT.HomeAssistant {
+		options.DiscoveryPrefix = ""
+	}
+	publisher, err := mqtt.Connect(options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return publisher
+}
+
+// newInfluxWriter returns a writer for InfluxDB, if a URL has been configured.
+func newInfluxWriter() *influx.Writer {
+	if cfg.Influx.URL == "" {
+		return nil
+	}
+	writer, err := influx.New(cfg.Influx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return writer
+}
+
+// newPVOutputUploader returns an uploader to PVOutput, if an API key has been
+// configured. Missed statuses are uploaded from the history store, which
+// might be nil.
+func newPVOutputUploader(store *history.Store) *pvoutput.Uploader {
+	if cfg.PVOutput.APIKey == "" {
+		return nil
+	}
+	uploader, err := pvoutput.New(cfg.PVOutput, cfg.Inverters, store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	uploader.Start()
+	return uploader
+}
+
+// listenSunSpec starts the SunSpec server, if an address has been configured.
+func listenSunSpec() *sunspec.Server {
+	if cfg.SunSpec.Listen == "" {
+		return nil
+	}
+	sunspec.MaxAge = 3 * cfg.Web.Poll
+	server, err := sunspec.Listen(cfg.SunSpec.Listen, cfg.Inverters, cfg.SunSpec.Model)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return server
+}
+
+// newAlerter returns an alerter, if any alert has been enabled.
+func newAlerter() *alert.Alerter {
+	if !cfg.Alerts.Enabled() {
+		return nil
+	}
+	alerter, err := alert.New(cfg.Alerts, cfg.Inverters)
+	if err != nil {
+		log.Fatal(err)
+	}
+	alerter.Start()
+	return alerter
+}
+
+// emulateOnNetwork serves one client after the other on a tcp:// or
+// rfc2217:// address.
+func emulateOnNetwork(listen string) {
+	l, err := serial.Listen(listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Emulating on %s\n", listen)
+	serial.SetupCloseHandler(l)
+
+	for {
+		transport, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Client connected")
+		if err := emulator.Serve(transport); err != nil {
+			log.Print(err)
+		}
+		transport.Close()
+		log.Println("Client disconnected")
+	}
+}
+
+// setupEmulator lets the emulator answer to all configured inverters,
+// emulate the configured site, keep its state in the configured file and
+// play the scenario.
+func setupEmulator() {
+	if err := cfg.Emulator.Site.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	emulator.SetSite(cfg.Emulator.Site)
+	if cfg.Emulator.State != "" {
+		device, err := emulator.OpenDevice(cfg.Emulator.State)
+		if err != nil {
+			log.Fatal(err)
+		}
+		emulator.SetDevice(device)
+	}
+	if cfg.Emulator.Scenario != "" {
+		scenario, err := emulator.LoadScenario(cfg.Emulator.Scenario)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Playing scenario %s\n", cfg.Emulator.Scenario)
+		emulator.SetScenario(scenario)
+	}
+	emulator.Addresses = nil
+	for _, inverter := range cfg.Inverters {
+		emulator.Addresses = append(emulator.Addresses, inverter.Address)
 	}
-	return PollInterval
 }
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/adangel/nt5000-serial/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var cmdConfig = &cobra.Command{
+	Use:   "config",
+	Short: "Work with the config file",
+}
+
+var cmdConfigValidate = &cobra.Command{
+	Use:   "validate [file]",
+	Short: "Check the config file and the environment variables",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("Invalid configuration:\n%v", err)
+		}
+		fmt.Println("Configuration is valid")
+		return nil
+	},
+}
+
+func init() {
+	cmdConfig.AddCommand(cmdConfigValidate)
+}
+
+// loadConfig applies the config file and the environment to cfg. Flags,
+// that are given explicitly, take precedence over both.
+func loadConfig(cmd *cobra.Command, args []string) error {
+	changed := make(map[*pflag.Flag]string)
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		if _, ok := f.Value.(pflag.SliceValue); !ok {
+			changed[f] = f.Value.String()
+		}
+	})
+
+	path := ConfigFile
+	if cmd == cmdConfigValidate && len(args) > 0 {
+		path = args[0]
+	}
+	if path == "" {
+		path = os.Getenv(config.EnvPrefix + "CONFIG")
+	}
+	if path != "" {
+		if err := config.Load(path, &cfg); err != nil {
+			return err
+		}
+	}
+	if err := cfg.ApplyEnv(os.LookupEnv); err != nil {
+		return err
+	}
+
+	for f, value := range changed {
+		if err := f.Value.Set(value); err != nil {
+			return err
+		}
+	}
+	flags := cmd.Flags()
+	if flags.Changed("port") {
+		cfg.Web.Listen = ":" + Port
+	}
+	if flags.Changed("poll") {
+		cfg.Web.Poll = time.Duration(PollInterval) * time.Second
+	}
+	if flags.Changed("address") {
+		inverters, err := config.ParseInverters(Addresses)
+		if err != nil {
+			return err
+		}
+		cfg.Inverters = inverters
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+var cmdMonthly = &cobra.Command{
+	Use:   "monthly",
+	Short: "Read the energy of the last 12 months (experimental)",
+	Run: func(cmd *cobra.Command, args []string) {
+		checkFormat()
+		client := connect()
+		defer client.Close()
+
+		log.Println("Reading monthly data (experimental, the values might be wrong)...")
+		months, err := client.ReadMonthlyEnergy()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		rows := make([]energyRow, 0, len(months))
+		for _, m := range months {
+			rows = append(rows, energyRow{Period: m.Date.Format("2006-01"), Energy: m.Energy})
+		}
+		printEnergy("Month", rows)
+	},
+}
+
+var cmdYearly = &cobra.Command{
+	Use:   "yearly",
+	Short: "Read the energy of the last 10 years (experimental)",
+	Run: func(cmd *cobra.Command, args []string) {
+		checkFormat()
+		client := connect()
+		defer client.Close()
+
+		log.Println("Reading yearly data (experimental, the values might be wrong)...")
+		years, err := client.ReadYearlyEnergy()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		rows := make([]energyRow, 0, len(years))
+		for _, y := range years {
+			rows = append(rows, energyRow{Period: y.Date.Format("2006"), Energy: y.Energy})
+		}
+		printEnergy("Year", rows)
+	},
+}
+
+var Format string
+
+func init() {
+	cmdMonthly.Flags().StringVarP(&Format, "format", "f", "table", "Output format: table, json or csv")
+	cmdYearly.Flags().StringVarP(&Format, "format", "f", "table", "Output format: table, json or csv")
+}
+
+// energyRow is one line of the monthly or yearly output.
+type energyRow struct {
+	Period string
+	Energy float32 // kWh
+}
+
+func printEnergy(period string, rows []energyRow) {
+	switch Format {
+	case "json":
+		bytes, err := json.MarshalIndent(rows, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(bytes))
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{period, "Energy (kWh)"})
+		for _, row := range rows {
+			w.Write([]string{row.Period, strconv.FormatFloat(float64(row.Energy), 'f', 1, 32)})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			log.Fatal(err)
+		}
+	case "table":
+		fmt.Printf("%-8s    Energy\n", period)
+		for _, row := range rows {
+			fmt.Printf("%-8s % 8.1f kWh\n", row.Period, row.Energy)
+		}
+	}
+}
+
+func checkFormat() {
+	if Format != "table" && Format != "json" && Format != "csv" {
+		log.Fatalf("Unknown format %q, use table, json or csv\n", Format)
+	}
+}
@@ -0,0 +1,352 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adangel/nt5000-serial/alert"
+	"github.com/adangel/nt5000-serial/emulator"
+	"github.com/adangel/nt5000-serial/history"
+	"github.com/adangel/nt5000-serial/influx"
+	"github.com/adangel/nt5000-serial/mqtt"
+	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/pvoutput"
+	"github.com/adangel/nt5000-serial/sunspec"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of all environment variables. The name of the
+// variable is the path of the setting in upper case, e.g. NT5000_MQTT_PASSWORD
+// for the setting password in the section mqtt.
+const EnvPrefix = "NT5000_"
+
+// Config contains all settings. Settings, that aren't in the file, keep their
+// default values.
+type Config struct {
+	Serial Serial `yaml:"serial"`
+	// Inverters are the inverters on the bus. In the environment, they are
+	// given like the flag --address, e.g. NT5000_INVERTERS=roof=1,garage=2.
+	Inverters []protocol.Inverter `yaml:"inverters"`
+	Web       Web                 `yaml:"web"`
+	History   History             `yaml:"history"`
+	MQTT      MQTT                `yaml:"mqtt"`
+	Influx    influx.Options      `yaml:"influx"`
+	PVOutput  pvoutput.Options    `yaml:"pvoutput"`
+	SunSpec   SunSpec             `yaml:"sunspec"`
+	Alerts    alert.Options       `yaml:"alerts"`
+	Emulator  Emulator            `yaml:"emulator"`
+}
+
+// Serial configures the serial port.
+type Serial struct {
+	Port string `yaml:"port"`
+	// USBID finds the port by the USB vendor and product id (VID:PID).
+	USBID string `yaml:"usb_id"`
+	// USBSerial finds the port by the USB serial number.
+	USBSerial string `yaml:"usb_serial"`
+	// Emulate uses the built-in emulator instead of the serial port.
+	Emulate bool `yaml:"emulate"`
+}
+
+// Web configures the web server.
+type Web struct {
+	Listen string        `yaml:"listen"`
+	Poll   time.Duration `yaml:"poll"`
+}
+
+// History configures the history store. It's disabled, if Dir is empty.
+type History struct {
+	Dir            string `yaml:"dir"`
+	history.Policy `yaml:",inline"`
+}
+
+// MQTT configures the MQTT publisher. It's disabled, if no broker is given.
+type MQTT struct {
+	mqtt.Options `yaml:",inline"`
+	// HomeAssistant publishes the discovery configs for Home Assistant.
+	HomeAssistant bool `yaml:"homeassistant"`
+}
+
+// SunSpec configures the Modbus TCP server. It's disabled, if Listen is
+// empty.
+type SunSpec struct {
+	Listen string `yaml:"listen"`
+	Model  uint16 `yaml:"model"`
+}
+
+// Emulator configures the emulator, that is used by the command emulator
+// and with Serial.Emulate.
+type Emulator struct {
+	emulator.Site `yaml:",inline"`
+	// Scenario is a YAML file with events, that let the emulator misbehave.
+	Scenario string `yaml:"scenario"`
+	// State is a file, that keeps the clock and the error memory of the
+	// emulated inverter across restarts.
+	State string `yaml:"state"`
+}
+
+// Default returns the default settings.
+func Default() Config {
+	return Config{
+		Serial:    Serial{Port: "/dev/ttyUSB0"},
+		Inverters: []protocol.Inverter{protocol.NewInverter(protocol.DefaultAddress)},
+		Web:       Web{Listen: ":8080", Poll: 5 * time.Second},
+		History:   History{Dir: "nt5000-history", Policy: history.DefaultPolicy},
+		MQTT: MQTT{Options: mqtt.Options{
+			ClientID:        "nt5000-serial",
+			TopicPrefix:     mqtt.DefaultTopicPrefix,
+			DiscoveryPrefix: mqtt.DefaultDiscoveryPrefix,
+		}},
+		Influx:   influx.DefaultOptions,
+		PVOutput: pvoutput.DefaultOptions,
+		SunSpec:  SunSpec{Model: sunspec.SinglePhase},
+		Emulator: Emulator{Site: emulator.DefaultSite},
+	}
+}
+
+// Load reads the YAML file into c. Unknown settings are an error, so that
+// typos don't go unnoticed.
+func Load(path string, c *Config) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("Invalid config file %s: %v\n", path, err)
+	}
+	for i, inverter := range c.Inverters {
+		if inverter.Name == "" {
+			c.Inverters[i].Name = protocol.NewInverter(inverter.Address).Name
+		}
+	}
+	return nil
+}
+
+// ApplyEnv overrides the settings with the environment variables, that are
+// set. lookup is usually os.LookupEnv.
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	return applyEnv(reflect.ValueOf(c).Elem(), EnvPrefix, lookup)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+var invertersType = reflect.TypeOf([]protocol.Inverter{})
+
+func applyEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if options == "inline" {
+			if err := applyEnv(v.Field(i), prefix, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		if name == "" || name == "-" {
+			continue
+		}
+		key := prefix + strings.ToUpper(name)
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnv(v.Field(i), key+"_", lookup); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := lookup(key)
+		if !ok {
+			continue
+		}
+		if err := set(v.Field(i), value); err != nil {
+			return fmt.Errorf("Invalid value %q of %s: %v\n", value, key, err)
+		}
+	}
+	return nil
+}
+
+func set(field reflect.Value, value string) error {
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case field.Type() == invertersType:
+		inverters, err := ParseInverters(strings.Split(value, ","))
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(inverters))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case field.CanInt():
+		i, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case field.CanUint():
+		u, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(u)
+	case field.CanFloat():
+		f, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %v", field.Type())
+	}
+	return nil
+}
+
+// ParseInverters parses the inverters like the flag --address. Each value is
+// either an address or name=address.
+func ParseInverters(values []string) ([]protocol.Inverter, error) {
+	var result []protocol.Inverter
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		name, address, found := strings.Cut(value, "=")
+		if !found {
+			address = name
+			name = ""
+		}
+		a, err := strconv.ParseUint(address, 10, 8)
+		if err != nil || a == 0 || a == uint64(protocol.BroadcastAddress) {
+			return nil, fmt.Errorf("Invalid address %q, use a number between 1 and 254\n", value)
+		}
+		inverter := protocol.NewInverter(byte(a))
+		if name != "" {
+			inverter.Name = name
+		}
+		result = append(result, inverter)
+	}
+	return result, nil
+}
+
+// Errors are all problems found by Validate.
+type Errors []error
+
+func (e Errors) Error() string {
+	var b strings.Builder
+	for _, err := range e {
+		b.WriteString(strings.TrimSpace(err.Error()))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// validName returns true, if the name only contains letters, digits, _ and -.
+// The name is used in MQTT topics, Home Assistant ids and file names, where
+// other characters like / or + have a meaning.
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks all settings of the enabled features. It returns Errors
+// with all problems found.
+func (c Config) Validate() error {
+	var errs Errors
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if c.Serial.USBID != "" {
+		vid, pid, found := strings.Cut(c.Serial.USBID, ":")
+		if _, err := strconv.ParseUint(vid, 16, 16); err != nil || !found {
+			check(fmt.Errorf("Invalid USB id %q, use VID:PID, e.g. 0403:6001\n", c.Serial.USBID))
+		} else if _, err := strconv.ParseUint(pid, 16, 16); err != nil {
+			check(fmt.Errorf("Invalid USB id %q, use VID:PID, e.g. 0403:6001\n", c.Serial.USBID))
+		}
+	}
+
+	if len(c.Inverters) == 0 {
+		check(fmt.Errorf("No inverters given\n"))
+	}
+	names := make(map[string]bool)
+	addresses := make(map[byte]bool)
+	for _, inverter := range c.Inverters {
+		if inverter.Address == 0 || inverter.Address == protocol.BroadcastAddress {
+			check(fmt.Errorf("Invalid address %v of inverter %s, use a number between 1 and 254\n", inverter.Address, inverter.Name))
+		}
+		if addresses[inverter.Address] {
+			check(fmt.Errorf("Address %v is used by more than one inverter\n", inverter.Address))
+		}
+		if !validName(inverter.Name) {
+			check(fmt.Errorf("Invalid name %q of inverter %v, use only letters, digits, _ and -\n", inverter.Name, inverter.Address))
+		}
+		if names[inverter.Name] {
+			check(fmt.Errorf("Name %s is used by more than one inverter\n", inverter.Name))
+		}
+		addresses[inverter.Address] = true
+		names[inverter.Name] = true
+	}
+
+	if _, _, err := net.SplitHostPort(c.Web.Listen); err != nil {
+		check(fmt.Errorf("Invalid listen address %q of the web server: %v\n", c.Web.Listen, err))
+	}
+	if c.Web.Poll <= 0 {
+		check(fmt.Errorf("Invalid poll interval %v\n", c.Web.Poll))
+	}
+
+	if c.History.Dir != "" {
+		check(c.History.Policy.Validate())
+	}
+	if c.MQTT.Broker != "" {
+		check(c.MQTT.Options.Validate())
+	}
+	if c.Influx.URL != "" {
+		check(c.Influx.Validate())
+	}
+	if c.PVOutput.APIKey != "" || c.PVOutput.SystemID != "" {
+		check(c.PVOutput.Validate())
+	}
+	if c.SunSpec.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.SunSpec.Listen); err != nil {
+			check(fmt.Errorf("Invalid listen address %q of the SunSpec server: %v\n", c.SunSpec.Listen, err))
+		}
+		_, err := sunspec.New(nil, c.SunSpec.Model)
+		check(err)
+	}
+	check(c.Alerts.Validate())
+	check(c.Emulator.Site.Validate())
+	if c.Emulator.Scenario != "" {
+		_, err := emulator.LoadScenario(c.Emulator.Scenario)
+		check(err)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/config"
+	"github.com/adangel/nt5000-serial/protocol"
+)
+
+func write(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Couldn't write config: %v\n", err)
+	}
+	return path
+}
+
+func TestExample(t *testing.T) {
+	c := config.Default()
+	if err := config.Load("../nt5000-serial.example.yaml", &c); err != nil {
+		t.Fatalf("Couldn't load example: %v\n", err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Example is invalid: %v\n", err)
+	}
+	if len(c.Inverters) != 2 || c.Inverters[1] != (protocol.Inverter{Name: "garage", Address: 2}) {
+		t.Fatalf("Wrong inverters %v\n", c.Inverters)
+	}
+	if c.Alerts.Offline != 15*time.Minute || c.History.Resolution != 5*time.Minute {
+		t.Fatalf("Wrong durations %v %v\n", c.Alerts.Offline, c.History.Resolution)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := write(t, `
+inverters:
+  - address: 3
+web:
+  poll: 10m
+mqtt:
+  broker: tcp://localhost:1883
+`)
+	c := config.Default()
+	if err := config.Load(path, &c); err != nil {
+		t.Fatalf("Couldn't load: %v\n", err)
+	}
+	if len(c.Inverters) != 1 || c.Inverters[0] != protocol.NewInverter(3) {
+		t.Fatalf("Wrong inverters %v\n", c.Inverters)
+	}
+	// the poll interval isn't limited anymore
+	if c.Web.Poll != 10*time.Minute {
+		t.Fatalf("Wrong poll interval %v\n", c.Web.Poll)
+	}
+	// defaults are kept
+	if c.Web.Listen != ":8080" || c.MQTT.TopicPrefix != "nt5000" || c.MQTT.Broker != "tcp://localhost:1883" {
+		t.Fatalf("Wrong settings %+v %+v\n", c.Web, c.MQTT)
+	}
+}
+
+func TestLoadUnknownSetting(t *testing.T) {
+	c := config.Default()
+	err := config.Load(write(t, "mqtt:\n  brokr: tcp://localhost:1883\n"), &c)
+	if err == nil || !strings.Contains(err.Error(), "brokr") {
+		t.Fatalf("Expected error for unknown setting, got %v\n", err)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"NT5000_SERIAL_PORT":           "/dev/ttyS1",
+		"NT5000_INVERTERS":             "roof=1,2",
+		"NT5000_WEB_POLL":              "1m",
+		"NT5000_HISTORY_RAW_RETENTION": "48h",
+		"NT5000_MQTT_PASSWORD":         "secret",
+		"NT5000_MQTT_QOS":              "1",
+		"NT5000_MQTT_HOMEASSISTANT":    "true",
+		"NT5000_PVOUTPUT_API_KEY":      "key",
+		"NT5000_ALERTS_TEMPERATURE":    "70.5",
+	}
+	c := config.Default()
+	err := c.ApplyEnv(func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	})
+	if err != nil {
+		t.Fatalf("Couldn't apply env: %v\n", err)
+	}
+	if c.Serial.Port != "/dev/ttyS1" || c.Web.Poll != time.Minute || c.History.RawRetention != 48*time.Hour {
+		t.Fatalf("Wrong settings %+v %+v %+v\n", c.Serial, c.Web, c.History)
+	}
+	if c.MQTT.Password != "secret" || c.MQTT.QoS != 1 || !c.MQTT.HomeAssistant {
+		t.Fatalf("Wrong MQTT settings %+v\n", c.MQTT)
+	}
+	if c.PVOutput.APIKey != "key" || c.Alerts.Temperature != 70.5 {
+		t.Fatalf("Wrong settings %+v %+v\n", c.PVOutput, c.Alerts)
+	}
+	if len(c.Inverters) != 2 || c.Inverters[0].Name != "roof" || c.Inverters[1] != protocol.NewInverter(2) {
+		t.Fatalf("Wrong inverters %v\n", c.Inverters)
+	}
+
+	err = c.ApplyEnv(func(key string) (string, bool) {
+		return "soon", key == "NT5000_WEB_POLL"
+	})
+	if err == nil || !strings.Contains(err.Error(), "NT5000_WEB_POLL") {
+		t.Fatalf("Expected error for invalid value, got %v\n", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := config.Default().Validate(); err != nil {
+		t.Fatalf("Defaults are invalid: %v\n", err)
+	}
+
+	c := config.Default()
+	c.Inverters = []protocol.Inverter{{Name: "a", Address: 1}, {Name: "b", Address: 1}, {Name: "c", Address: 255}}
+	c.Web.Poll = 0
+	c.MQTT.Broker = "localhost"
+	c.PVOutput.APIKey = "key"
+	c.SunSpec.Listen = ":502"
+	c.SunSpec.Model = 102
+	err := c.Validate()
+	errs, ok := err.(config.Errors)
+	if !ok || len(errs) != 6 {
+		t.Fatalf("Expected 6 errors, got %v\n", err)
+	}
+
+	// names end up in MQTT topics and file names
+	for _, name := range []string{"roof/west", "roof+", "#", "roof west", ""} {
+		c := config.Default()
+		c.Inverters = []protocol.Inverter{{Name: name, Address: 1}}
+		if err := c.Validate(); err == nil {
+			t.Fatalf("Expected error for name %q\n", name)
+		}
+	}
+	c = config.Default()
+	c.Inverters = []protocol.Inverter{{Name: "roof_West-2", Address: 1}}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Valid name rejected: %v\n", err)
+	}
+}
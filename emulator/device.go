@@ -0,0 +1,205 @@
+package emulator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/adangel/nt5000-serial/protocol"
+)
+
+// errorSlots is the number of entries in the error memory. Each read
+// returns two of them.
+const errorSlots = 10
+
+// Device is the clock and the error memory of the emulated inverter. The
+// error memory is a ring, that overwrites the oldest entry. If the device
+// has been opened with a path, every change is saved there.
+type Device struct {
+	mu sync.Mutex
+	// offset is the difference between the clock of the device and the
+	// clock of the host.
+	offset time.Duration
+	// entries is the ring of errors, head is the next entry to write.
+	entries [errorSlots]protocol.Error
+	head    int
+	path    string
+}
+
+// deviceState is the content of the file of a device.
+type deviceState struct {
+	ClockOffset time.Duration
+	Errors      []protocol.Error
+}
+
+// NewDevice returns a device with the time of the host and a grid
+// frequency error from yesterday evening in the error memory.
+func NewDevice() *Device {
+	d := &Device{}
+	yesterday := time.Now().Local().AddDate(0, 0, -1)
+	d.add(protocol.Error{
+		Date: time.Date(yesterday.Year(), yesterday.Month(), yesterday.Day(), 20, 3, 0, 0, time.Local),
+		Code: 0x11,
+	})
+	return d
+}
+
+// OpenDevice loads the device from the file at path. If the file doesn't
+// exist, it starts with a new device.
+func OpenDevice(path string) (*Device, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		d := NewDevice()
+		d.path = path
+		return d, d.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state deviceState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("Invalid device state %s: %v\n", path, err)
+	}
+	d := &Device{offset: state.ClockOffset, path: path}
+	for i := len(state.Errors) - 1; i >= 0; i-- {
+		d.add(state.Errors[i])
+	}
+	return d, nil
+}
+
+// Now returns the time of the clock of the device.
+func (d *Device) Now() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.now()
+}
+
+func (d *Device) now() time.Time {
+	return d.clock(time.Now())
+}
+
+func (d *Device) clock(t time.Time) time.Time {
+	return t.Add(d.offset).Local()
+}
+
+// Clock converts a time of the host to the clock of the device.
+func (d *Device) Clock(t time.Time) time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.clock(t)
+}
+
+// Set changes one part of the clock like the set commands do. Hour and
+// minute are sent with one added, e.g. 15 for 14 o'clock.
+func (d *Device) Set(command protocol.Command, value byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t := d.now()
+	year, month, day, hour, minute, second := t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second()
+	switch command {
+	case protocol.SetYear:
+		year = int(value) + 2000
+	case protocol.SetMonth:
+		if value < 1 || value > 12 {
+			return fmt.Errorf("Invalid month %v\n", value)
+		}
+		month = time.Month(value)
+	case protocol.SetDay:
+		if value < 1 || value > 31 {
+			return fmt.Errorf("Invalid day %v\n", value)
+		}
+		day = int(value)
+	case protocol.SetHour:
+		if value < 1 || value > 24 {
+			return fmt.Errorf("Invalid hour %v, it must be sent with one added\n", value)
+		}
+		hour = int(value) - 1
+	case protocol.SetMinute:
+		if value < 1 || value > 60 {
+			return fmt.Errorf("Invalid minute %v, it must be sent with one added\n", value)
+		}
+		minute = int(value) - 1
+		second = 0
+	default:
+		return fmt.Errorf("Unknown set command %v\n", command)
+	}
+	// e.g. the 31st, when the month is changed to February
+	if days := time.Date(year, month+1, 0, 0, 0, 0, 0, time.Local).Day(); day > days {
+		day = days
+	}
+
+	set := time.Date(year, month, day, hour, minute, second, t.Nanosecond(), time.Local)
+	d.offset += set.Sub(t)
+	return d.save()
+}
+
+// AddError writes an error to the error memory.
+func (d *Device) AddError(e protocol.Error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.add(e)
+	return d.save()
+}
+
+func (d *Device) add(e protocol.Error) {
+	d.entries[d.head] = e
+	d.head = (d.head + 1) % errorSlots
+}
+
+// Errors returns the error memory, the newest entry first.
+func (d *Device) Errors() []protocol.Error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.errors()
+}
+
+func (d *Device) errors() []protocol.Error {
+	var result []protocol.Error
+	for i := 1; i <= errorSlots; i++ {
+		e := d.entries[(d.head-i+errorSlots)%errorSlots]
+		if e.Date.IsZero() {
+			break
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+// Slot returns the two entries of the error memory, that are read with the
+// given slot from 1 to 5.
+func (d *Device) Slot(slot byte) []protocol.Error {
+	if slot < 1 || int(slot) > errorSlots/2 {
+		return nil
+	}
+	all := d.Errors()
+	start := int(slot-1) * 2
+	if start >= len(all) {
+		return nil
+	}
+	end := start + 2
+	if end > len(all) {
+		end = len(all)
+	}
+	return all[start:end]
+}
+
+// save writes the device to its file, if it has one.
+func (d *Device) save() error {
+	if d.path == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(deviceState{ClockOffset: d.offset, Errors: d.errors()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp := d.path + ".tmp"
+	if err := os.WriteFile(temp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, d.path)
+}
@@ -0,0 +1,92 @@
+package emulator_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/emulator"
+	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/serial"
+)
+
+func TestSetTime(t *testing.T) {
+	emulator.SetDevice(emulator.NewDevice())
+	t.Cleanup(func() { emulator.SetDevice(emulator.NewDevice()) })
+	client := serial.NewClient(serial.NewMemoryTransport(emulator.Respond))
+	defer client.Close()
+
+	set := time.Date(2021, 2, 28, 14, 0, 0, 0, time.Local)
+	if err := client.SetTime(set); err != nil {
+		t.Fatalf("Couldn't set time: %v\n", err)
+	}
+	read, err := client.ReadTime()
+	if err != nil {
+		t.Fatalf("Couldn't read time: %v\n", err)
+	}
+	if !read.Equal(set) && !read.Equal(set.Add(time.Minute)) {
+		t.Fatalf("Expected %v, got %v\n", set, read)
+	}
+}
+
+func TestSetInvalid(t *testing.T) {
+	d := emulator.NewDevice()
+	before := d.Now()
+	// hour and minute are sent with one added, so 0 is invalid
+	if err := d.Set(protocol.SetHour, 0); err == nil {
+		t.Fatalf("Expected error for hour 0\n")
+	}
+	if err := d.Set(protocol.SetMonth, 13); err == nil {
+		t.Fatalf("Expected error for month 13\n")
+	}
+	if d.Now().Sub(before) > time.Second {
+		t.Fatalf("Clock changed to %v\n", d.Now())
+	}
+}
+
+func TestErrorRing(t *testing.T) {
+	d := emulator.NewDevice()
+	start := time.Date(2022, 4, 1, 12, 0, 0, 0, time.Local)
+	for i := 0; i < 12; i++ {
+		d.AddError(protocol.Error{Date: start.Add(time.Duration(i) * time.Hour), Code: byte(0x20 + i)})
+	}
+
+	entries := d.Errors()
+	if len(entries) != 10 || entries[0].Code != 0x2b || entries[9].Code != 0x22 {
+		t.Fatalf("Expected the newest 10 errors, got %v\n", entries)
+	}
+	slot := d.Slot(2)
+	if len(slot) != 2 || slot[0].Code != 0x29 || slot[1].Code != 0x28 {
+		t.Fatalf("Wrong errors in slot 2: %v\n", slot)
+	}
+	if d.Slot(6) != nil {
+		t.Fatalf("Expected no slot 6\n")
+	}
+}
+
+func TestDeviceState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "device.json")
+	d, err := emulator.OpenDevice(path)
+	if err != nil {
+		t.Fatalf("Couldn't open device: %v\n", err)
+	}
+	if err := d.Set(protocol.SetYear, 20); err != nil {
+		t.Fatalf("Couldn't set year: %v\n", err)
+	}
+	added := protocol.Error{Date: time.Date(2020, 5, 1, 10, 30, 0, 0, time.Local), Code: 0x17}
+	if err := d.AddError(added); err != nil {
+		t.Fatalf("Couldn't add error: %v\n", err)
+	}
+
+	reopened, err := emulator.OpenDevice(path)
+	if err != nil {
+		t.Fatalf("Couldn't reopen device: %v\n", err)
+	}
+	if reopened.Now().Year() != 2020 {
+		t.Fatalf("Clock wasn't restored: %v\n", reopened.Now())
+	}
+	entries := reopened.Errors()
+	if len(entries) != 2 || !entries[0].Date.Equal(added.Date) || entries[0].Code != added.Code {
+		t.Fatalf("Error memory wasn't restored: %v\n", entries)
+	}
+}
@@ -1,60 +1,163 @@
 package emulator
 
 import (
+	"errors"
 	"log"
-	"math/rand"
 	"time"
 
 	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/serial"
 )
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
-}
+// model produces the data of the emulated inverter.
+var model = NewModel(DefaultSite, time.Now().UnixNano())
 
-var emulatedData protocol.DataPoint = protocol.DataPoint{
-	EnergyTotal: 1000.0 * rand.Float32(),
+// SetSite changes the emulated site. The energy counters start again.
+func SetSite(site Site) {
+	model = NewModel(site, time.Now().UnixNano())
 }
-var lastReading int64 = 0
 
+// ProduceDataPoint returns the current values of the emulated inverter.
 func ProduceDataPoint() protocol.DataPoint {
-	now := time.Now()
-
-	emulatedData.Date = now.Local()
-	emulatedData.DC.Power = 4500.0 * rand.Float32()
-	emulatedData.DC.Voltage = float32(500.0)
-	emulatedData.DC.Current = emulatedData.DC.Power / emulatedData.DC.Voltage
-	emulatedData.AC.Power = emulatedData.DC.Power
-	emulatedData.AC.Voltage = float32(230.0)
-	emulatedData.AC.Current = emulatedData.AC.Power / emulatedData.AC.Voltage
-	emulatedData.Temperature = 60*rand.Float32() - 20 // between -20°C/+40°C
-	emulatedData.HeatFlux = 100 * rand.Float32()
-
-	if lastReading > 0 {
-		millis := now.UnixMilli() - lastReading
-		energy := emulatedData.DC.Power * float32(millis) / 1000.0 / 3600.0 / 1000.0
-		emulatedData.EnergyDay += energy
-		emulatedData.EnergyTotal += energy
-		log.Printf("Energy %v Wh in last %v ms\n", energy, millis)
-		log.Printf("Updated energyDay=%v\n", emulatedData.EnergyDay)
-	}
-	lastReading = now.UnixMilli()
-	return emulatedData
-}
-
-func CurrentTimeBytes() []byte {
-	data := make([]byte, 13)
+	return model.At(time.Now())
+}
+
+// device is the clock and the error memory of the emulated inverter.
+var device = NewDevice()
+
+// SetDevice replaces the clock and the error memory, e.g. with one, that is
+// saved to a file.
+func SetDevice(d *Device) {
+	device = d
+}
+
+// Addresses are the addresses on the bus, the emulator answers to.
+var Addresses = []byte{protocol.DefaultAddress}
+
+func answers(address byte) bool {
+	if address == protocol.BroadcastAddress {
+		return true
+	}
+	for _, a := range Addresses {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve answers all requests received on the transport with Handle, until
+// it's closed.
+func Serve(transport serial.Transport) error {
+	for {
+		request, err := transport.ReadFrame(protocol.RequestLength)
+		if errors.Is(err, serial.ErrTimeout) {
+			// ignore incomplete or no data
+			continue
+		}
+		if errors.Is(err, serial.ErrNotConnected) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("Received %v bytes: 0x%x\n", len(request), request)
+
+		response := Handle(request)
+		if response != nil {
+			err = transport.WriteFrame(response)
+			if err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+// Respond answers a request frame like a NT5000 would. It returns nil for
+// requests that don't have a response.
+func Respond(data []byte) []byte {
+	request, err := protocol.ParseRequest(data)
+	if err != nil {
+		log.Printf("Invalid request %x: %v\n", data, err)
+		return nil
+	}
+	if !answers(request.Address) {
+		return nil
+	}
+
+	switch request.Command {
+	case protocol.ReadData:
+		log.Printf("Read data\n")
+		return protocol.ConvertToByte(ProduceDataPoint())
+	case protocol.ReadTime:
+		log.Printf("Read time\n")
+		return protocol.ConvertTimeToByte(device.Now())
+	case protocol.SetYear, protocol.SetMonth, protocol.SetDay, protocol.SetHour, protocol.SetMinute:
+		if err := device.Set(request.Command, request.Parameter); err != nil {
+			log.Print(err)
+		} else {
+			log.Printf("%v --> %v\n", request.Command, device.Now().Format(time.ANSIC))
+		}
+	case protocol.ReadSerialNumber:
+		log.Printf("Read serial number\n")
+		return protocol.ConvertSerialNumberToByte("1533A5012345")
+	case protocol.ReadProtocolAndFirmware:
+		log.Printf("Read protocol + firmware\n")
+		return protocol.ConvertProtocolAndFirmwareToByte("11", "1-23")
+	case protocol.ReadErrors:
+		log.Printf("Read errors %v\n", request.Parameter)
+		return protocol.ConvertErrorsToByte(device.Slot(request.Parameter))
+	case protocol.ReadMonthlyEnergy:
+		log.Printf("Read monthly data %v\n", request.Parameter)
+		return protocol.ConvertMonthlyEnergyToByte(ProduceMonthlyEnergy(int(request.Parameter)))
+	case protocol.ReadYearlyEnergy:
+		log.Printf("Read yearly data %v\n", request.Parameter)
+		return protocol.ConvertYearlyEnergyToByte(ProduceYearlyEnergy(int(request.Parameter)))
+	default:
+		log.Printf("Unknown command: %v\n", request.Command)
+	}
+	return nil
+}
+
+// typicalMonthlyYield is the energy in kWh per installed kWp for each month
+// of a typical year in central Europe.
+var typicalMonthlyYield = [12]float32{25, 45, 80, 115, 135, 140, 140, 120, 90, 60, 30, 20}
+
+// ProduceMonthlyEnergy returns the energy for the given slot. Slot 1 is the
+// current month, slot 2 the month before and so on up to 12.
+func ProduceMonthlyEnergy(slot int) protocol.MonthlyEnergy {
+	if slot < 1 || slot > 12 {
+		return protocol.MonthlyEnergy{}
+	}
+
 	now := time.Now().Local()
-	data[0] = byte(now.Year() - 2000)
-	data[1] = byte(now.Month())
-	data[2] = byte(now.Day())
-	data[3] = byte(now.Hour())
-	data[4] = byte(now.Minute())
-	for i := 5; i < 12; i++ {
-		data[i] = 0x0d
+	month := time.Date(now.Year(), now.Month()-time.Month(slot-1), 1, 0, 0, 0, 0, time.Local)
+	energy := typicalMonthlyYield[month.Month()-1] * float32(model.Site().Peak)
+	if slot == 1 {
+		daysInMonth := time.Date(now.Year(), now.Month()+1, 0, 0, 0, 0, 0, time.Local).Day()
+		energy = energy * float32(now.Day()) / float32(daysInMonth)
 	}
+	return protocol.MonthlyEnergy{Date: month, Energy: energy}
+}
 
-	protocol.CalculateChecksum(data)
+// ProduceYearlyEnergy returns the energy for the given slot. Slot 1 is the
+// current year, slot 2 the year before and so on up to 10.
+func ProduceYearlyEnergy(slot int) protocol.YearlyEnergy {
+	if slot < 1 || slot > 10 {
+		return protocol.YearlyEnergy{}
+	}
 
-	return data
+	now := time.Now().Local()
+	year := time.Date(now.Year()-(slot-1), time.January, 1, 0, 0, 0, 0, time.Local)
+	var energy float32
+	if slot == 1 {
+		for i := 1; i <= int(now.Month()); i++ {
+			energy += ProduceMonthlyEnergy(i).Energy
+		}
+	} else {
+		for _, yield := range typicalMonthlyYield {
+			energy += yield * float32(model.Site().Peak)
+		}
+	}
+	return protocol.YearlyEnergy{Date: year, Energy: energy}
 }
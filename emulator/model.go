@@ -0,0 +1,291 @@
+package emulator
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/adangel/nt5000-serial/protocol"
+)
+
+// Site describes the emulated PV system.
+type Site struct {
+	// Latitude and Longitude of the site in degrees, north and east are
+	// positive.
+	Latitude  float64 `yaml:"latitude"`
+	Longitude float64 `yaml:"longitude"`
+	// Peak is the installed power of the modules in kWp.
+	Peak float64 `yaml:"peak"`
+	// Tilt of the modules in degrees, 0 is horizontal.
+	Tilt float64 `yaml:"tilt"`
+	// Azimuth is the orientation of the modules in degrees, 180 is south.
+	Azimuth float64 `yaml:"azimuth"`
+	// Clouds is the average cloud cover from 0 (always clear) to 1 (always
+	// overcast).
+	Clouds float64 `yaml:"clouds"`
+}
+
+// DefaultSite is a typical roof in central Europe.
+var DefaultSite = Site{Latitude: 47.4, Longitude: 8.5, Peak: 4.5, Tilt: 30, Azimuth: 180, Clouds: 0.3}
+
+// Validate checks, that all values are in range.
+func (s Site) Validate() error {
+	switch {
+	case s.Latitude < -90 || s.Latitude > 90:
+		return fmt.Errorf("Invalid latitude %v, use -90 to 90\n", s.Latitude)
+	case s.Longitude < -180 || s.Longitude > 180:
+		return fmt.Errorf("Invalid longitude %v, use -180 to 180\n", s.Longitude)
+	case s.Peak <= 0 || s.Peak > maxPeak:
+		return fmt.Errorf("Invalid peak power %v kWp, use up to %v kWp\n", s.Peak, maxPeak)
+	case s.Tilt < 0 || s.Tilt > 90:
+		return fmt.Errorf("Invalid tilt %v, use 0 to 90\n", s.Tilt)
+	case s.Azimuth < 0 || s.Azimuth >= 360:
+		return fmt.Errorf("Invalid azimuth %v, use 0 to 359\n", s.Azimuth)
+	case s.Clouds < 0 || s.Clouds > 1:
+		return fmt.Errorf("Invalid cloud cover %v, use 0 to 1\n", s.Clouds)
+	}
+	return nil
+}
+
+const (
+	// maxPeak is the largest system, whose values can still be encoded.
+	maxPeak = 10
+	// ratedPower is the maximum AC power of the inverter in kW.
+	ratedPower = 4.6
+	// startPower is the DC power in kW, below which the inverter is off.
+	startPower = 0.02
+	// mppVoltage is the DC voltage at the maximum power point under
+	// standard test conditions (1000 W/m², 25 °C).
+	mppVoltage = 500.0
+	// openVoltage is the DC voltage without load.
+	openVoltage = 600.0
+	gridVoltage = 230.0
+	// The DC voltages, that can be encoded in the protocol.
+	minVoltage = 100.0
+	maxVoltage = 814.0
+	// powerCoefficient is the change of the module power per °C.
+	powerCoefficient = -0.004
+	// voltageCoefficient is the change of the module voltage per °C.
+	voltageCoefficient = -0.0035
+	// systemLosses are the losses of wiring, dirt and mismatch.
+	systemLosses = 0.03
+	// step is the longest interval, over which the energy is integrated.
+	step = time.Minute
+	// The energy counters of the inverter wrap around at these values in
+	// kWh.
+	maxEnergyDay   = 65.536
+	maxEnergyTotal = 65536
+)
+
+// Model simulates a NT5000 with the modules of a site. The power follows
+// the sun, reduced by clouds, that drift randomly.
+type Model struct {
+	mu    sync.Mutex
+	site  Site
+	rand  *rand.Rand
+	last  time.Time
+	state state
+	// clouds is the part of the clear sky irradiance, that gets through the
+	// clouds.
+	clouds      float64
+	energyDay   float64
+	energyTotal float64
+}
+
+// state is the operating point at one moment.
+type state struct {
+	irradiance  float64
+	temperature float64
+	dcVoltage   float64
+	dcPower     float64
+	acVoltage   float64
+	acPower     float64
+}
+
+// NewModel returns a model of the site. The same seed produces the same
+// clouds.
+func NewModel(site Site, seed int64) *Model {
+	r := rand.New(rand.NewSource(seed))
+	return &Model{
+		site:        site,
+		rand:        r,
+		clouds:      1 - site.Clouds*0.7,
+		energyTotal: site.Peak * 950 * (1 + 4*r.Float64()),
+	}
+}
+
+// At advances the model to the given time and returns the values, the
+// inverter would report. The energy of the day starts at midnight local
+// time. The first call integrates the energy since midnight.
+func (m *Model) At(now time.Time) protocol.DataPoint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.last.IsZero() || now.Sub(m.last) > 24*time.Hour {
+		m.last = startOfDay(now)
+		m.energyDay = 0
+	}
+	for m.last.Before(now) {
+		next := m.last.Add(step)
+		if next.After(now) {
+			next = now
+		}
+		midnight := startOfDay(m.last).AddDate(0, 0, 1)
+		if next.After(midnight) {
+			next = midnight
+		}
+		hours := next.Sub(m.last).Hours()
+		m.driftClouds(hours)
+		m.state = m.operatingPoint(next)
+		m.energyDay += m.state.acPower * hours
+		m.energyTotal += m.state.acPower * hours
+		m.last = next
+		if next.Equal(midnight) {
+			m.energyDay = 0
+		}
+	}
+	if m.state == (state{}) {
+		m.state = m.operatingPoint(now)
+	}
+
+	s := m.state
+	return protocol.DataPoint{
+		Date:        now.Local(),
+		DC:          measurement(s.dcVoltage, s.dcPower),
+		AC:          measurement(s.acVoltage, s.acPower),
+		Temperature: float32(s.temperature),
+		HeatFlux:    float32(s.irradiance),
+		EnergyDay:   float32(math.Mod(m.energyDay, maxEnergyDay)),
+		EnergyTotal: float32(math.Mod(m.energyTotal, maxEnergyTotal)),
+	}
+}
+
+// SetEnergyTotal sets the total energy in kWh.
+func (m *Model) SetEnergyTotal(energy float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.energyTotal = energy
+}
+
+// Site returns the emulated site.
+func (m *Model) Site() Site {
+	return m.site
+}
+
+func measurement(voltage float64, power float64) protocol.Measurement {
+	return protocol.Measurement{
+		Voltage: float32(voltage),
+		Current: float32(power * 1000 / voltage),
+		Power:   float32(power),
+	}
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.Local()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// driftClouds lets the cloud transmittance wander around its average.
+func (m *Model) driftClouds(hours float64) {
+	average := 1 - m.site.Clouds*0.7
+	volatility := 0.05 + 0.6*m.site.Clouds
+	m.clouds += 2*(average-m.clouds)*hours + volatility*math.Sqrt(hours)*m.rand.NormFloat64()
+	m.clouds = math.Max(0.1, math.Min(1, m.clouds))
+}
+
+// operatingPoint calculates the values of the inverter at the given time.
+func (m *Model) operatingPoint(t time.Time) state {
+	var s state
+	s.irradiance = m.site.irradiance(t) * m.clouds
+	s.temperature = m.site.ambientTemperature(t) + s.irradiance/800*25
+	s.acVoltage = gridVoltage + 3*m.rand.NormFloat64()
+
+	s.dcPower = m.site.Peak * s.irradiance / 1000 * (1 + powerCoefficient*(s.temperature-25)) * (1 - systemLosses)
+	if s.dcPower < startPower {
+		// the inverter is off, only the open voltage of the modules is left
+		s.dcPower = 0
+		s.dcVoltage = minVoltage
+		if s.irradiance > 0 {
+			s.dcVoltage = clamp(openVoltage*(1+0.05*math.Log(s.irradiance/1000)), minVoltage, maxVoltage)
+		}
+		return s
+	}
+	s.dcVoltage = clamp(mppVoltage*(1+voltageCoefficient*(s.temperature-25))*(1+0.03*math.Log(s.irradiance/1000)), minVoltage, maxVoltage)
+	s.acPower = math.Min(s.dcPower-losses(s.dcPower), ratedPower)
+	if s.acPower < 0 {
+		s.acPower = 0
+	}
+	return s
+}
+
+// losses returns the losses of the inverter in kW at the given DC power.
+// The constant part dominates at low power, the quadratic part at full
+// power, with the best efficiency of about 96% in between.
+func losses(dcPower float64) float64 {
+	return 0.007*ratedPower + 0.01*dcPower + 0.02*dcPower*dcPower/ratedPower
+}
+
+func clamp(value float64, min float64, max float64) float64 {
+	return math.Max(min, math.Min(max, value))
+}
+
+// ambientTemperature is warmest in summer and in the afternoon.
+func (s Site) ambientTemperature(t time.Time) float64 {
+	season := -math.Cos(2 * math.Pi * float64(t.YearDay()-15) / 365)
+	if s.Latitude < 0 {
+		season = -season
+	}
+	local := t.UTC().Add(time.Duration(s.Longitude / 15 * float64(time.Hour)))
+	hour := float64(local.Hour()) + float64(local.Minute())/60
+	daily := math.Sin(2 * math.Pi * (hour - 9) / 24)
+	return 10 + 10*season + 5*daily
+}
+
+// irradiance returns the clear sky irradiance on the modules in W/m².
+func (s Site) irradiance(t time.Time) float64 {
+	elevation, azimuth := sunPosition(s.Latitude, s.Longitude, t)
+	if elevation <= 0 {
+		return 0
+	}
+	zenith := 90 - degrees(elevation)
+	airMass := 1 / (math.Cos(radians(zenith)) + 0.50572*math.Pow(96.07995-zenith, -1.6364))
+	direct := 1353 * math.Pow(0.7, math.Pow(airMass, 0.678))
+	diffuse := 0.1 * direct
+	global := direct*math.Sin(elevation) + diffuse
+
+	tilt := radians(s.Tilt)
+	incidence := math.Sin(elevation)*math.Cos(tilt) + math.Cos(elevation)*math.Sin(tilt)*math.Cos(azimuth-radians(s.Azimuth))
+	return direct*math.Max(incidence, 0) + diffuse*(1+math.Cos(tilt))/2 + 0.2*global*(1-math.Cos(tilt))/2
+}
+
+// sunPosition returns the elevation and the azimuth of the sun in radians.
+// The azimuth is measured clockwise from north.
+func sunPosition(latitude float64, longitude float64, t time.Time) (float64, float64) {
+	t = t.UTC()
+	day := float64(t.YearDay())
+	hours := float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600
+	b := 2 * math.Pi * (day - 81) / 364
+	equationOfTime := 9.87*math.Sin(2*b) - 7.53*math.Cos(b) - 1.5*math.Sin(b)
+	solarTime := hours + longitude/15 + equationOfTime/60
+
+	hourAngle := radians(15 * (solarTime - 12))
+	declination := radians(23.45 * math.Sin(2*math.Pi*(284+day)/365))
+	lat := radians(latitude)
+	sinElevation := math.Sin(lat)*math.Sin(declination) + math.Cos(lat)*math.Cos(declination)*math.Cos(hourAngle)
+	elevation := math.Asin(sinElevation)
+	azimuth := math.Atan2(-math.Sin(hourAngle)*math.Cos(declination)*math.Cos(lat), math.Sin(declination)-sinElevation*math.Sin(lat))
+	if azimuth < 0 {
+		azimuth += 2 * math.Pi
+	}
+	return elevation, azimuth
+}
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+func degrees(radians float64) float64 {
+	return radians * 180 / math.Pi
+}
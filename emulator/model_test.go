@@ -0,0 +1,101 @@
+package emulator_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/emulator"
+	"github.com/adangel/nt5000-serial/protocol"
+)
+
+var clearSky = local(emulator.Site{Latitude: 47.4, Peak: 4.5, Tilt: 30, Azimuth: 180})
+
+// local moves the site to the longitude of the local time zone, so that
+// the sun is up at noon local time.
+func local(site emulator.Site) emulator.Site {
+	_, offset := time.Date(2022, 6, 21, 12, 0, 0, 0, time.Local).Zone()
+	site.Longitude = float64(offset) / 240
+	return site
+}
+
+func TestNight(t *testing.T) {
+	m := emulator.NewModel(local(emulator.DefaultSite), 1)
+	data := m.At(time.Date(2022, 6, 21, 1, 0, 0, 0, time.Local))
+	if data.DC.Power != 0 || data.AC.Power != 0 || data.HeatFlux != 0 || data.EnergyDay != 0 {
+		t.Fatalf("Expected no power at night, got %+v\n", data)
+	}
+}
+
+func TestNoon(t *testing.T) {
+	m := emulator.NewModel(clearSky, 1)
+	data := m.At(time.Date(2022, 6, 21, 12, 30, 0, 0, time.Local))
+	if data.AC.Power < 2.5 || data.AC.Power > 4.6 {
+		t.Fatalf("Wrong AC power %v kW\n", data.AC.Power)
+	}
+	efficiency := data.AC.Power / data.DC.Power
+	if efficiency < 0.93 || efficiency >= 1 {
+		t.Fatalf("Wrong efficiency %v\n", efficiency)
+	}
+	if data.HeatFlux < 700 || data.Temperature < 30 {
+		t.Fatalf("Wrong irradiance %v or module temperature %v\n", data.HeatFlux, data.Temperature)
+	}
+	if math.Abs(float64(data.DC.Voltage*data.DC.Current/1000-data.DC.Power)) > 0.01 {
+		t.Fatalf("DC current doesn't match the power: %+v\n", data.DC)
+	}
+}
+
+func TestWinterIsWeaker(t *testing.T) {
+	summer := emulator.NewModel(clearSky, 1).At(time.Date(2022, 6, 21, 23, 0, 0, 0, time.Local))
+	winter := emulator.NewModel(clearSky, 1).At(time.Date(2022, 12, 21, 23, 0, 0, 0, time.Local))
+	if winter.EnergyDay <= 0 || winter.EnergyDay >= summer.EnergyDay/2 {
+		t.Fatalf("Wrong daily energy, summer %v kWh, winter %v kWh\n", summer.EnergyDay, winter.EnergyDay)
+	}
+}
+
+func TestRollover(t *testing.T) {
+	m := emulator.NewModel(local(emulator.DefaultSite), 1)
+	start := time.Date(2022, 6, 21, 8, 0, 0, 0, time.Local)
+	first := m.At(start)
+	evening := m.At(start.Add(12 * time.Hour))
+	if evening.EnergyDay <= first.EnergyDay || evening.EnergyTotal <= first.EnergyTotal {
+		t.Fatalf("Energy didn't increase: %+v %+v\n", first, evening)
+	}
+	next := m.At(start.Add(18 * time.Hour))
+	if next.EnergyDay != 0 || next.EnergyTotal < evening.EnergyTotal {
+		t.Fatalf("Daily energy wasn't reset: %+v\n", next)
+	}
+}
+
+func TestEncodable(t *testing.T) {
+	site := local(emulator.DefaultSite)
+	site.Peak = 10
+	m := emulator.NewModel(site, 1)
+	start := time.Date(2022, 6, 21, 0, 0, 0, 0, time.Local)
+	for minutes := 0; minutes < 24*60; minutes += 10 {
+		data := m.At(start.Add(time.Duration(minutes) * time.Minute))
+		decoded, err := protocol.Convert(protocol.ConvertToByte(data))
+		if err != nil {
+			t.Fatalf("Couldn't decode %+v: %v\n", data, err)
+		}
+		if math.Abs(float64(decoded.DC.Voltage-data.DC.Voltage)) > 3 || math.Abs(float64(decoded.AC.Current-data.AC.Current)) > 0.2 {
+			t.Fatalf("Value out of range at %v: %+v became %+v\n", data.Date, data, decoded)
+		}
+	}
+}
+
+func TestValidateSite(t *testing.T) {
+	if err := emulator.DefaultSite.Validate(); err != nil {
+		t.Fatalf("Default site is invalid: %v\n", err)
+	}
+	for _, site := range []emulator.Site{
+		{Latitude: 91, Peak: 1},
+		{Peak: 0},
+		{Peak: 1, Azimuth: 360},
+		{Peak: 1, Clouds: 2},
+	} {
+		if err := site.Validate(); err == nil {
+			t.Fatalf("Expected error for %+v\n", site)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package emulator
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/adangel/nt5000-serial/protocol"
+	"gopkg.in/yaml.v3"
+)
+
+// The types of events. Drop, Corrupt, Truncate, Slow, Offline and Night
+// affect the responses while the event lasts, Fault and Wrap happen once.
+const (
+	// Drop doesn't answer.
+	Drop = "drop"
+	// Corrupt answers with a wrong checksum.
+	Corrupt = "corrupt"
+	// Truncate answers only the first half of the response.
+	Truncate = "truncate"
+	// Slow answers after Delay.
+	Slow = "slow"
+	// Offline doesn't answer at all, like an inverter without power.
+	Offline = "offline"
+	// Night doesn't answer, while the inverter produces no power.
+	Night = "night"
+	// Fault writes an error with Code to the error memory.
+	Fault = "fault"
+	// Wrap sets the total energy Energy kWh below the point, where the
+	// counter wraps around.
+	Wrap = "wrap"
+)
+
+// Scenario schedules misbehaviour of the emulator.
+type Scenario struct {
+	Events []Event `yaml:"events"`
+}
+
+// Event is something, that happens at a certain time after the start of the
+// emulator.
+type Event struct {
+	Type string `yaml:"type"`
+	// At is the time after the start, when the event happens first.
+	At time.Duration `yaml:"at"`
+	// For is how long the event lasts, 0 means until the emulator stops.
+	For time.Duration `yaml:"for"`
+	// Every repeats the event, 0 means only once.
+	Every time.Duration `yaml:"every"`
+	// Probability is the chance, that a response is affected, while the
+	// event lasts. 0 means always. Fault and Wrap don't support it.
+	Probability float64 `yaml:"probability"`
+	// Address limits the event to one inverter, 0 means all inverters.
+	// Fault and Wrap don't support it, because all emulated inverters share
+	// the error memory and the energy.
+	Address byte `yaml:"address"`
+	// Delay is the delay of Slow.
+	Delay time.Duration `yaml:"delay"`
+	// Code is the error code of Fault, 0x11 (grid frequency) if not set.
+	Code byte `yaml:"code"`
+	// Energy is the energy in kWh of Wrap, that is left until the counter
+	// wraps around, 1 kWh if not set.
+	Energy float64 `yaml:"energy"`
+}
+
+// LoadScenario reads a scenario from a YAML file.
+func LoadScenario(path string) (Scenario, error) {
+	var s Scenario
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&s); err != nil {
+		return s, fmt.Errorf("Invalid scenario %s: %v\n", path, err)
+	}
+	if err := s.Validate(); err != nil {
+		return s, fmt.Errorf("Invalid scenario %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Validate checks all events.
+func (s Scenario) Validate() error {
+	for i, e := range s.Events {
+		switch {
+		case e.Type != Drop && e.Type != Corrupt && e.Type != Truncate && e.Type != Slow &&
+			e.Type != Offline && e.Type != Night && e.Type != Fault && e.Type != Wrap:
+			return fmt.Errorf("Unknown type %q of event %d\n", e.Type, i+1)
+		case e.At < 0 || e.For < 0 || e.Every < 0:
+			return fmt.Errorf("Negative duration in event %d\n", i+1)
+		case e.Probability < 0 || e.Probability > 1:
+			return fmt.Errorf("Invalid probability %v of event %d, use 0 to 1\n", e.Probability, i+1)
+		case e.Type == Slow && e.Delay <= 0:
+			return fmt.Errorf("Missing delay of event %d\n", i+1)
+		case e.Energy < 0 || e.Energy >= maxEnergyTotal:
+			return fmt.Errorf("Invalid energy %v of event %d\n", e.Energy, i+1)
+		case e.once() && (e.Address != 0 || e.Probability != 0):
+			return fmt.Errorf("Event %d of type %s doesn't support address and probability\n", i+1, e.Type)
+		}
+	}
+	return nil
+}
+
+// once returns true for the events, that happen once instead of lasting.
+func (e Event) once() bool {
+	return e.Type == Fault || e.Type == Wrap
+}
+
+// occurrences returns how often the event has started after elapsed.
+func (e Event) occurrences(elapsed time.Duration) int {
+	if elapsed < e.At {
+		return 0
+	}
+	if e.Every == 0 {
+		return 1
+	}
+	return 1 + int((elapsed-e.At)/e.Every)
+}
+
+// active returns true, if the event lasts at elapsed.
+func (e Event) active(elapsed time.Duration) bool {
+	if elapsed < e.At {
+		return false
+	}
+	since := elapsed - e.At
+	if e.Every > 0 {
+		since %= e.Every
+	}
+	return e.For == 0 || since < e.For
+}
+
+// player plays a scenario.
+type player struct {
+	scenario Scenario
+	start    time.Time
+	rand     *rand.Rand
+
+	mu sync.Mutex
+	// happened counts, how often each event has happened.
+	happened []int
+}
+
+var (
+	scenarioMu sync.Mutex
+	current    *player
+)
+
+// SetScenario starts playing the scenario now. All requests answered by
+// Handle are affected by it.
+func SetScenario(s Scenario) {
+	scenarioMu.Lock()
+	defer scenarioMu.Unlock()
+	current = &player{
+		scenario: s,
+		start:    time.Now(),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		happened: make([]int, len(s.Events)),
+	}
+}
+
+// Handle answers a request like Respond, but misbehaves as the scenario
+// says.
+func Handle(request []byte) []byte {
+	scenarioMu.Lock()
+	p := current
+	scenarioMu.Unlock()
+	if p == nil {
+		return Respond(request)
+	}
+	return p.handle(request)
+}
+
+func (p *player) handle(data []byte) []byte {
+	now := time.Now()
+	elapsed := now.Sub(p.start)
+	var address byte
+	if request, err := protocol.ParseRequest(data); err == nil {
+		address = request.Address
+	}
+
+	// the model is asked outside the lock and only once
+	night := false
+	for _, e := range p.scenario.Events {
+		if e.Type == Night {
+			night = model.At(now).AC.Power == 0
+			break
+		}
+	}
+
+	p.mu.Lock()
+	var drop, corrupt, truncate bool
+	var delay time.Duration
+	// once-only events are performed after the lock has been released, as
+	// a fault is written to disk
+	var due []occurrence
+	for i, e := range p.scenario.Events {
+		if e.once() {
+			for p.happened[i] < e.occurrences(elapsed) {
+				due = append(due, occurrence{e, p.start.Add(e.At + time.Duration(p.happened[i])*e.Every)})
+				p.happened[i]++
+			}
+			continue
+		}
+		if !e.active(elapsed) || (e.Address != 0 && e.Address != address) {
+			continue
+		}
+		if e.Probability > 0 && p.rand.Float64() >= e.Probability {
+			continue
+		}
+		switch e.Type {
+		case Drop, Offline:
+			drop = true
+		case Night:
+			drop = drop || night
+		case Corrupt:
+			corrupt = true
+		case Truncate:
+			truncate = true
+		case Slow:
+			if e.Delay > delay {
+				delay = e.Delay
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	for _, o := range due {
+		happen(o.event, o.date)
+	}
+
+	if drop {
+		log.Printf("Scenario: not answering\n")
+		return nil
+	}
+	response := Respond(data)
+	if response == nil {
+		return nil
+	}
+	if delay > 0 {
+		log.Printf("Scenario: answering after %v\n", delay)
+		time.Sleep(delay)
+	}
+	if corrupt {
+		log.Printf("Scenario: corrupting checksum\n")
+		response[len(response)-1]++
+	}
+	if truncate {
+		log.Printf("Scenario: truncating response\n")
+		response = response[:len(response)/2]
+	}
+	return response
+}
+
+// occurrence is an event, that happens once, at the given date.
+type occurrence struct {
+	event Event
+	date  time.Time
+}
+
+// happen performs an event, that happens once, at the given date.
+func happen(e Event, date time.Time) {
+	switch e.Type {
+	case Fault:
+		code := e.Code
+		if code == 0 {
+			code = 0x11
+		}
+		log.Printf("Scenario: fault 0x%02x\n", code)
+		entry := protocol.Error{Date: device.Clock(date).Truncate(time.Minute), Code: code}
+		if err := device.AddError(entry); err != nil {
+			log.Print(err)
+		}
+	case Wrap:
+		energy := e.Energy
+		if energy == 0 {
+			energy = 1
+		}
+		log.Printf("Scenario: total energy wraps around in %v kWh\n", energy)
+		model.SetEnergyTotal(maxEnergyTotal - energy)
+	}
+}
@@ -0,0 +1,104 @@
+package emulator_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/emulator"
+	"github.com/adangel/nt5000-serial/protocol"
+)
+
+func play(t *testing.T, events ...emulator.Event) {
+	emulator.SetScenario(emulator.Scenario{Events: events})
+	t.Cleanup(func() { emulator.SetScenario(emulator.Scenario{}) })
+}
+
+func request(command protocol.Command, parameter byte) []byte {
+	return protocol.NewRequest(command, parameter).Bytes()
+}
+
+func TestLoadScenario(t *testing.T) {
+	s, err := emulator.LoadScenario("../scenario.example.yaml")
+	if err != nil {
+		t.Fatalf("Couldn't load example: %v\n", err)
+	}
+	if len(s.Events) != 8 || s.Events[4].Code != 0x11 || s.Events[3].Delay != 1500*time.Millisecond {
+		t.Fatalf("Wrong events %+v\n", s.Events)
+	}
+
+	for _, content := range []string{
+		"events:\n  - type: explode\n",
+		"events:\n  - type: slow\n",
+		"events:\n  - type: drop\n    probability: 2\n",
+		"events:\n  - type: drop\n    when: 5m\n",
+		"events:\n  - type: fault\n    address: 2\n",
+		"events:\n  - type: wrap\n    probability: 0.5\n",
+	} {
+		path := filepath.Join(t.TempDir(), "scenario.yaml")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Couldn't write scenario: %v\n", err)
+		}
+		if _, err := emulator.LoadScenario(path); err == nil {
+			t.Fatalf("Expected error for %q\n", content)
+		}
+	}
+}
+
+func TestDrop(t *testing.T) {
+	play(t, emulator.Event{Type: emulator.Drop, Address: 1})
+	if response := emulator.Handle(request(protocol.ReadData, 0)); response != nil {
+		t.Fatalf("Expected no response, got 0x%x\n", response)
+	}
+
+	// other inverters and later events aren't affected
+	play(t, emulator.Event{Type: emulator.Drop, Address: 2}, emulator.Event{Type: emulator.Offline, At: time.Hour})
+	if response := emulator.Handle(request(protocol.ReadData, 0)); response == nil {
+		t.Fatalf("Expected response\n")
+	}
+}
+
+func TestCorruptAndTruncate(t *testing.T) {
+	play(t, emulator.Event{Type: emulator.Corrupt})
+	response := emulator.Handle(request(protocol.ReadSerialNumber, 1))
+	if len(response) != protocol.ResponseLength || protocol.VerifyChecksum(response) == nil {
+		t.Fatalf("Expected wrong checksum, got 0x%x\n", response)
+	}
+
+	play(t, emulator.Event{Type: emulator.Truncate})
+	response = emulator.Handle(request(protocol.ReadSerialNumber, 1))
+	if len(response) >= protocol.ResponseLength {
+		t.Fatalf("Expected truncated response, got 0x%x\n", response)
+	}
+}
+
+func TestSlow(t *testing.T) {
+	play(t, emulator.Event{Type: emulator.Slow, Delay: 50 * time.Millisecond})
+	start := time.Now()
+	if response := emulator.Handle(request(protocol.ReadData, 0)); response == nil {
+		t.Fatalf("Expected response\n")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("Expected delayed response, took %v\n", elapsed)
+	}
+}
+
+func TestFault(t *testing.T) {
+	play(t, emulator.Event{Type: emulator.Fault, Code: 0x22})
+	errors, err := protocol.ConvertErrors(emulator.Handle(request(protocol.ReadErrors, 1)))
+	if err != nil || len(errors) == 0 || errors[0].Code != 0x22 {
+		t.Fatalf("Expected fault 0x22, got %v %v\n", errors, err)
+	}
+	if time.Since(errors[0].Date) > time.Minute {
+		t.Fatalf("Wrong date of fault %v\n", errors[0].Date)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	play(t, emulator.Event{Type: emulator.Wrap, Energy: 0.5})
+	data, err := protocol.Convert(emulator.Handle(request(protocol.ReadData, 0)))
+	if err != nil || data.EnergyTotal < 65535 {
+		t.Fatalf("Expected total energy just before wrapping around, got %v %v\n", data.EnergyTotal, err)
+	}
+}
@@ -0,0 +1,150 @@
+package history
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/adangel/nt5000-serial/protocol"
+)
+
+// Aggregation defines how the data points of one interval are combined.
+type Aggregation int
+
+const (
+	// Average averages all values, except for the energy counters, which are
+	// taken from the last data point.
+	Average Aggregation = iota
+	Min
+	Max
+)
+
+func (a Aggregation) String() string {
+	switch a {
+	case Min:
+		return "min"
+	case Max:
+		return "max"
+	default:
+		return "avg"
+	}
+}
+
+// ParseAggregation returns the aggregation with the given name, one of avg,
+// min or max.
+func ParseAggregation(name string) (Aggregation, error) {
+	for _, a := range []Aggregation{Average, Min, Max} {
+		if name == a.String() {
+			return a, nil
+		}
+	}
+	return Average, fmt.Errorf("Invalid aggregation %q, use avg, min or max\n", name)
+}
+
+// Aggregate combines all data points within the same interval of the given
+// step into one. The intervals are aligned to the local time, so that a step
+// of 24h starts at midnight. The date of the result is the start of the
+// interval. The data points must be sorted by date.
+func Aggregate(points []protocol.DataPoint, step time.Duration, aggregation Aggregation) []protocol.DataPoint {
+	var result []protocol.DataPoint
+	for start := 0; start < len(points); {
+		bucket := bucketStart(points[start].Date, step)
+		end := start
+		for end < len(points) && bucketStart(points[end].Date, step).Equal(bucket) {
+			end++
+		}
+		var p protocol.DataPoint
+		switch aggregation {
+		case Min:
+			p = combine(points[start:end], min)
+		case Max:
+			p = combine(points[start:end], max)
+		default:
+			p = average(points[start:end])
+		}
+		p.Date = bucket
+		result = append(result, p)
+		start = end
+	}
+	return result
+}
+
+func bucketStart(t time.Time, step time.Duration) time.Time {
+	_, offset := t.Zone()
+	shift := time.Duration(offset) * time.Second
+	return t.Add(shift).Truncate(step).Add(-shift)
+}
+
+func average(points []protocol.DataPoint) protocol.DataPoint {
+	sum := combine(points, func(a, b float32) float32 { return a + b })
+	n := float32(len(points))
+	last := points[len(points)-1]
+	return protocol.DataPoint{
+		DC:          protocol.Measurement{Voltage: sum.DC.Voltage / n, Current: sum.DC.Current / n, Power: sum.DC.Power / n},
+		AC:          protocol.Measurement{Voltage: sum.AC.Voltage / n, Current: sum.AC.Current / n, Power: sum.AC.Power / n},
+		Temperature: sum.Temperature / n,
+		HeatFlux:    sum.HeatFlux / n,
+		EnergyDay:   last.EnergyDay,
+		EnergyTotal: last.EnergyTotal,
+	}
+}
+
+// combine applies f to all values of the data points.
+func combine(points []protocol.DataPoint, f func(a, b float32) float32) protocol.DataPoint {
+	result := points[0]
+	for _, p := range points[1:] {
+		result.DC = combineMeasurement(result.DC, p.DC, f)
+		result.AC = combineMeasurement(result.AC, p.AC, f)
+		result.Temperature = f(result.Temperature, p.Temperature)
+		result.HeatFlux = f(result.HeatFlux, p.HeatFlux)
+		result.EnergyDay = f(result.EnergyDay, p.EnergyDay)
+		result.EnergyTotal = f(result.EnergyTotal, p.EnergyTotal)
+	}
+	return result
+}
+
+func combineMeasurement(a, b protocol.Measurement, f func(a, b float32) float32) protocol.Measurement {
+	return protocol.Measurement{Voltage: f(a.Voltage, b.Voltage), Current: f(a.Current, b.Current), Power: f(a.Power, b.Power)}
+}
+
+func min(a, b float32) float32 {
+	if b < a {
+		return b
+	}
+	return a
+}
+
+func max(a, b float32) float32 {
+	if b > a {
+		return b
+	}
+	return a
+}
+
+// DailyYield is the energy harvested on one day.
+type DailyYield struct {
+	// Date is midnight of the day in local time.
+	Date   time.Time
+	Energy float32
+}
+
+// Daily returns the energy harvested per day by the given inverter for all
+// days with data between from and to. The energy of a day is the highest
+// daily energy counter, that has been stored on that day.
+func (s *Store) Daily(inverter string, from, to time.Time) ([]DailyYield, error) {
+	points, err := s.Query(inverter, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []DailyYield
+	for _, p := range points {
+		local := p.Date.Local()
+		day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.Local)
+		if len(result) == 0 || !result[len(result)-1].Date.Equal(day) {
+			result = append(result, DailyYield{Date: day})
+		}
+		last := &result[len(result)-1]
+		last.Energy = max(last.Energy, p.EnergyDay)
+	}
+	return result, nil
+}
@@ -0,0 +1,89 @@
+package history_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/history"
+	"github.com/adangel/nt5000-serial/protocol"
+)
+
+func TestAggregate(t *testing.T) {
+	start := time.Date(2022, 4, 10, 12, 0, 0, 0, time.Local)
+	points := []protocol.DataPoint{
+		dataPoint(start, 1, 1),
+		dataPoint(start.Add(10*time.Minute), 4, 2),
+		dataPoint(start.Add(20*time.Minute), 2, 3),
+		dataPoint(start.Add(time.Hour), 5, 4),
+	}
+
+	tests := []struct {
+		aggregation history.Aggregation
+		power       float32
+		energy      float32
+	}{
+		{history.Average, 7.0 / 3, 3},
+		{history.Min, 1, 1},
+		{history.Max, 4, 3},
+	}
+	for _, test := range tests {
+		result := history.Aggregate(points, time.Hour, test.aggregation)
+		if len(result) != 2 {
+			t.Fatalf("%v: expected 2 data points, got %v\n", test.aggregation, len(result))
+		}
+		if result[0].AC.Power != test.power {
+			t.Fatalf("%v: expected power %v, got %v\n", test.aggregation, test.power, result[0].AC.Power)
+		}
+		if result[0].EnergyDay != test.energy {
+			t.Fatalf("%v: expected energy %v, got %v\n", test.aggregation, test.energy, result[0].EnergyDay)
+		}
+		if !result[0].Date.Equal(start) || !result[1].Date.Equal(start.Add(time.Hour)) {
+			t.Fatalf("%v: wrong dates %v %v\n", test.aggregation, result[0].Date, result[1].Date)
+		}
+	}
+}
+
+func TestAggregateDaysInLocalTime(t *testing.T) {
+	start := time.Date(2022, 4, 10, 0, 30, 0, 0, time.Local)
+	result := history.Aggregate([]protocol.DataPoint{dataPoint(start, 1, 1)}, 24*time.Hour, history.Average)
+	if !result[0].Date.Equal(start.Add(-30 * time.Minute)) {
+		t.Fatalf("Expected midnight, got %v\n", result[0].Date)
+	}
+}
+
+func TestParseAggregation(t *testing.T) {
+	a, err := history.ParseAggregation("max")
+	if err != nil || a != history.Max {
+		t.Fatalf("Expected max, got %v %v\n", a, err)
+	}
+	_, err = history.ParseAggregation("sum")
+	if err == nil {
+		t.Fatalf("Expected error for invalid aggregation\n")
+	}
+}
+
+func TestDaily(t *testing.T) {
+	store, err := history.Open(t.TempDir(), history.DefaultPolicy)
+	if err != nil {
+		t.Fatalf("Couldn't open store: %v\n", err)
+	}
+	day := time.Date(2022, 4, 10, 0, 0, 0, 0, time.Local)
+	store.Append("roof", dataPoint(day.Add(10*time.Hour), 1, 2.5))
+	store.Append("roof", dataPoint(day.Add(18*time.Hour), 1, 12.25))
+	store.Append("roof", dataPoint(day.Add(23*time.Hour), 0, 0))
+	store.Append("roof", dataPoint(day.Add(36*time.Hour), 1, 5))
+
+	daily, err := store.Daily("roof", day, day.AddDate(0, 0, 2))
+	if err != nil {
+		t.Fatalf("Couldn't query: %v\n", err)
+	}
+	if len(daily) != 2 {
+		t.Fatalf("Expected 2 days, got %v\n", daily)
+	}
+	if !daily[0].Date.Equal(day) || daily[0].Energy != 12.25 {
+		t.Fatalf("Wrong first day: %v\n", daily[0])
+	}
+	if !daily[1].Date.Equal(day.AddDate(0, 0, 1)) || daily[1].Energy != 5 {
+		t.Fatalf("Wrong second day: %v\n", daily[1])
+	}
+}
@@ -0,0 +1,356 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adangel/nt5000-serial/protocol"
+)
+
+const (
+	dayFormat = "2006-01-02"
+	// rawSuffix is the suffix of files with all data points, that have been
+	// polled.
+	rawSuffix = ".jsonl"
+	// downsampledSuffix is the suffix of files, that have been compacted to
+	// one data point per Policy.Resolution.
+	downsampledSuffix = ".down.jsonl"
+)
+
+// Policy defines how long the data is kept.
+type Policy struct {
+	// RawRetention is how long all data points are kept. Older data is
+	// downsampled to Resolution. Zero keeps all data points forever.
+	RawRetention time.Duration `yaml:"raw_retention"`
+	// Resolution is the interval of the downsampled data.
+	Resolution time.Duration `yaml:"resolution"`
+	// Retention is how long data is kept at all. Zero keeps the data forever.
+	Retention time.Duration `yaml:"retention"`
+}
+
+// DefaultPolicy keeps all data points for a week and afterwards one data
+// point every 5 minutes forever.
+var DefaultPolicy = Policy{
+	RawRetention: 7 * 24 * time.Hour,
+	Resolution:   5 * time.Minute,
+}
+
+// Store keeps the data points of the inverters on disk. Every inverter has
+// its own directory, named after the inverter, with one file per day. Each
+// line of a file is one data point encoded as JSON.
+type Store struct {
+	dir    string
+	policy Policy
+	mu     sync.Mutex
+}
+
+// Validate checks, that the durations of the policy fit together.
+func (p Policy) Validate() error {
+	if p.RawRetention > 0 && p.Resolution <= 0 {
+		return fmt.Errorf("Invalid history policy, resolution must be positive\n")
+	}
+	if p.Retention > 0 && p.RawRetention > p.Retention {
+		return fmt.Errorf("Invalid history policy, raw retention %v is longer than retention %v\n", p.RawRetention, p.Retention)
+	}
+	return nil
+}
+
+// Open returns a store in the given directory. The directory is created,
+// if it doesn't exist.
+func Open(dir string, policy Policy) (*Store, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, policy: policy}, nil
+}
+
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Data adds the data point of the inverter and logs errors, so that the
+// store can be used as sink.
+func (s *Store) Data(inverter protocol.Inverter, data protocol.DataPoint) {
+	if err := s.Append(inverter.Name, data); err != nil {
+		log.Printf("Couldn't store history: %v\n", err)
+	}
+}
+
+// Append adds a data point of the given inverter.
+func (s *Store) Append(inverter string, data protocol.DataPoint) error {
+	line, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := s.inverterDir(inverter)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(dir, data.Date.Local().Format(dayFormat)+rawSuffix)
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Query returns all data points of the given inverter with from <= date < to,
+// sorted by date.
+func (s *Store) Query(inverter string, from, to time.Time) ([]protocol.DataPoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := s.files(inverter)
+	if err != nil {
+		return nil, err
+	}
+
+	first := from.Local().Format(dayFormat)
+	last := to.Local().Format(dayFormat)
+	var result []protocol.DataPoint
+	for _, f := range files {
+		if f.day < first || f.day > last {
+			continue
+		}
+		points, err := readFile(f.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range points {
+			if !p.Date.Before(from) && p.Date.Before(to) {
+				result = append(result, p)
+			}
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Date.Before(result[j].Date)
+	})
+	return result, nil
+}
+
+// Last returns the newest data point of the given inverter. If there is no
+// data, ok is false.
+func (s *Store) Last(inverter string) (data protocol.DataPoint, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := s.files(inverter)
+	if err != nil {
+		return protocol.DataPoint{}, false, err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		points, err := readFile(files[i].path)
+		if err != nil {
+			return protocol.DataPoint{}, false, err
+		}
+		for _, p := range points {
+			if !ok || p.Date.After(data.Date) {
+				data = p
+				ok = true
+			}
+		}
+		if ok {
+			return data, true, nil
+		}
+	}
+	return protocol.DataPoint{}, false, nil
+}
+
+// Inverters returns the names of all inverters, that have data.
+func (s *Store) Inverters() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, e := range entries {
+		if e.IsDir() {
+			result = append(result, e.Name())
+		}
+	}
+	return result, nil
+}
+
+// Compact applies the policy: files older than the retention are deleted and
+// files older than the raw retention are downsampled. Only complete days are
+// considered.
+func (s *Store) Compact(now time.Time) error {
+	inverters, err := s.Inverters()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, inverter := range inverters {
+		files, err := s.files(inverter)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			date, err := time.ParseInLocation(dayFormat, f.day, time.Local)
+			if err != nil {
+				continue
+			}
+			end := date.AddDate(0, 0, 1)
+
+			if s.policy.Retention > 0 && now.Sub(end) > s.policy.Retention {
+				log.Printf("Removing history %s\n", f.path)
+				err = os.Remove(f.path)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if s.policy.RawRetention > 0 && !f.downsampled && now.Sub(end) > s.policy.RawRetention {
+				log.Printf("Downsampling history %s\n", f.path)
+				err = s.downsampleFile(f)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Store) downsampleFile(f file) error {
+	points, err := readFile(f.path)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(f.path, rawSuffix) + downsampledSuffix
+	err = writeFile(name, Downsample(points, s.policy.Resolution))
+	if err != nil {
+		return err
+	}
+	return os.Remove(f.path)
+}
+
+// Downsample combines all data points within the same interval of the given
+// resolution into their average. The data points must be sorted by date.
+func Downsample(points []protocol.DataPoint, resolution time.Duration) []protocol.DataPoint {
+	return Aggregate(points, resolution, Average)
+}
+
+// file is one day of data of an inverter.
+type file struct {
+	path        string
+	day         string
+	downsampled bool
+}
+
+// files returns the files of the inverter sorted by day.
+func (s *Store) files(inverter string) ([]file, error) {
+	entries, err := os.ReadDir(s.inverterDir(inverter))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result []file
+	for _, e := range entries {
+		name := e.Name()
+		f := file{path: filepath.Join(s.inverterDir(inverter), name)}
+		switch {
+		case strings.HasSuffix(name, downsampledSuffix):
+			f.day = strings.TrimSuffix(name, downsampledSuffix)
+			f.downsampled = true
+		case strings.HasSuffix(name, rawSuffix):
+			f.day = strings.TrimSuffix(name, rawSuffix)
+		default:
+			continue
+		}
+		result = append(result, f)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].day < result[j].day
+	})
+	return result, nil
+}
+
+// inverterDir returns the directory of the inverter. Path separators in the
+// name are replaced, so that the directory is always within the store.
+func (s *Store) inverterDir(inverter string) string {
+	name := strings.NewReplacer("/", "_", "\\", "_").Replace(inverter)
+	if name == "" || name == "." || name == ".." {
+		name = "_" + name
+	}
+	return filepath.Join(s.dir, name)
+}
+
+func readFile(name string) ([]protocol.DataPoint, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var result []protocol.DataPoint
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var p protocol.DataPoint
+		if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+			// a partially written line, e.g. after a crash
+			log.Printf("Ignoring invalid line in %s: %v\n", name, err)
+			continue
+		}
+		result = append(result, p)
+	}
+	return result, scanner.Err()
+}
+
+// writeFile writes the data points into a temporary file first and renames
+// it, so that the file is never incomplete.
+func writeFile(name string, points []protocol.DataPoint) error {
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, p := range points {
+		line, err := json.Marshal(p)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
@@ -0,0 +1,148 @@
+package history_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/history"
+	"github.com/adangel/nt5000-serial/protocol"
+)
+
+func dataPoint(date time.Time, power float32, energy float32) protocol.DataPoint {
+	return protocol.DataPoint{
+		Date:        date,
+		AC:          protocol.Measurement{Voltage: 230, Power: power},
+		EnergyDay:   energy,
+		EnergyTotal: 1000 + energy,
+	}
+}
+
+func TestAppendAndQuery(t *testing.T) {
+	store, err := history.Open(t.TempDir(), history.DefaultPolicy)
+	if err != nil {
+		t.Fatalf("Couldn't open store: %v\n", err)
+	}
+
+	start := time.Date(2022, 4, 10, 23, 58, 0, 0, time.Local)
+	for i := 0; i < 4; i++ {
+		err := store.Append("roof", dataPoint(start.Add(time.Duration(i)*time.Minute), float32(i), 0))
+		if err != nil {
+			t.Fatalf("Couldn't append: %v\n", err)
+		}
+	}
+	store.Append("garage", dataPoint(start, 10, 0))
+
+	points, err := store.Query("roof", start.Add(time.Minute), start.Add(3*time.Minute))
+	if err != nil {
+		t.Fatalf("Couldn't query: %v\n", err)
+	}
+	if len(points) != 2 {
+		t.Fatalf("Expected 2 data points, got %v\n", len(points))
+	}
+	if points[0].AC.Power != 1 || points[1].AC.Power != 2 {
+		t.Fatalf("Wrong data points: %v\n", points)
+	}
+	if !points[1].Date.Equal(start.Add(2 * time.Minute)) {
+		t.Fatalf("Wrong date: %v\n", points[1].Date)
+	}
+
+	last, ok, err := store.Last("roof")
+	if err != nil || !ok {
+		t.Fatalf("No last data point: %v\n", err)
+	}
+	if last.AC.Power != 3 {
+		t.Fatalf("Wrong last data point: %v\n", last)
+	}
+
+	inverters, _ := store.Inverters()
+	if len(inverters) != 2 || inverters[0] != "garage" || inverters[1] != "roof" {
+		t.Fatalf("Wrong inverters: %v\n", inverters)
+	}
+
+	_, ok, _ = store.Last("unknown")
+	if ok {
+		t.Fatalf("Expected no data for unknown inverter\n")
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	start := time.Date(2022, 4, 10, 12, 0, 0, 0, time.UTC)
+	points := []protocol.DataPoint{
+		dataPoint(start, 1, 1),
+		dataPoint(start.Add(time.Minute), 3, 2),
+		dataPoint(start.Add(5*time.Minute), 5, 3),
+	}
+
+	result := history.Downsample(points, 5*time.Minute)
+	if len(result) != 2 {
+		t.Fatalf("Expected 2 data points, got %v\n", len(result))
+	}
+	if result[0].AC.Power != 2 || result[0].AC.Voltage != 230 {
+		t.Fatalf("Expected average, got %v\n", result[0].AC)
+	}
+	if result[0].EnergyDay != 2 || result[0].EnergyTotal != 1002 {
+		t.Fatalf("Expected last energy, got %v %v\n", result[0].EnergyDay, result[0].EnergyTotal)
+	}
+	if !result[1].Date.Equal(start.Add(5 * time.Minute)) {
+		t.Fatalf("Wrong date: %v\n", result[1].Date)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	store, err := history.Open(dir, history.Policy{
+		RawRetention: 24 * time.Hour,
+		Resolution:   time.Hour,
+		Retention:    10 * 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Couldn't open store: %v\n", err)
+	}
+
+	now := time.Date(2022, 4, 20, 12, 0, 0, 0, time.Local)
+	old := now.AddDate(0, 0, -15)
+	yesterday := now.AddDate(0, 0, -1)
+	week := now.AddDate(0, 0, -7)
+	for _, day := range []time.Time{old, week, yesterday, now} {
+		for i := 0; i < 60; i++ {
+			store.Append("roof", dataPoint(day.Add(time.Duration(i)*time.Minute), float32(i), 0))
+		}
+	}
+
+	err = store.Compact(now)
+	if err != nil {
+		t.Fatalf("Couldn't compact: %v\n", err)
+	}
+
+	expected := []string{"2022-04-13.down.jsonl", "2022-04-19.jsonl", "2022-04-20.jsonl"}
+	entries, _ := os.ReadDir(filepath.Join(dir, "roof"))
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected files %v, got %v\n", expected, entries)
+	}
+	for i, e := range entries {
+		if e.Name() != expected[i] {
+			t.Fatalf("Expected file %v, got %v\n", expected[i], e.Name())
+		}
+	}
+
+	points, _ := store.Query("roof", week, week.AddDate(0, 0, 1))
+	if len(points) != 1 {
+		t.Fatalf("Expected 1 downsampled data point, got %v\n", len(points))
+	}
+	if points[0].AC.Power != 29.5 {
+		t.Fatalf("Expected average power 29.5, got %v\n", points[0].AC.Power)
+	}
+	points, _ = store.Query("roof", yesterday, yesterday.AddDate(0, 0, 1))
+	if len(points) != 60 {
+		t.Fatalf("Expected 60 raw data points, got %v\n", len(points))
+	}
+}
+
+func TestInvalidPolicy(t *testing.T) {
+	_, err := history.Open(t.TempDir(), history.Policy{RawRetention: time.Hour})
+	if err == nil {
+		t.Fatalf("Expected error for missing resolution\n")
+	}
+}
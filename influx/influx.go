@@ -0,0 +1,561 @@
+package influx
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/sink"
+)
+
+// Options configure the connection to InfluxDB.
+type Options struct {
+	// URL of the database, e.g. http://localhost:8086 or udp://localhost:8089
+	// for the UDP listener of InfluxDB v1.
+	URL string `yaml:"url"`
+	// Version is the API version, 1 or 2. UDP ignores it.
+	Version int `yaml:"version"`
+
+	// Org, Bucket and Token are used by v2.
+	Org    string `yaml:"org"`
+	Bucket string `yaml:"bucket"`
+	Token  string `yaml:"token"`
+
+	// Database, Username and Password are used by v1.
+	Database string `yaml:"database"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// Measurement is the name of the measurement, nt5000 by default.
+	Measurement string `yaml:"measurement"`
+	// BatchSize is the number of data points, that are written at once.
+	BatchSize int `yaml:"batch_size"`
+	// FlushInterval is the maximum time a data point waits until it's
+	// written.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	// BufferDir is the directory, where data points are kept while the
+	// database is unreachable. Without it, at most MaxBuffer data points are
+	// kept in memory.
+	BufferDir string `yaml:"buffer"`
+	// MaxBuffer is the maximum number of data points kept in memory, while
+	// the database is unreachable.
+	MaxBuffer int `yaml:"max_buffer"`
+	// MaxBufferFile is the maximum number of data points kept in BufferDir.
+	// If there are more, the oldest are dropped.
+	MaxBufferFile int `yaml:"max_buffer_file"`
+}
+
+// DefaultOptions are used for all options, that aren't set.
+var DefaultOptions = Options{
+	Version:       2,
+	Measurement:   "nt5000",
+	BatchSize:     100,
+	FlushInterval: 10 * time.Second,
+	MaxBuffer:     10000,
+	MaxBufferFile: 100000,
+}
+
+// bufferFile is the name of the file in BufferDir.
+const bufferFile = "influx-buffer.lp"
+
+// maxDatagram is the maximum size of a UDP packet.
+const maxDatagram = 1400
+
+// Writer writes the data points as line protocol in batches.
+type Writer struct {
+	options Options
+	client  *http.Client
+	// send writes lines to the database.
+	send func(lines []string) error
+
+	// flushing makes sure, that only one flush runs at a time.
+	flushing sync.Mutex
+	// buffered is the number of lines in the file in BufferDir, -1 if it
+	// hasn't been counted yet. It's only used while flushing.
+	buffered int
+
+	mu      sync.Mutex
+	pending []string
+	serials map[string]string
+	flush   chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// New returns a writer, that flushes in the background until Close is called.
+func New(options Options) (*Writer, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	if options.Version == 0 {
+		options.Version = DefaultOptions.Version
+	}
+	if options.Measurement == "" {
+		options.Measurement = DefaultOptions.Measurement
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultOptions.BatchSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultOptions.FlushInterval
+	}
+	if options.MaxBuffer <= 0 {
+		options.MaxBuffer = DefaultOptions.MaxBuffer
+	}
+	if options.MaxBufferFile <= 0 {
+		options.MaxBufferFile = DefaultOptions.MaxBufferFile
+	}
+
+	w := &Writer{
+		options:  options,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		serials:  make(map[string]string),
+		buffered: -1,
+		flush:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	u, _ := url.Parse(options.URL)
+	switch {
+	case u.Scheme == "udp":
+		w.send = func(lines []string) error { return sendUDP(u.Host, lines) }
+	case options.Version == 2:
+		w.send = w.sendV2
+	default:
+		w.send = w.sendV1
+	}
+
+	if options.BufferDir != "" {
+		if err := os.MkdirAll(options.BufferDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// Validate checks, that the URL and the database are given.
+func (o Options) Validate() error {
+	if o.URL == "" {
+		return fmt.Errorf("No InfluxDB URL given\n")
+	}
+	u, err := url.Parse(o.URL)
+	if err != nil {
+		return err
+	}
+	version := o.Version
+	if version == 0 {
+		version = DefaultOptions.Version
+	}
+	switch {
+	case u.Scheme == "udp":
+		return nil
+	case u.Scheme != "http" && u.Scheme != "https":
+		return fmt.Errorf("Unsupported InfluxDB URL %s, use http, https or udp\n", o.URL)
+	case version == 2:
+		if o.Bucket == "" {
+			return fmt.Errorf("No InfluxDB bucket given\n")
+		}
+	case version == 1:
+		if o.Database == "" {
+			return fmt.Errorf("No InfluxDB database given\n")
+		}
+	default:
+		return fmt.Errorf("Unsupported InfluxDB version %v\n", o.Version)
+	}
+	return nil
+}
+
+// SetSerialNumber sets the serial number of the inverter, that is added as
+// tag "serial" to all following data points.
+func (w *Writer) SetSerialNumber(inverter protocol.Inverter, serialnumber string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.serials[inverter.Name] = serialnumber
+}
+
+// Info sets the serial number of the inverter, if it has been read.
+func (w *Writer) Info(inverter protocol.Inverter, info sink.Info) {
+	if info.SerialNumber != "" {
+		w.SetSerialNumber(inverter, info.SerialNumber)
+	}
+}
+
+// Data queues the data point. It's written once the batch is full or the
+// flush interval has passed.
+func (w *Writer) Data(inverter protocol.Inverter, data protocol.DataPoint) {
+	w.mu.Lock()
+	line := Line(w.options.Measurement, inverter, w.serials[inverter.Name], data)
+	w.pending = append(w.pending, line)
+	full := len(w.pending) >= w.options.BatchSize
+	w.mu.Unlock()
+
+	if full {
+		select {
+		case w.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close writes all pending data points.
+func (w *Writer) Close() error {
+	select {
+	case <-w.done:
+		return nil
+	default:
+		close(w.done)
+	}
+	<-w.stopped
+	return nil
+}
+
+func (w *Writer) run() {
+	defer close(w.stopped)
+	ticker := time.NewTicker(w.options.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			w.Flush()
+			return
+		case <-ticker.C:
+		case <-w.flush:
+		}
+		w.Flush()
+	}
+}
+
+// Flush writes all pending data points. Data points, that have been buffered
+// on disk, are written first. If the database is unreachable, the data
+// points are buffered. If only some batches could be written, all are
+// written again later. That's fine, because InfluxDB overwrites data points
+// with the same tags and timestamp.
+func (w *Writer) Flush() error {
+	w.flushing.Lock()
+	defer w.flushing.Unlock()
+
+	w.mu.Lock()
+	lines := w.pending
+	w.pending = nil
+	w.mu.Unlock()
+
+	err := w.sendBuffered()
+	if err == nil {
+		err = w.sendBatches(lines)
+	}
+	if isRejected(err) {
+		log.Printf("Dropping data points rejected by InfluxDB: %v\n", err)
+		return err
+	}
+	if isConfigError(err) {
+		log.Printf("InfluxDB refused to write, check the URL, credentials and bucket or database. Dropping %v data points: %v\n", len(lines), err)
+		return err
+	}
+	if err != nil {
+		log.Printf("Couldn't write to InfluxDB: %v\n", err)
+		w.buffer(lines)
+	}
+	return err
+}
+
+func (w *Writer) sendBatches(lines []string) error {
+	for len(lines) > 0 {
+		n := w.options.BatchSize
+		if n > len(lines) {
+			n = len(lines)
+		}
+		if err := w.send(lines[:n]); err != nil {
+			return err
+		}
+		lines = lines[n:]
+	}
+	return nil
+}
+
+// buffer keeps the lines, that couldn't be written, on disk or in memory.
+func (w *Writer) buffer(lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	if w.options.BufferDir != "" {
+		err := w.bufferFile(lines)
+		if err == nil {
+			return
+		}
+		log.Printf("Couldn't buffer data points: %v\n", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = append(lines, w.pending...)
+	if len(w.pending) > w.options.MaxBuffer {
+		dropped := len(w.pending) - w.options.MaxBuffer
+		log.Printf("Dropping %v data points for InfluxDB\n", dropped)
+		w.pending = w.pending[dropped:]
+	}
+}
+
+// bufferFile appends the lines to the file in BufferDir. If it has more than
+// MaxBufferFile lines afterwards, the oldest are dropped. It drops a tenth
+// more, so that the file isn't rewritten on every flush.
+func (w *Writer) bufferFile(lines []string) error {
+	name := filepath.Join(w.options.BufferDir, bufferFile)
+	if w.buffered < 0 {
+		buffered, err := readLines(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		w.buffered = len(buffered)
+	}
+	if err := appendLines(name, lines); err != nil {
+		return err
+	}
+	w.buffered += len(lines)
+	if w.buffered <= w.options.MaxBufferFile {
+		return nil
+	}
+
+	buffered, err := readLines(name)
+	if err != nil {
+		return err
+	}
+	keep := w.options.MaxBufferFile - w.options.MaxBufferFile/10
+	if keep > len(buffered) {
+		keep = len(buffered)
+	}
+	log.Printf("Dropping %v buffered data points for InfluxDB\n", len(buffered)-keep)
+	temp := name + ".tmp"
+	if err := os.WriteFile(temp, []byte(strings.Join(buffered[len(buffered)-keep:], "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	w.buffered = keep
+	return os.Rename(temp, name)
+}
+
+// sendBuffered writes the data points buffered on disk and removes the file
+// afterwards.
+func (w *Writer) sendBuffered() error {
+	if w.options.BufferDir == "" {
+		return nil
+	}
+	name := filepath.Join(w.options.BufferDir, bufferFile)
+	lines, err := readLines(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = w.sendBatches(lines)
+	if isRejected(err) {
+		log.Printf("Dropping buffered data points rejected by InfluxDB: %v\n", err)
+		w.buffered = 0
+		return os.Remove(name)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Written %v buffered data points to InfluxDB\n", len(lines))
+	w.buffered = 0
+	return os.Remove(name)
+}
+
+func (w *Writer) sendV2(lines []string) error {
+	query := url.Values{}
+	query.Set("org", w.options.Org)
+	query.Set("bucket", w.options.Bucket)
+	query.Set("precision", "s")
+	request, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(w.options.URL, "/")+"/api/v2/write?"+query.Encode(), body(lines))
+	if err != nil {
+		return err
+	}
+	if w.options.Token != "" {
+		request.Header.Set("Authorization", "Token "+w.options.Token)
+	}
+	return w.do(request)
+}
+
+func (w *Writer) sendV1(lines []string) error {
+	query := url.Values{}
+	query.Set("db", w.options.Database)
+	query.Set("precision", "s")
+	request, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(w.options.URL, "/")+"/write?"+query.Encode(), body(lines))
+	if err != nil {
+		return err
+	}
+	if w.options.Username != "" {
+		request.SetBasicAuth(w.options.Username, w.options.Password)
+	}
+	return w.do(request)
+}
+
+func (w *Writer) do(request *http.Request) error {
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return &StatusError{Status: response.Status, StatusCode: response.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	return nil
+}
+
+// StatusError is returned, if InfluxDB didn't accept the data points.
+type StatusError struct {
+	Status     string
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("InfluxDB returned %s: %s", e.Status, e.Message)
+}
+
+// isRejected returns true, if the data points are invalid. Writing them again
+// won't help.
+func isRejected(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusBadRequest
+}
+
+// isConfigError returns true, if the credentials are wrong or the bucket or
+// database doesn't exist. Nothing can be written, until it's fixed.
+func isConfigError(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return true
+	}
+	return false
+}
+
+func body(lines []string) io.Reader {
+	return strings.NewReader(strings.Join(lines, "\n") + "\n")
+}
+
+// sendUDP sends the lines in as few packets as possible.
+func sendUDP(address string, lines []string) error {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > maxDatagram {
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		packet.WriteString(line)
+		packet.WriteByte('\n')
+	}
+	if packet.Len() > 0 {
+		_, err = conn.Write(packet.Bytes())
+	}
+	return err
+}
+
+// Line returns the data point in line protocol. The inverter's name, address
+// and serial number (if known) are tags.
+func Line(measurement string, inverter protocol.Inverter, serialnumber string, data protocol.DataPoint) string {
+	var b strings.Builder
+	b.WriteString(escape(measurement, ", "))
+	b.WriteString(",inverter=" + escape(inverter.Name, ",= "))
+	b.WriteString(",address=" + strconv.Itoa(int(inverter.Address)))
+	if serialnumber != "" {
+		b.WriteString(",serial=" + escape(serialnumber, ",= "))
+	}
+
+	fields := []struct {
+		name  string
+		value float32
+	}{
+		{"udc", data.DC.Voltage},
+		{"idc", data.DC.Current},
+		{"pdc", data.DC.Power},
+		{"uac", data.AC.Voltage},
+		{"iac", data.AC.Current},
+		{"pac", data.AC.Power},
+		{"temp", data.Temperature},
+		{"flux", data.HeatFlux},
+		{"wd", data.EnergyDay},
+		{"wtot", data.EnergyTotal},
+	}
+	for i, f := range fields {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(f.name + "=" + strconv.FormatFloat(float64(f.value), 'f', -1, 32))
+	}
+	b.WriteString(" " + strconv.FormatInt(data.Date.Unix(), 10))
+	return b.String()
+}
+
+// escape escapes the given characters and backslashes with a backslash.
+func escape(s string, chars string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r == '\\' || strings.ContainsRune(chars, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func appendLines(name string, lines []string) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, strings.Join(lines, "\n")+"\n")
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readLines(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
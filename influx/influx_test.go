@@ -0,0 +1,261 @@
+package influx_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/influx"
+	"github.com/adangel/nt5000-serial/protocol"
+)
+
+var data = protocol.DataPoint{
+	Date:        time.Unix(1649620983, 0),
+	DC:          protocol.Measurement{Voltage: 497.6, Current: 1.4, Power: 0.7},
+	AC:          protocol.Measurement{Voltage: 230, Current: 3.2, Power: 0.736},
+	Temperature: 21,
+	HeatFlux:    210,
+	EnergyTotal: 374,
+}
+
+func TestLine(t *testing.T) {
+	line := influx.Line("nt5000", protocol.Inverter{Name: "roof top", Address: 2}, "1533A5012345", data)
+	expected := `nt5000,inverter=roof\ top,address=2,serial=1533A5012345 udc=497.6,idc=1.4,pdc=0.7,uac=230,iac=3.2,pac=0.736,temp=21,flux=210,wd=0,wtot=374 1649620983`
+	if line != expected {
+		t.Fatalf("Expected\n%v\ngot\n%v\n", expected, line)
+	}
+
+	line = influx.Line("nt5000", protocol.NewInverter(1), "", data)
+	if !strings.HasPrefix(line, "nt5000,inverter=inverter-1,address=1 udc=") {
+		t.Fatalf("Unexpected line without serial number: %v\n", line)
+	}
+}
+
+// server is a stand-in for InfluxDB, that records all requests.
+type server struct {
+	mu       sync.Mutex
+	fail     bool
+	status   int
+	requests []*http.Request
+	bodies   []string
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if s.status != 0 {
+		http.Error(w, http.StatusText(s.status), s.status)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	s.requests = append(s.requests, r)
+	s.bodies = append(s.bodies, string(body))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) lines() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lines []string
+	for _, b := range s.bodies {
+		lines = append(lines, strings.Split(strings.TrimSpace(b), "\n")...)
+	}
+	return lines
+}
+
+func TestWriteV2(t *testing.T) {
+	s := &server{}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	w, err := influx.New(influx.Options{URL: ts.URL, Org: "home", Bucket: "solar", Token: "secret", BatchSize: 2, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("Couldn't create writer: %v\n", err)
+	}
+	inverter := protocol.NewInverter(1)
+	w.SetSerialNumber(inverter, "1533A5012345")
+	for i := 0; i < 3; i++ {
+		w.Data(inverter, data)
+	}
+	w.Close()
+
+	if lines := s.lines(); len(lines) != 3 || !strings.Contains(lines[0], "serial=1533A5012345") {
+		t.Fatalf("Expected 3 lines, got %v\n", lines)
+	}
+	r := s.requests[0]
+	if r.URL.Path != "/api/v2/write" || r.URL.Query().Get("org") != "home" || r.URL.Query().Get("bucket") != "solar" || r.URL.Query().Get("precision") != "s" {
+		t.Fatalf("Wrong request: %v\n", r.URL)
+	}
+	if r.Header.Get("Authorization") != "Token secret" {
+		t.Fatalf("Wrong authorization: %v\n", r.Header.Get("Authorization"))
+	}
+}
+
+func TestWriteV1(t *testing.T) {
+	s := &server{}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	w, err := influx.New(influx.Options{URL: ts.URL, Version: 1, Database: "solar", Username: "user", Password: "pass"})
+	if err != nil {
+		t.Fatalf("Couldn't create writer: %v\n", err)
+	}
+	w.Data(protocol.NewInverter(1), data)
+	w.Close()
+
+	if len(s.requests) != 1 {
+		t.Fatalf("Expected 1 request, got %v\n", len(s.requests))
+	}
+	r := s.requests[0]
+	if r.URL.Path != "/write" || r.URL.Query().Get("db") != "solar" {
+		t.Fatalf("Wrong request: %v\n", r.URL)
+	}
+	if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+		t.Fatalf("Wrong authentication: %v %v\n", user, pass)
+	}
+}
+
+func TestBufferWhileUnreachable(t *testing.T) {
+	s := &server{fail: true}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	dir := t.TempDir()
+	w, err := influx.New(influx.Options{URL: ts.URL, Bucket: "solar", BufferDir: dir, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("Couldn't create writer: %v\n", err)
+	}
+	defer w.Close()
+
+	inverter := protocol.NewInverter(1)
+	w.Data(inverter, data)
+	w.Data(inverter, data)
+	if err := w.Flush(); err == nil {
+		t.Fatalf("Expected error while unreachable\n")
+	}
+	buffered, err := os.ReadFile(filepath.Join(dir, "influx-buffer.lp"))
+	if err != nil || strings.Count(string(buffered), "\n") != 2 {
+		t.Fatalf("Expected 2 buffered lines, got %q %v\n", buffered, err)
+	}
+
+	s.mu.Lock()
+	s.fail = false
+	s.mu.Unlock()
+	w.Data(inverter, data)
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Couldn't flush: %v\n", err)
+	}
+	if lines := s.lines(); len(lines) != 3 {
+		t.Fatalf("Expected 3 lines, got %v\n", lines)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "influx-buffer.lp")); !os.IsNotExist(err) {
+		t.Fatalf("Buffer not removed\n")
+	}
+}
+
+func TestBufferLimit(t *testing.T) {
+	ts := httptest.NewServer(&server{fail: true})
+	defer ts.Close()
+
+	dir := t.TempDir()
+	w, err := influx.New(influx.Options{URL: ts.URL, Bucket: "solar", BufferDir: dir, MaxBufferFile: 10, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("Couldn't create writer: %v\n", err)
+	}
+	defer w.Close()
+
+	inverter := protocol.NewInverter(1)
+	for i := 0; i < 12; i++ {
+		point := data
+		point.Date = data.Date.Add(time.Duration(i) * time.Second)
+		w.Data(inverter, point)
+		w.Flush()
+	}
+	buffered, err := os.ReadFile(filepath.Join(dir, "influx-buffer.lp"))
+	lines := strings.Split(strings.TrimSpace(string(buffered)), "\n")
+	// with 11 lines, the oldest are dropped down to 9, then the 12th is added
+	if err != nil || len(lines) != 10 {
+		t.Fatalf("Expected 10 buffered lines, got %v %v\n", len(lines), err)
+	}
+	if !strings.HasSuffix(lines[0], " 1649620985") || !strings.HasSuffix(lines[9], " 1649620994") {
+		t.Fatalf("Expected the newest data points, got %v\n", lines)
+	}
+}
+
+func TestConfigError(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound} {
+		s := &server{status: status}
+		ts := httptest.NewServer(s)
+		dir := t.TempDir()
+		w, err := influx.New(influx.Options{URL: ts.URL, Bucket: "solar", BufferDir: dir, FlushInterval: time.Hour})
+		if err != nil {
+			t.Fatalf("Couldn't create writer: %v\n", err)
+		}
+
+		w.Data(protocol.NewInverter(1), data)
+		if err := w.Flush(); err == nil {
+			t.Fatalf("Expected error for status %v\n", status)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "influx-buffer.lp")); !os.IsNotExist(err) {
+			t.Fatalf("Data points buffered for status %v\n", status)
+		}
+
+		s.mu.Lock()
+		s.status = 0
+		s.mu.Unlock()
+		if err := w.Flush(); err != nil || len(s.lines()) != 0 {
+			t.Fatalf("Expected the data points to be dropped for status %v: %v %v\n", status, s.lines(), err)
+		}
+		w.Close()
+		ts.Close()
+	}
+}
+
+func TestWriteUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %v\n", err)
+	}
+	defer conn.Close()
+
+	w, err := influx.New(influx.Options{URL: "udp://" + conn.LocalAddr().String()})
+	if err != nil {
+		t.Fatalf("Couldn't create writer: %v\n", err)
+	}
+	w.Data(protocol.NewInverter(1), data)
+	w.Close()
+
+	buffer := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("No packet received: %v\n", err)
+	}
+	if !strings.HasPrefix(string(buffer[:n]), "nt5000,inverter=inverter-1") {
+		t.Fatalf("Wrong packet: %q\n", buffer[:n])
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, options := range []influx.Options{
+		{},
+		{URL: "http://localhost:8086"},
+		{URL: "http://localhost:8086", Version: 1},
+		{URL: "ftp://localhost", Bucket: "solar"},
+	} {
+		if _, err := influx.New(options); err == nil {
+			t.Fatalf("Expected error for %+v\n", options)
+		}
+	}
+}
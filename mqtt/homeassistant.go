@@ -0,0 +1,117 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+
+	"github.com/adangel/nt5000-serial/protocol"
+)
+
+// DefaultDiscoveryPrefix is the default discovery prefix of Home Assistant.
+const DefaultDiscoveryPrefix = "homeassistant"
+
+// sensor describes how a value is shown in Home Assistant.
+type sensor struct {
+	field       string
+	name        string
+	deviceClass string
+	stateClass  string
+}
+
+var sensors = []sensor{
+	{"dc/voltage", "DC voltage", "voltage", "measurement"},
+	{"dc/current", "DC current", "current", "measurement"},
+	{"dc/power", "DC power", "power", "measurement"},
+	{"ac/voltage", "AC voltage", "voltage", "measurement"},
+	{"ac/current", "AC current", "current", "measurement"},
+	{"ac/power", "AC power", "power", "measurement"},
+	{"temperature", "Temperature", "temperature", "measurement"},
+	{"heat_flux", "Irradiance", "irradiance", "measurement"},
+	// the daily energy is reset at night, total_increasing handles that
+	{"energy_day", "Energy today", "energy", "total_increasing"},
+	{"energy_total", "Energy total", "energy", "total_increasing"},
+}
+
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	SerialNumber string   `json:"serial_number"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+}
+
+type discoveryAvailability struct {
+	Topic string `json:"topic"`
+}
+
+// discoveryConfig is the config of one sensor, see
+// https://www.home-assistant.io/integrations/sensor.mqtt/
+type discoveryConfig struct {
+	Name              string                  `json:"name"`
+	UniqueID          string                  `json:"unique_id"`
+	ObjectID          string                  `json:"object_id"`
+	StateTopic        string                  `json:"state_topic"`
+	UnitOfMeasurement string                  `json:"unit_of_measurement"`
+	DeviceClass       string                  `json:"device_class"`
+	StateClass        string                  `json:"state_class"`
+	Availability      []discoveryAvailability `json:"availability"`
+	AvailabilityMode  string                  `json:"availability_mode"`
+	Device            discoveryDevice         `json:"device"`
+}
+
+// publishDiscovery publishes the configs of all sensors of the inverter, so
+// that Home Assistant creates them automatically. All sensors belong to one
+// device, which is identified by the serial number.
+func (p *Publisher) publishDiscovery(inverter protocol.Inverter, serialnumber, firmware string) {
+	units := make(map[string]string)
+	for _, v := range Values(protocol.DataPoint{}) {
+		units[v.Field] = v.Unit
+	}
+
+	id := "nt5000_" + sanitizeID(serialnumber)
+	device := discoveryDevice{
+		Identifiers:  []string{id},
+		Name:         inverter.Name,
+		Manufacturer: "Sunways",
+		Model:        "NT5000",
+		SerialNumber: serialnumber,
+		SWVersion:    firmware,
+	}
+	for _, s := range sensors {
+		objectID := id + "_" + sanitizeID(s.field)
+		config := discoveryConfig{
+			Name:              s.name,
+			UniqueID:          objectID,
+			ObjectID:          objectID,
+			StateTopic:        p.Topic(inverter.Name, s.field),
+			UnitOfMeasurement: units[s.field],
+			DeviceClass:       s.deviceClass,
+			StateClass:        s.stateClass,
+			Availability: []discoveryAvailability{
+				{Topic: p.Topic("status")},
+				{Topic: p.Topic(inverter.Name, "status")},
+			},
+			AvailabilityMode: "all",
+			Device:           device,
+		}
+		payload, err := json.Marshal(config)
+		if err != nil {
+			log.Printf("Couldn't encode discovery config: %v\n", err)
+			return
+		}
+		p.publish(p.discovery+"/sensor/"+id+"/"+sanitizeID(s.field)+"/config", true, payload)
+	}
+}
+
+// sanitizeID replaces all characters, that are not allowed in a Home
+// Assistant id or discovery topic.
+func sanitizeID(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,390 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/sink"
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	online  = "online"
+	offline = "offline"
+)
+
+// Options configure the connection to the MQTT broker.
+type Options struct {
+	// Broker is the URL of the broker, e.g. tcp://localhost:1883 or
+	// ssl://localhost:8883.
+	Broker   string `yaml:"broker"`
+	ClientID string `yaml:"client_id"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// TopicPrefix is the first level of all topics.
+	TopicPrefix string `yaml:"topic"`
+	QoS         byte   `yaml:"qos"`
+	// DiscoveryPrefix enables the Home Assistant discovery, if not empty.
+	DiscoveryPrefix string `yaml:"discovery_prefix"`
+
+	// CAFile is a PEM file with the certificates to verify the broker.
+	// Without it, the system certificates are used.
+	CAFile string `yaml:"ca"`
+	// CertFile and KeyFile are the client certificate, if the broker
+	// requires one.
+	CertFile string `yaml:"cert"`
+	KeyFile  string `yaml:"key"`
+	// Insecure disables the verification of the broker's certificate.
+	Insecure bool `yaml:"insecure"`
+}
+
+// ErrNotConnected is returned by Client.Publish, while the connection to the
+// broker is down.
+var ErrNotConnected = errors.New("not connected to MQTT broker")
+
+// DefaultTopicPrefix is used, if no topic prefix is given.
+const DefaultTopicPrefix = "nt5000"
+
+// Client publishes messages to a broker.
+type Client interface {
+	Publish(topic string, qos byte, retained bool, payload []byte) error
+	Close()
+}
+
+// Publisher publishes the data of the inverters. All topics start with the
+// topic prefix:
+//
+//	<prefix>/status                        online or offline (last will)
+//	<prefix>/<inverter>/status             online or offline, retained
+//	<prefix>/<inverter>/data               data point as JSON
+//	<prefix>/<inverter>/<field>            single values, e.g. ac/power
+//	<prefix>/<inverter>/info/<field>       serial_number, protocol, firmware, retained
+//	<prefix>/<inverter>/errors             error memory as JSON, retained
+type Publisher struct {
+	client Client
+	prefix string
+	qos    byte
+	// discovery is the Home Assistant discovery prefix. The discovery is
+	// disabled, if it's empty.
+	discovery string
+
+	mu        sync.Mutex
+	available map[string]bool
+	// retained are the last retained messages by topic. They are published
+	// again after a reconnect, because they might have been lost while
+	// disconnected.
+	retained map[string][]byte
+	// disconnected is set, after ErrNotConnected has been logged once.
+	disconnected bool
+}
+
+// NewPublisher returns a publisher, that uses the given client.
+func NewPublisher(client Client, prefix string, qos byte) *Publisher {
+	if prefix == "" {
+		prefix = DefaultTopicPrefix
+	}
+	return &Publisher{client: client, prefix: strings.TrimSuffix(prefix, "/"), qos: qos, available: make(map[string]bool), retained: make(map[string][]byte)}
+}
+
+// Connect connects to the broker in the background. The broker publishes
+// "offline" to <prefix>/status, if the connection is lost.
+func Connect(options Options) (*Publisher, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	if options.TopicPrefix == "" {
+		options.TopicPrefix = DefaultTopicPrefix
+	}
+	p := NewPublisher(nil, options.TopicPrefix, options.QoS)
+	p.EnableDiscovery(options.DiscoveryPrefix)
+	client, err := connect(options, p.Topic("status"), p.republish)
+	if err != nil {
+		return nil, err
+	}
+	p.client = client
+	return p, nil
+}
+
+// Validate checks the broker URL, the QoS and the certificates.
+func (o Options) Validate() error {
+	u, err := url.Parse(o.Broker)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss":
+	default:
+		return fmt.Errorf("Unsupported MQTT broker %q, use e.g. tcp://localhost:1883\n", o.Broker)
+	}
+	if o.QoS > 2 {
+		return fmt.Errorf("Invalid MQTT QoS %v\n", o.QoS)
+	}
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return fmt.Errorf("MQTT client certificate and key must be given together\n")
+	}
+	_, err = newTLSConfig(o)
+	return err
+}
+
+// EnableDiscovery publishes configs for Home Assistant with the given
+// discovery prefix. An empty prefix disables the discovery.
+func (p *Publisher) EnableDiscovery(prefix string) {
+	p.discovery = strings.TrimSuffix(prefix, "/")
+}
+
+// Topic returns the full topic for the given levels.
+func (p *Publisher) Topic(levels ...string) string {
+	return p.prefix + "/" + strings.Join(levels, "/")
+}
+
+// Data publishes the data point as JSON and each value in its own topic.
+func (p *Publisher) Data(inverter protocol.Inverter, data protocol.DataPoint) {
+	p.setAvailable(inverter, true)
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Couldn't encode data: %v\n", err)
+		return
+	}
+	p.publish(p.Topic(inverter.Name, "data"), false, payload)
+	for _, v := range Values(data) {
+		p.publish(p.Topic(inverter.Name, v.Field), false, []byte(v.String()))
+	}
+}
+
+// Failure marks the inverter as offline.
+func (p *Publisher) Failure(inverter protocol.Inverter, err error) {
+	p.setAvailable(inverter, false)
+}
+
+// Info publishes the basic information and the error memory, if it has been
+// read.
+func (p *Publisher) Info(inverter protocol.Inverter, info sink.Info) {
+	if info.Errors != nil {
+		p.PublishErrors(inverter, info.Errors)
+	}
+	p.PublishInfo(inverter, info.SerialNumber, info.Protocol, info.Firmware)
+}
+
+// PublishInfo publishes the basic information about the inverter. Empty values
+// aren't published. If the discovery is enabled and the serial number is
+// known, the Home Assistant configs are published as well.
+func (p *Publisher) PublishInfo(inverter protocol.Inverter, serialnumber, protocolVersion, firmware string) {
+	for field, value := range map[string]string{"serial_number": serialnumber, "protocol": protocolVersion, "firmware": firmware} {
+		if value != "" {
+			p.publish(p.Topic(inverter.Name, "info", field), true, []byte(value))
+		}
+	}
+	if p.discovery != "" && serialnumber != "" {
+		p.publishDiscovery(inverter, serialnumber, firmware)
+	}
+}
+
+// errorEntry is one entry of the error memory.
+type errorEntry struct {
+	protocol.Error
+	Fault protocol.Fault
+}
+
+// PublishErrors publishes the error memory.
+func (p *Publisher) PublishErrors(inverter protocol.Inverter, errors []protocol.Error) {
+	entries := make([]errorEntry, 0, len(errors))
+	for _, e := range errors {
+		entries = append(entries, errorEntry{Error: e, Fault: e.Fault()})
+	}
+	payload, err := json.Marshal(entries)
+	if err != nil {
+		log.Printf("Couldn't encode errors: %v\n", err)
+		return
+	}
+	p.publish(p.Topic(inverter.Name, "errors"), true, payload)
+}
+
+// Close publishes "offline" and disconnects.
+func (p *Publisher) Close() error {
+	p.publish(p.Topic("status"), true, []byte(offline))
+	p.client.Close()
+	return nil
+}
+
+func (p *Publisher) setAvailable(inverter protocol.Inverter, available bool) {
+	p.mu.Lock()
+	previous, known := p.available[inverter.Name]
+	p.available[inverter.Name] = available
+	p.mu.Unlock()
+
+	if known && previous == available {
+		return
+	}
+	state := offline
+	if available {
+		state = online
+	}
+	p.publish(p.Topic(inverter.Name, "status"), true, []byte(state))
+}
+
+func (p *Publisher) publish(topic string, retained bool, payload []byte) {
+	if retained {
+		p.mu.Lock()
+		p.retained[topic] = payload
+		p.mu.Unlock()
+	}
+	err := p.client.Publish(topic, p.qos, retained, payload)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if errors.Is(err, ErrNotConnected) {
+		if !p.disconnected {
+			log.Printf("Couldn't publish %s: %v, dropping messages until connected\n", topic, err)
+			p.disconnected = true
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Couldn't publish %s: %v\n", topic, err)
+		return
+	}
+	p.disconnected = false
+}
+
+// republish publishes all retained messages again.
+func (p *Publisher) republish(client Client) {
+	p.mu.Lock()
+	retained := make(map[string][]byte, len(p.retained))
+	for topic, payload := range p.retained {
+		retained[topic] = payload
+	}
+	p.mu.Unlock()
+
+	client.Publish(p.Topic("status"), p.qos, true, []byte(online))
+	for topic, payload := range retained {
+		if err := client.Publish(topic, p.qos, true, payload); err != nil {
+			log.Printf("Couldn't publish %s: %v\n", topic, err)
+		}
+	}
+}
+
+// Value is a single value of a data point.
+type Value struct {
+	// Field is the topic level of the value, e.g. ac/power.
+	Field string
+	Value float32
+	// Unit is the unit of the value as used by Home Assistant.
+	Unit string
+}
+
+func (v Value) String() string {
+	return strconv.FormatFloat(float64(v.Value), 'f', -1, 32)
+}
+
+// Values returns all values of the data point.
+func Values(data protocol.DataPoint) []Value {
+	return []Value{
+		{"dc/voltage", data.DC.Voltage, "V"},
+		{"dc/current", data.DC.Current, "A"},
+		{"dc/power", data.DC.Power, "kW"},
+		{"ac/voltage", data.AC.Voltage, "V"},
+		{"ac/current", data.AC.Current, "A"},
+		{"ac/power", data.AC.Power, "kW"},
+		{"temperature", data.Temperature, "°C"},
+		{"heat_flux", data.HeatFlux, "W/m²"},
+		{"energy_day", data.EnergyDay, "kWh"},
+		{"energy_total", data.EnergyTotal, "kWh"},
+	}
+}
+
+// pahoClient adapts the paho client to Client.
+type pahoClient struct {
+	client paho.Client
+}
+
+// connect returns a client, that connects in the background. onConnect is
+// called whenever the connection has been established.
+func connect(options Options, statusTopic string, onConnect func(Client)) (Client, error) {
+	opts := paho.NewClientOptions()
+	opts.AddBroker(options.Broker)
+	opts.SetClientID(options.ClientID)
+	opts.SetUsername(options.Username)
+	opts.SetPassword(options.Password)
+	opts.SetWill(statusTopic, offline, options.QoS, true)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(10 * time.Second)
+	opts.SetOnConnectHandler(func(c paho.Client) {
+		log.Printf("Connected to MQTT broker %s\n", options.Broker)
+		// publish in the background, the handler must not block
+		go onConnect(&pahoClient{client: c})
+	})
+	opts.SetConnectionLostHandler(func(c paho.Client, err error) {
+		log.Printf("Lost connection to MQTT broker: %v\n", err)
+	})
+
+	tlsConfig, err := newTLSConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	client := paho.NewClient(opts)
+	// with ConnectRetry, the token only completes once connected, so don't
+	// wait for it
+	client.Connect()
+	return &pahoClient{client: client}, nil
+}
+
+func (c *pahoClient) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	if !c.client.IsConnectionOpen() {
+		return ErrNotConnected
+	}
+	token := c.client.Publish(topic, qos, retained, payload)
+	if qos == 0 {
+		return nil
+	}
+	if !token.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("Timeout while publishing\n")
+	}
+	return token.Error()
+}
+
+func (c *pahoClient) Close() {
+	c.client.Disconnect(1000)
+}
+
+func newTLSConfig(options Options) (*tls.Config, error) {
+	if options.CAFile == "" && options.CertFile == "" && !options.Insecure {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: options.Insecure}
+	if options.CAFile != "" {
+		pem, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s\n", options.CAFile)
+		}
+	}
+	if options.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
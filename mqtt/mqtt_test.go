@@ -0,0 +1,325 @@
+package mqtt_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/mqtt"
+	"github.com/adangel/nt5000-serial/protocol"
+)
+
+type message struct {
+	topic    string
+	retained bool
+	payload  string
+}
+
+type fakeClient struct {
+	mu       sync.Mutex
+	messages []message
+	closed   bool
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, message{topic, retained, string(payload)})
+	return nil
+}
+
+func (c *fakeClient) Close() {
+	c.closed = true
+}
+
+func (c *fakeClient) find(topic string) (message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := len(c.messages) - 1; i >= 0; i-- {
+		if c.messages[i].topic == topic {
+			return c.messages[i], true
+		}
+	}
+	return message{}, false
+}
+
+func (c *fakeClient) count(topic string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, m := range c.messages {
+		if m.topic == topic {
+			n++
+		}
+	}
+	return n
+}
+
+func expectMessage(t *testing.T, client *fakeClient, topic string, payload string, retained bool) {
+	m, ok := client.find(topic)
+	if !ok {
+		t.Fatalf("No message published to %v\n", topic)
+	}
+	if m.payload != payload {
+		t.Fatalf("Expected %v on %v, got %v\n", payload, topic, m.payload)
+	}
+	if m.retained != retained {
+		t.Fatalf("Expected retained=%v on %v\n", retained, topic)
+	}
+}
+
+func TestPublishData(t *testing.T) {
+	client := &fakeClient{}
+	p := mqtt.NewPublisher(client, "solar/", 0)
+	inverter := protocol.NewInverter(1)
+
+	data := protocol.DataPoint{
+		Date:        time.Date(2022, 4, 10, 12, 0, 0, 0, time.UTC),
+		AC:          protocol.Measurement{Voltage: 230, Current: 3.2, Power: 0.736},
+		Temperature: 21.5,
+		EnergyTotal: 374,
+	}
+	p.Data(inverter, data)
+	p.Data(inverter, data)
+
+	expectMessage(t, client, "solar/inverter-1/ac/power", "0.736", false)
+	expectMessage(t, client, "solar/inverter-1/temperature", "21.5", false)
+	expectMessage(t, client, "solar/inverter-1/energy_total", "374", false)
+	expectMessage(t, client, "solar/inverter-1/status", "online", true)
+	if m, _ := client.find("solar/inverter-1/data"); !strings.Contains(m.payload, `"EnergyTotal":374`) {
+		t.Fatalf("Wrong JSON data: %v\n", m.payload)
+	}
+	if n := client.count("solar/inverter-1/status"); n != 1 {
+		t.Fatalf("Expected availability to be published once, got %v\n", n)
+	}
+
+	p.Failure(inverter, errors.New("timeout"))
+	expectMessage(t, client, "solar/inverter-1/status", "offline", true)
+}
+
+func TestPublishInfoAndErrors(t *testing.T) {
+	client := &fakeClient{}
+	p := mqtt.NewPublisher(client, "", 0)
+	inverter := protocol.Inverter{Name: "roof", Address: 2}
+
+	p.PublishInfo(inverter, "1533A5012345", "111", "23")
+	expectMessage(t, client, "nt5000/roof/info/serial_number", "1533A5012345", true)
+	expectMessage(t, client, "nt5000/roof/info/firmware", "23", true)
+
+	p.PublishErrors(inverter, []protocol.Error{{Date: time.Date(2022, 4, 10, 20, 3, 0, 0, time.UTC), Code: 0x11}})
+	m, _ := client.find("nt5000/roof/errors")
+	if !strings.Contains(m.payload, `"Code":17`) || !strings.Contains(m.payload, "Grid frequency") || !m.retained {
+		t.Fatalf("Wrong error memory: %v\n", m)
+	}
+
+	p.Close()
+	expectMessage(t, client, "nt5000/status", "offline", true)
+	if !client.closed {
+		t.Fatalf("Client not closed\n")
+	}
+}
+
+// broker is a minimal MQTT 3.1.1 broker, that records the will and all
+// published messages.
+type broker struct {
+	listener net.Listener
+	mu       sync.Mutex
+	will     message
+	messages []message
+}
+
+func startBroker(t *testing.T) *broker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %v\n", err)
+	}
+	b := &broker{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *broker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case 1: // CONNECT
+			b.connect(body)
+			conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+		case 3: // PUBLISH
+			topic, rest := readString(body)
+			qos := (header >> 1) & 0x03
+			if qos > 0 {
+				conn.Write([]byte{0x40, 0x02, rest[0], rest[1]})
+				rest = rest[2:]
+			}
+			b.mu.Lock()
+			b.messages = append(b.messages, message{topic, header&0x01 == 1, string(rest)})
+			b.mu.Unlock()
+		case 12: // PINGREQ
+			conn.Write([]byte{0xd0, 0x00})
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+func (b *broker) connect(body []byte) {
+	_, rest := readString(body) // protocol name
+	flags := rest[1]
+	rest = rest[4:]            // level, flags, keep alive
+	_, rest = readString(rest) // client id
+	if flags&0x04 != 0 {
+		topic, rest := readString(rest)
+		payload, _ := readString(rest)
+		b.mu.Lock()
+		b.will = message{topic, flags&0x20 != 0, payload}
+		b.mu.Unlock()
+	}
+}
+
+func (b *broker) find(topic string) (message, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, m := range b.messages {
+		if m.topic == topic {
+			return m, true
+		}
+	}
+	return message{}, false
+}
+
+func readString(data []byte) (string, []byte) {
+	n := int(binary.BigEndian.Uint16(data))
+	return string(data[2 : 2+n]), data[2+n:]
+}
+
+func TestConnect(t *testing.T) {
+	b := startBroker(t)
+	defer b.listener.Close()
+
+	p, err := mqtt.Connect(mqtt.Options{Broker: "tcp://" + b.listener.Addr().String(), ClientID: "test", QoS: 1})
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v\n", err)
+	}
+	// the message is published again, once connected
+	p.PublishInfo(protocol.NewInverter(1), "1533A5012345", "", "")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m, ok := b.find("nt5000/inverter-1/info/serial_number")
+		if ok {
+			if m.payload != "1533A5012345" || !m.retained {
+				t.Fatalf("Wrong message: %v\n", m)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("No message received\n")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.Close()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.will != (message{"nt5000/status", true, "offline"}) {
+		t.Fatalf("Wrong last will: %v\n", b.will)
+	}
+	if _, ok := b.findLocked("nt5000/status"); !ok {
+		t.Fatalf("Status not published\n")
+	}
+}
+
+func (b *broker) findLocked(topic string) (message, bool) {
+	for _, m := range b.messages {
+		if m.topic == topic {
+			return m, true
+		}
+	}
+	return message{}, false
+}
+
+func TestHomeAssistantDiscovery(t *testing.T) {
+	client := &fakeClient{}
+	p := mqtt.NewPublisher(client, "solar", 0)
+	inverter := protocol.Inverter{Name: "roof", Address: 2}
+
+	p.PublishInfo(inverter, "1533A5012345", "111", "23")
+	if _, ok := client.find("homeassistant/sensor/nt5000_1533A5012345/energy_total/config"); ok {
+		t.Fatalf("Discovery published, although disabled\n")
+	}
+
+	p.EnableDiscovery("homeassistant")
+	p.PublishInfo(inverter, "1533A5012345", "111", "23")
+	m, ok := client.find("homeassistant/sensor/nt5000_1533A5012345/energy_total/config")
+	if !ok || !m.retained {
+		t.Fatalf("No retained discovery config published\n")
+	}
+
+	var config struct {
+		UniqueID          string `json:"unique_id"`
+		StateTopic        string `json:"state_topic"`
+		UnitOfMeasurement string `json:"unit_of_measurement"`
+		DeviceClass       string `json:"device_class"`
+		StateClass        string `json:"state_class"`
+		Availability      []struct {
+			Topic string `json:"topic"`
+		} `json:"availability"`
+		Device struct {
+			Identifiers []string `json:"identifiers"`
+			SWVersion   string   `json:"sw_version"`
+		} `json:"device"`
+	}
+	if err := json.Unmarshal([]byte(m.payload), &config); err != nil {
+		t.Fatalf("Invalid config: %v\n", err)
+	}
+	if config.UniqueID != "nt5000_1533A5012345_energy_total" {
+		t.Fatalf("Wrong unique id: %v\n", config.UniqueID)
+	}
+	if config.StateTopic != "solar/roof/energy_total" {
+		t.Fatalf("Wrong state topic: %v\n", config.StateTopic)
+	}
+	if config.UnitOfMeasurement != "kWh" || config.DeviceClass != "energy" || config.StateClass != "total_increasing" {
+		t.Fatalf("Wrong energy sensor: %+v\n", config)
+	}
+	if len(config.Availability) != 2 || config.Availability[1].Topic != "solar/roof/status" {
+		t.Fatalf("Wrong availability: %v\n", config.Availability)
+	}
+	if len(config.Device.Identifiers) != 1 || config.Device.Identifiers[0] != "nt5000_1533A5012345" || config.Device.SWVersion != "23" {
+		t.Fatalf("Wrong device: %+v\n", config.Device)
+	}
+
+	m, _ = client.find("homeassistant/sensor/nt5000_1533A5012345/ac_power/config")
+	if !strings.Contains(m.payload, `"device_class":"power"`) || !strings.Contains(m.payload, `"state_class":"measurement"`) {
+		t.Fatalf("Wrong power sensor: %v\n", m.payload)
+	}
+}
@@ -0,0 +1,326 @@
+package poller
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/serial"
+)
+
+type State int
+
+const (
+	// Disconnected means the port has not been opened yet or the poller
+	// has been stopped.
+	Disconnected State = iota
+	// Connected means the last request has been answered.
+	Connected
+	// Reconnecting means the port has been closed after too many failures
+	// and the poller is trying to open it again.
+	Reconnecting
+)
+
+func (s State) String() string {
+	switch s {
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	default:
+		return "disconnected"
+	}
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Status describes the connection to the inverters.
+type Status struct {
+	State               State
+	ConsecutiveFailures int
+	Reconnects          int
+	LastError           string
+	LastSuccess         time.Time
+}
+
+// Opener opens a new connection to the bus.
+type Opener func() (serial.Transport, error)
+
+// Poller periodically reads the current data from all inverters on the bus.
+// If no inverter answers MaxFailures times in a row, the connection is
+// closed and opened again. Failed attempts are retried with an exponential
+// backoff up to MaxBackoff.
+type Poller struct {
+	MaxFailures int
+	MaxBackoff  time.Duration
+	// ErrorInterval is how often the error memory is read again, while the
+	// connection stays open. 0 disables it.
+	ErrorInterval time.Duration
+
+	// OnConnect is called for every inverter whenever the connection has
+	// been (re)opened.
+	OnConnect func(inverter protocol.Inverter, client *serial.Client)
+	// OnData is called for every data point read.
+	OnData func(inverter protocol.Inverter, data protocol.DataPoint)
+	// OnError is called whenever an inverter didn't answer.
+	OnError func(inverter protocol.Inverter, err error)
+	// OnErrors is called with the error memory, whenever it has been read
+	// again after ErrorInterval. OnConnect is expected to read it, when the
+	// connection has been opened.
+	OnErrors func(inverter protocol.Inverter, errors []protocol.Error)
+	// OnStatus is called whenever the status has changed.
+	OnStatus func(status Status)
+
+	open      Opener
+	inverters []protocol.Inverter
+	interval  time.Duration
+
+	// errorsRead is when the error memory of each inverter has been read
+	// last. It's only used by the polling goroutine.
+	errorsRead map[byte]time.Time
+
+	mu        sync.Mutex
+	transport serial.Transport
+	status    Status
+	done      chan struct{}
+}
+
+// New returns a poller for the given inverters. Without any inverters, the
+// inverter with the default address is polled.
+func New(open Opener, inverters []protocol.Inverter, interval time.Duration) *Poller {
+	if len(inverters) == 0 {
+		inverters = []protocol.Inverter{protocol.NewInverter(protocol.DefaultAddress)}
+	}
+	return &Poller{
+		MaxFailures:   3,
+		MaxBackoff:    5 * time.Minute,
+		ErrorInterval: 5 * time.Minute,
+		open:          open,
+		inverters:     inverters,
+		interval:      interval,
+		errorsRead:    make(map[byte]time.Time),
+		done:          make(chan struct{}),
+	}
+}
+
+func (p *Poller) Inverters() []protocol.Inverter {
+	return p.inverters
+}
+
+// Start polls in the background until Close is called.
+func (p *Poller) Start() {
+	go p.run()
+}
+
+func (p *Poller) Status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// Close stops polling and closes the connection.
+func (p *Poller) Close() error {
+	p.mu.Lock()
+	if p.stopped() {
+		p.mu.Unlock()
+		return nil
+	}
+	close(p.done)
+
+	p.status.State = Disconnected
+	status := p.status
+	var err error
+	if p.transport != nil {
+		err = p.transport.Close()
+		p.transport = nil
+	}
+	p.mu.Unlock()
+
+	if p.OnStatus != nil {
+		p.OnStatus(status)
+	}
+	return err
+}
+
+// stopped returns true, once Close has been called.
+func (p *Poller) stopped() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Poller) run() {
+	for {
+		wait := p.poll()
+		select {
+		case <-p.done:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// poll opens the connection if needed and reads one data point from every
+// inverter. It returns the time to wait until the next attempt.
+func (p *Poller) poll() time.Duration {
+	transport, err := p.connect()
+	if err != nil {
+		log.Printf("Couldn't connect: %v\n", err)
+		return p.failed(err, false)
+	}
+
+	var lastErr error
+	var lastSuccess time.Time
+	for _, inverter := range p.inverters {
+		if p.stopped() {
+			return p.interval
+		}
+		client := serial.NewClientWithAddress(transport, inverter.Address)
+		data, err := client.GetDataPoint()
+		if err != nil {
+			log.Printf("Couldn't read data from %s: %v\n", inverter.Name, err)
+			lastErr = fmt.Errorf("%s: %w", inverter.Name, err)
+			if p.OnError != nil {
+				p.OnError(inverter, err)
+			}
+			continue
+		}
+
+		lastSuccess = data.Date
+		if p.OnData != nil {
+			p.OnData(inverter, data)
+		}
+		p.readErrors(inverter, client)
+	}
+
+	if p.stopped() {
+		return p.interval
+	}
+	if lastSuccess.IsZero() {
+		return p.failed(lastErr, true)
+	}
+	p.update(func(s *Status) {
+		s.State = Connected
+		s.ConsecutiveFailures = 0
+		s.LastError = ""
+		if lastErr != nil {
+			s.LastError = lastErr.Error()
+		}
+		s.LastSuccess = lastSuccess
+	})
+	return p.interval
+}
+
+func (p *Poller) connect() (serial.Transport, error) {
+	p.mu.Lock()
+	transport := p.transport
+	p.mu.Unlock()
+	if transport != nil {
+		return transport, nil
+	}
+
+	transport, err := p.open()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	if p.stopped() {
+		p.mu.Unlock()
+		transport.Close()
+		return nil, serial.ErrNotConnected
+	}
+	p.transport = transport
+	p.mu.Unlock()
+
+	now := time.Now()
+	for _, inverter := range p.inverters {
+		p.errorsRead[inverter.Address] = now
+		if p.OnConnect != nil {
+			p.OnConnect(inverter, serial.NewClientWithAddress(transport, inverter.Address))
+		}
+	}
+	return transport, nil
+}
+
+// readErrors reads the error memory again, once ErrorInterval has passed,
+// so that new faults are noticed without a reconnect.
+func (p *Poller) readErrors(inverter protocol.Inverter, client *serial.Client) {
+	if p.OnErrors == nil || p.ErrorInterval <= 0 || time.Since(p.errorsRead[inverter.Address]) < p.ErrorInterval {
+		return
+	}
+	p.errorsRead[inverter.Address] = time.Now()
+	errors, err := client.ReadErrors()
+	if err != nil {
+		log.Printf("Couldn't read error memory of %s: %v\n", inverter.Name, err)
+		return
+	}
+	if errors == nil {
+		errors = []protocol.Error{}
+	}
+	p.OnErrors(inverter, errors)
+}
+
+// failed records the error and closes the connection after too many
+// failures.
+func (p *Poller) failed(err error, connected bool) time.Duration {
+	var failures int
+	p.update(func(s *Status) {
+		s.ConsecutiveFailures++
+		s.LastError = err.Error()
+		failures = s.ConsecutiveFailures
+
+		if !connected {
+			s.State = Reconnecting
+			return
+		}
+		if failures >= p.MaxFailures {
+			log.Printf("%v consecutive failures, reconnecting\n", failures)
+			if p.transport != nil {
+				if err := p.transport.Close(); err != nil {
+					log.Print(err)
+				}
+				p.transport = nil
+			}
+			s.State = Reconnecting
+			s.Reconnects++
+		}
+	})
+	return p.backoff(failures)
+}
+
+// backoff doubles the poll interval for every consecutive failure.
+func (p *Poller) backoff(failures int) time.Duration {
+	wait := p.interval
+	for i := 1; i < failures && wait < p.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	return wait
+}
+
+// update changes the status, unless the poller has been stopped in the
+// meantime.
+func (p *Poller) update(f func(s *Status)) {
+	p.mu.Lock()
+	if p.stopped() {
+		p.mu.Unlock()
+		return
+	}
+	f(&p.status)
+	status := p.status
+	p.mu.Unlock()
+
+	if p.OnStatus != nil {
+		p.OnStatus(status)
+	}
+}
@@ -0,0 +1,165 @@
+package poller_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/emulator"
+	"github.com/adangel/nt5000-serial/poller"
+	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/serial"
+)
+
+func TestReconnect(t *testing.T) {
+	var mu sync.Mutex
+	opens := 0
+	requests := 0
+
+	p := poller.New(func() (serial.Transport, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		opens++
+		return serial.NewMemoryTransport(func(r []byte) []byte {
+			mu.Lock()
+			defer mu.Unlock()
+			requests++
+			if requests <= 3 {
+				// the device doesn't answer the first requests
+				return nil
+			}
+			return emulator.Respond(r)
+		}), nil
+	}, nil, time.Millisecond)
+	p.MaxBackoff = 5 * time.Millisecond
+
+	received := make(chan protocol.DataPoint, 10)
+	p.OnData = func(inverter protocol.Inverter, data protocol.DataPoint) {
+		received <- data
+	}
+	p.Start()
+	defer p.Close()
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No data received\n")
+	}
+
+	waitForState(t, p, poller.Connected)
+	status := p.Status()
+	if status.Reconnects != 1 {
+		t.Fatalf("Expected 1 reconnect, got %v\n", status.Reconnects)
+	}
+	if status.ConsecutiveFailures != 0 {
+		t.Fatalf("Expected no failures, got %v\n", status.ConsecutiveFailures)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if opens != 2 {
+		t.Fatalf("Expected port to be opened twice, got %v\n", opens)
+	}
+}
+
+func TestOpenFailure(t *testing.T) {
+	p := poller.New(func() (serial.Transport, error) {
+		return nil, &serial.PortNotFoundError{Port: "/dev/ttyUSB0"}
+	}, nil, time.Millisecond)
+
+	statuses := make(chan poller.Status, 10)
+	p.OnStatus = func(status poller.Status) {
+		select {
+		case statuses <- status:
+		default:
+		}
+	}
+	p.Start()
+	defer p.Close()
+
+	select {
+	case status := <-statuses:
+		if status.State != poller.Reconnecting {
+			t.Fatalf("Expected state reconnecting, got %v\n", status.State)
+		}
+		if status.LastError == "" {
+			t.Fatalf("Expected last error to be set\n")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No status received\n")
+	}
+}
+
+func TestMultipleInverters(t *testing.T) {
+	emulator.Addresses = []byte{1, 3}
+	defer func() {
+		emulator.Addresses = []byte{protocol.DefaultAddress}
+	}()
+
+	inverters := []protocol.Inverter{protocol.NewInverter(1), protocol.NewInverter(2), protocol.NewInverter(3)}
+	p := poller.New(func() (serial.Transport, error) {
+		return serial.NewMemoryTransport(emulator.Respond), nil
+	}, inverters, time.Hour)
+
+	received := make(chan protocol.Inverter, 10)
+	failed := make(chan protocol.Inverter, 10)
+	p.OnData = func(inverter protocol.Inverter, data protocol.DataPoint) {
+		received <- inverter
+	}
+	p.OnError = func(inverter protocol.Inverter, err error) {
+		failed <- inverter
+	}
+	p.Start()
+	defer p.Close()
+
+	for _, expected := range []string{"inverter-1", "inverter-3"} {
+		select {
+		case inverter := <-received:
+			if inverter.Name != expected {
+				t.Fatalf("Expected data from %v, got %v\n", expected, inverter.Name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No data received from %v\n", expected)
+		}
+	}
+	if inverter := <-failed; inverter.Address != 2 {
+		t.Fatalf("Expected inverter 2 to fail, got %v\n", inverter.Name)
+	}
+	waitForState(t, p, poller.Connected)
+}
+
+func TestClose(t *testing.T) {
+	p := poller.New(func() (serial.Transport, error) {
+		return serial.NewMemoryTransport(emulator.Respond), nil
+	}, nil, time.Millisecond)
+
+	var mu sync.Mutex
+	var last poller.Status
+	p.OnStatus = func(status poller.Status) {
+		mu.Lock()
+		defer mu.Unlock()
+		last = status
+	}
+	p.Start()
+	waitForState(t, p, poller.Connected)
+	p.Close()
+
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if last.State != poller.Disconnected {
+		t.Fatalf("Expected last status disconnected, got %v\n", last.State)
+	}
+	if p.Status().State != poller.Disconnected {
+		t.Fatalf("Expected state disconnected, got %v\n", p.Status().State)
+	}
+}
+
+func waitForState(t *testing.T, p *poller.Poller, expected poller.State) {
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Status().State != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected state %v, got %v\n", expected, p.Status().State)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -1,61 +1,168 @@
 package prometheus
 
 import (
+	"fmt"
+	"sync"
+
+	"github.com/adangel/nt5000-serial/poller"
 	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/sink"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-var gaugeDCVoltage = promauto.NewGauge(prometheus.GaugeOpts{
+// labels identify the inverter of each metric.
+var labels = []string{"inverter", "address"}
+
+var gaugeDCVoltage = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "nt5000_dc_voltage",
 	Help: "DC Voltage in V",
-})
-var gaugeDCCurrent = promauto.NewGauge(prometheus.GaugeOpts{
+}, labels)
+var gaugeDCCurrent = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "nt5000_dc_current",
 	Help: "DC Current in A",
-})
-var gaugeDCPower = promauto.NewGauge(prometheus.GaugeOpts{
+}, labels)
+var gaugeDCPower = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "nt5000_dc_power",
 	Help: "DC Power in kW",
-})
-var gaugeACVoltage = promauto.NewGauge(prometheus.GaugeOpts{
+}, labels)
+var gaugeACVoltage = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "nt5000_ac_voltage",
 	Help: "AC Voltage in V",
-})
-var gaugeACCurrent = promauto.NewGauge(prometheus.GaugeOpts{
+}, labels)
+var gaugeACCurrent = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "nt5000_ac_current",
 	Help: "AC Current in A",
-})
-var gaugeACPower = promauto.NewGauge(prometheus.GaugeOpts{
+}, labels)
+var gaugeACPower = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "nt5000_ac_power",
 	Help: "AC Power in kW",
-})
-var gaugeTemperature = promauto.NewGauge(prometheus.GaugeOpts{
+}, labels)
+var gaugeTemperature = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "nt5000_temperature",
 	Help: "Temperature in °C",
-})
-var gaugeHeatFlux = promauto.NewGauge(prometheus.GaugeOpts{
+}, labels)
+var gaugeHeatFlux = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "nt5000_heat_flux",
 	Help: "Heat Flux in W/m^2",
-})
-var gaugeEnergyDay = promauto.NewGauge(prometheus.GaugeOpts{
+}, labels)
+var gaugeEnergyDay = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "nt5000_energy_day",
 	Help: "Energy harvested today in kWh",
-})
-var gaugeEnergyTotal = promauto.NewGauge(prometheus.GaugeOpts{
+}, labels)
+var gaugeEnergyTotal = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "nt5000_energy_total",
 	Help: "Energy harvested total in kWh",
+}, labels)
+var gaugeInverterUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "nt5000_inverter_up",
+	Help: "1 if the inverter answered the last request, 0 otherwise",
+}, labels)
+var gaugeLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "nt5000_inverter_last_success_timestamp_seconds",
+	Help: "Time of the last data point read from the inverter as Unix timestamp",
+}, labels)
+var gaugeConnected = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "nt5000_connected",
+	Help: "1 if any inverter answered the last request, 0 otherwise",
+})
+var gaugeConsecutiveFailures = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "nt5000_consecutive_failures",
+	Help: "Number of failed requests since the last successful one",
+})
+var gaugeReconnects = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "nt5000_reconnects",
+	Help: "Number of times the serial port has been reopened",
 })
+var gaugeErrorMemory = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "nt5000_error_memory_entries",
+	Help: "Number of entries in the error memory of the inverter",
+}, append(labels, "code", "fault", "severity"))
+
+func inverterLabels(inverter protocol.Inverter) prometheus.Labels {
+	return prometheus.Labels{"inverter": inverter.Name, "address": fmt.Sprintf("%d", inverter.Address)}
+}
+
+func RecordPrometheusData(inverter protocol.Inverter, currentData protocol.DataPoint) {
+	l := inverterLabels(inverter)
+	gaugeDCVoltage.With(l).Set(float64(currentData.DC.Voltage))
+	gaugeDCCurrent.With(l).Set(float64(currentData.DC.Current))
+	gaugeDCPower.With(l).Set(float64(currentData.DC.Power))
+	gaugeACVoltage.With(l).Set(float64(currentData.AC.Voltage))
+	gaugeACCurrent.With(l).Set(float64(currentData.AC.Current))
+	gaugeACPower.With(l).Set(float64(currentData.AC.Power))
+	gaugeTemperature.With(l).Set(float64(currentData.Temperature))
+	gaugeHeatFlux.With(l).Set(float64(currentData.HeatFlux))
+	gaugeEnergyDay.With(l).Set(float64(currentData.EnergyDay))
+	gaugeEnergyTotal.With(l).Set(float64(currentData.EnergyTotal))
+	gaugeInverterUp.With(l).Set(1)
+	gaugeLastSuccess.With(l).Set(float64(currentData.Date.Unix()))
+	seenMu.Lock()
+	seen[inverter] = true
+	seenMu.Unlock()
+}
+
+// seen are the inverters, that have answered at least once.
+var seenMu sync.Mutex
+var seen = make(map[protocol.Inverter]bool)
+
+// RecordFailure marks the inverter as down. The other metrics keep the last
+// values, nt5000_inverter_up tells whether they are current.
+func RecordFailure(inverter protocol.Inverter) {
+	gaugeInverterUp.With(inverterLabels(inverter)).Set(0)
+}
+
+func RecordConnectionStatus(status poller.Status) {
+	if status.State == poller.Connected {
+		gaugeConnected.Set(1)
+	} else {
+		gaugeConnected.Set(0)
+		seenMu.Lock()
+		for inverter := range seen {
+			RecordFailure(inverter)
+		}
+		seenMu.Unlock()
+	}
+	gaugeConsecutiveFailures.Set(float64(status.ConsecutiveFailures))
+	gaugeReconnects.Set(float64(status.Reconnects))
+}
+
+var errorMemoryMu sync.Mutex
+var errorMemory = make(map[protocol.Inverter][]protocol.Error)
+
+func RecordErrorMemory(inverter protocol.Inverter, errors []protocol.Error) {
+	errorMemoryMu.Lock()
+	defer errorMemoryMu.Unlock()
+
+	errorMemory[inverter] = errors
+	gaugeErrorMemory.Reset()
+	for inverter, errors := range errorMemory {
+		l := inverterLabels(inverter)
+		for _, e := range errors {
+			fault := e.Fault()
+			gaugeErrorMemory.WithLabelValues(l["inverter"], l["address"], fmt.Sprintf("0x%02x", e.Code), fault.Name(), fault.Severity.String()).Inc()
+		}
+	}
+}
+
+// Sink records the data, the error memory and the connection status as
+// metrics.
+type Sink struct{}
+
+func (Sink) Data(inverter protocol.Inverter, data protocol.DataPoint) {
+	RecordPrometheusData(inverter, data)
+}
+
+func (Sink) Failure(inverter protocol.Inverter, err error) {
+	RecordFailure(inverter)
+}
+
+func (Sink) Info(inverter protocol.Inverter, info sink.Info) {
+	if info.Errors != nil {
+		RecordErrorMemory(inverter, info.Errors)
+	}
+}
 
-func RecordPrometheusData(currentData protocol.DataPoint) {
-	gaugeDCVoltage.Set(float64(currentData.DC.Voltage))
-	gaugeDCCurrent.Set(float64(currentData.DC.Current))
-	gaugeDCPower.Set(float64(currentData.DC.Power))
-	gaugeACVoltage.Set(float64(currentData.AC.Voltage))
-	gaugeACCurrent.Set(float64(currentData.AC.Current))
-	gaugeACPower.Set(float64(currentData.AC.Power))
-	gaugeTemperature.Set(float64(currentData.Temperature))
-	gaugeHeatFlux.Set(float64(currentData.HeatFlux))
-	gaugeEnergyDay.Set(float64(currentData.EnergyDay))
-	gaugeEnergyTotal.Set(float64(currentData.EnergyTotal))
+func (Sink) Status(status poller.Status) {
+	RecordConnectionStatus(status)
 }
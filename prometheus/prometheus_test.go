@@ -0,0 +1,84 @@
+package prometheus_test
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/poller"
+	"github.com/adangel/nt5000-serial/prometheus"
+	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/sink"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// scrape returns the metrics like Prometheus would see them.
+func scrape(t *testing.T) string {
+	recorder := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(recorder.Body)
+	if err != nil {
+		t.Fatalf("Couldn't read metrics: %v\n", err)
+	}
+	return string(body)
+}
+
+func expectMetrics(t *testing.T, metrics string, expected []string) {
+	for _, e := range expected {
+		if !strings.Contains(metrics, e+"\n") {
+			t.Fatalf("Missing %s in\n%s\n", e, metrics)
+		}
+	}
+}
+
+func TestSink(t *testing.T) {
+	roof := protocol.Inverter{Name: "roof", Address: 1}
+	garage := protocol.Inverter{Name: "garage", Address: 2}
+	s := prometheus.Sink{}
+
+	s.Status(poller.Status{State: poller.Connected, ConsecutiveFailures: 0, Reconnects: 2})
+	s.Data(roof, protocol.DataPoint{
+		Date:        time.Unix(1649620983, 0),
+		DC:          protocol.Measurement{Voltage: 497.5, Current: 1.5, Power: 0.75},
+		AC:          protocol.Measurement{Voltage: 230, Current: 3.25, Power: 0.75},
+		Temperature: 21,
+		HeatFlux:    210,
+		EnergyDay:   2.5,
+		EnergyTotal: 374,
+	})
+	s.Failure(garage, errors.New("timeout"))
+	s.Info(roof, sink.Info{Errors: []protocol.Error{{Code: 0x11}, {Code: 0x11}, {Code: 0xfe}}})
+
+	expectMetrics(t, scrape(t), []string{
+		`nt5000_dc_voltage{address="1",inverter="roof"} 497.5`,
+		`nt5000_dc_current{address="1",inverter="roof"} 1.5`,
+		`nt5000_dc_power{address="1",inverter="roof"} 0.75`,
+		`nt5000_ac_voltage{address="1",inverter="roof"} 230`,
+		`nt5000_ac_current{address="1",inverter="roof"} 3.25`,
+		`nt5000_ac_power{address="1",inverter="roof"} 0.75`,
+		`nt5000_temperature{address="1",inverter="roof"} 21`,
+		`nt5000_heat_flux{address="1",inverter="roof"} 210`,
+		`nt5000_energy_day{address="1",inverter="roof"} 2.5`,
+		`nt5000_energy_total{address="1",inverter="roof"} 374`,
+		`nt5000_inverter_up{address="1",inverter="roof"} 1`,
+		`nt5000_inverter_up{address="2",inverter="garage"} 0`,
+		`nt5000_inverter_last_success_timestamp_seconds{address="1",inverter="roof"} 1.649620983e+09`,
+		`nt5000_connected 1`,
+		`nt5000_consecutive_failures 0`,
+		`nt5000_reconnects 2`,
+		`nt5000_error_memory_entries{address="1",code="0x11",fault="fault 004",inverter="roof",severity="warning"} 2`,
+		`nt5000_error_memory_entries{address="1",code="0xfe",fault="code 0xfe",inverter="roof",severity="unknown"} 1`,
+	})
+
+	// once disconnected, all inverters, that have answered, are down
+	s.Status(poller.Status{State: poller.Reconnecting, ConsecutiveFailures: 5, Reconnects: 3})
+	expectMetrics(t, scrape(t), []string{
+		`nt5000_inverter_up{address="1",inverter="roof"} 0`,
+		`nt5000_connected 0`,
+		`nt5000_consecutive_failures 5`,
+		`nt5000_reconnects 3`,
+	})
+}
@@ -0,0 +1,80 @@
+package protocol
+
+import "fmt"
+
+type Severity int
+
+const (
+	SeverityUnknown Severity = iota
+	// SeverityWarning means the inverter stopped feeding in temporarily
+	// and recovers on its own.
+	SeverityWarning
+	// SeverityFault means the inverter needs attention.
+	SeverityFault
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityFault:
+		return "fault"
+	default:
+		return "unknown"
+	}
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Fault describes an error code of the error memory.
+type Fault struct {
+	Code byte
+	// Number is the fault number shown on the display of the inverter.
+	// It's 0 for unknown codes.
+	Number      int
+	Description string
+	Severity    Severity
+	Action      string
+}
+
+// Name returns the fault number like it's shown on the display, e.g. "fault 004".
+func (f Fault) Name() string {
+	if f.Number == 0 {
+		return fmt.Sprintf("code 0x%02x", f.Code)
+	}
+	return fmt.Sprintf("fault %03d", f.Number)
+}
+
+// faults contains all known error codes. Only codes, that have been observed
+// on a real device, are listed.
+var faults = map[byte]Fault{
+	0x11: {
+		Number:      4,
+		Description: "Grid frequency out of range",
+		Severity:    SeverityWarning,
+		Action:      "The inverter reconnects automatically once the frequency is back in range. Contact the grid operator, if this happens often.",
+	},
+}
+
+// LookupFault returns the description of the given error code. Unknown
+// codes result in a fault with SeverityUnknown.
+func LookupFault(code byte) Fault {
+	f, ok := faults[code]
+	if !ok {
+		return Fault{
+			Code:        code,
+			Description: "Unknown error code",
+			Severity:    SeverityUnknown,
+			Action:      "Look up the error code in the manual of the inverter.",
+		}
+	}
+	f.Code = code
+	return f
+}
+
+// Fault returns the description of the error's code.
+func (e Error) Fault() Fault {
+	return LookupFault(e.Code)
+}
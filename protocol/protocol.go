@@ -15,6 +15,17 @@ type DataPoint struct {
 	EnergyTotal float32
 }
 
+// Inverter identifies one inverter on the RS485 bus.
+type Inverter struct {
+	Name    string `yaml:"name"`
+	Address byte   `yaml:"address"`
+}
+
+// NewInverter returns an inverter with a name derived from the address.
+func NewInverter(address byte) Inverter {
+	return Inverter{Name: fmt.Sprintf("inverter-%d", address), Address: address}
+}
+
 type Measurement struct {
 	Voltage float32
 	Current float32
@@ -26,6 +37,17 @@ type Error struct {
 	Code byte
 }
 
+// ChecksumError is returned, if the checksum byte of a frame doesn't match
+// the calculated checksum.
+type ChecksumError struct {
+	Expected byte
+	Actual   byte
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("Invalid checksum: expected 0x%02x, got 0x%02x", e.Expected, e.Actual)
+}
+
 func CalculateChecksum(data []byte) {
 	last := len(data) - 1
 	chksum := 0
@@ -37,6 +59,9 @@ func CalculateChecksum(data []byte) {
 }
 
 func VerifyChecksum(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("Invalid data, expected at least 2 bytes, but got %d\n", len(data))
+	}
 	last := 12 // the 13th byte is always the checksum
 	// unless, it's the 5th
 	if len(data) < last {
@@ -48,15 +73,15 @@ func VerifyChecksum(data []byte) error {
 	}
 	checksum = checksum % 256
 	if data[last] != byte(checksum) {
-		return fmt.Errorf("Invalid checksum: expected 0x%02x, got 0x%02x\n", checksum, data[last])
+		return &ChecksumError{Expected: byte(checksum), Actual: data[last]}
 	}
 	return nil
 }
 
 func Convert(data []byte) (DataPoint, error) {
 	d := DataPoint{}
-	if len(data) != 13 {
-		return d, fmt.Errorf("Invalid data, expected 13 bytes, but got %d\n", len(data))
+	if err := checkLength(data); err != nil {
+		return d, err
 	}
 
 	d.Date = time.Now().Local()
@@ -91,3 +116,207 @@ func ConvertToByte(d DataPoint) []byte {
 	CalculateChecksum(data)
 	return data
 }
+
+// FillByte is used for unused bytes in responses.
+const FillByte byte = 0x0d
+
+// filledResponse returns a response, where all bytes except the checksum
+// are fill bytes.
+func filledResponse() []byte {
+	data := make([]byte, ResponseLength)
+	for i := 0; i < ResponseLength-1; i++ {
+		data[i] = FillByte
+	}
+	return data
+}
+
+// checkLength returns an error, if data is not a complete response.
+func checkLength(data []byte) error {
+	if len(data) != ResponseLength {
+		return fmt.Errorf("Invalid data, expected %d bytes, but got %d\n", ResponseLength, len(data))
+	}
+	return nil
+}
+
+// MonthlyEnergy is the energy harvested in one month.
+type MonthlyEnergy struct {
+	Date   time.Time // first day of the month
+	Energy float32   // kWh
+}
+
+// ConvertMonthlyEnergy converts the response for one slot of the monthly
+// data. An empty slot results in a zero Date.
+//
+// Experimental: the layout isn't documented and hasn't been verified with a
+// real NT5000 yet, only with the emulator.
+func ConvertMonthlyEnergy(data []byte) (MonthlyEnergy, error) {
+	m := MonthlyEnergy{}
+	if err := checkLength(data); err != nil {
+		return m, err
+	}
+	if data[0] == FillByte {
+		return m, nil
+	}
+	if data[0] < 1 || data[0] > 12 {
+		return m, fmt.Errorf("Invalid month %d\n", data[0])
+	}
+
+	m.Date = time.Date(int(data[1])+2000, time.Month(data[0]), 1, 0, 0, 0, 0, time.Local)
+	m.Energy = (float32(data[2])*256 + float32(data[3])) / 10.0
+	return m, nil
+}
+
+func ConvertMonthlyEnergyToByte(m MonthlyEnergy) []byte {
+	data := filledResponse()
+
+	if !m.Date.IsZero() {
+		energy := uint16(m.Energy*10.0 + 0.5)
+		data[0] = byte(m.Date.Month())
+		data[1] = byte(m.Date.Year() - 2000)
+		data[2] = byte(energy >> 8)
+		data[3] = byte(energy)
+	}
+
+	CalculateChecksum(data)
+	return data
+}
+
+// YearlyEnergy is the energy harvested in one year.
+type YearlyEnergy struct {
+	Date   time.Time // first day of the year
+	Energy float32   // kWh
+}
+
+// ConvertYearlyEnergy converts the response for one slot of the yearly
+// data. An empty slot results in a zero Date.
+//
+// Experimental: like the monthly data, the layout hasn't been verified with a
+// real NT5000 yet.
+func ConvertYearlyEnergy(data []byte) (YearlyEnergy, error) {
+	y := YearlyEnergy{}
+	if err := checkLength(data); err != nil {
+		return y, err
+	}
+	// the year alone can't tell an empty slot, 0x0d is 2013
+	if data[0] == FillByte && data[1] == FillByte && data[2] == FillByte {
+		return y, nil
+	}
+
+	y.Date = time.Date(int(data[0])+2000, time.January, 1, 0, 0, 0, 0, time.Local)
+	y.Energy = float32(data[1])*256 + float32(data[2])
+	return y, nil
+}
+
+func ConvertYearlyEnergyToByte(y YearlyEnergy) []byte {
+	data := filledResponse()
+
+	if !y.Date.IsZero() {
+		energy := uint16(y.Energy + 0.5)
+		data[0] = byte(y.Date.Year() - 2000)
+		data[1] = byte(energy >> 8)
+		data[2] = byte(energy)
+	}
+
+	CalculateChecksum(data)
+	return data
+}
+
+// ConvertTime converts the response of the read time command.
+func ConvertTime(data []byte) (time.Time, error) {
+	if err := checkLength(data); err != nil {
+		return time.Time{}, err
+	}
+	return time.Date(int(data[0])+2000, time.Month(data[1]), int(data[2]), int(data[3]), int(data[4]), 0, 0, time.Local), nil
+}
+
+func ConvertTimeToByte(t time.Time) []byte {
+	data := filledResponse()
+	data[0] = byte(t.Year() - 2000)
+	data[1] = byte(t.Month())
+	data[2] = byte(t.Day())
+	data[3] = byte(t.Hour())
+	data[4] = byte(t.Minute())
+
+	CalculateChecksum(data)
+	return data
+}
+
+// ConvertSerialNumber converts the response of the read serial number command.
+func ConvertSerialNumber(data []byte) (string, error) {
+	if err := checkLength(data); err != nil {
+		return "", err
+	}
+	return withoutFillBytes(data[0:12]), nil
+}
+
+func ConvertSerialNumberToByte(serialnumber string) []byte {
+	data := filledResponse()
+	copy(data[0:12], serialnumber)
+
+	CalculateChecksum(data)
+	return data
+}
+
+// ConvertProtocolAndFirmware converts the response of the read protocol and
+// firmware command.
+func ConvertProtocolAndFirmware(data []byte) (string, string, error) {
+	if err := checkLength(data); err != nil {
+		return "", "", err
+	}
+	return string(data[0:2]), withoutFillBytes(data[2:11]), nil
+}
+
+func ConvertProtocolAndFirmwareToByte(protocol string, firmware string) []byte {
+	data := filledResponse()
+	copy(data[0:2], protocol)
+	copy(data[2:11], firmware)
+
+	CalculateChecksum(data)
+	return data
+}
+
+func withoutFillBytes(data []byte) string {
+	var result string = ""
+	for _, b := range data {
+		if b != FillByte {
+			result += string(b)
+		}
+	}
+	return result
+}
+
+// ConvertErrors converts the response for one slot of the error memory.
+// Each slot contains up to two errors.
+func ConvertErrors(data []byte) ([]Error, error) {
+	if err := checkLength(data); err != nil {
+		return nil, err
+	}
+
+	var result []Error
+	for _, e := range [][]byte{data[0:6], data[6:12]} {
+		if e[0] != FillByte {
+			result = append(result, Error{
+				Date: time.Date(int(e[5])+2000, time.Month(e[0]), int(e[1]), int(e[2]), int(e[3]), 0, 0, time.Local),
+				Code: e[4],
+			})
+		}
+	}
+	return result, nil
+}
+
+// ConvertErrorsToByte encodes up to two errors as one slot of the error memory.
+func ConvertErrorsToByte(errors []Error) []byte {
+	data := filledResponse()
+	for i := 0; i < len(errors) && i < 2; i++ {
+		e := data[i*6 : i*6+6]
+		e[0] = byte(errors[i].Date.Month())
+		e[1] = byte(errors[i].Date.Day())
+		e[2] = byte(errors[i].Date.Hour())
+		e[3] = byte(errors[i].Date.Minute())
+		e[4] = errors[i].Code
+		e[5] = byte(errors[i].Date.Year() - 2000)
+	}
+
+	CalculateChecksum(data)
+	return data
+}
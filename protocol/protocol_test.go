@@ -3,6 +3,7 @@ package protocol_test
 import (
 	"bytes"
 	"testing"
+	"time"
 
 	"github.com/adangel/nt5000-serial/protocol"
 )
@@ -106,3 +107,78 @@ func assertCorrectChecksum(t *testing.T, err error) {
 		t.Fatalf("Expected no error for correct checksum\n")
 	}
 }
+
+func TestConvertMonthlyEnergy(t *testing.T) {
+	data := []byte("\x0a\x1a\x0c\x35\x0d\x0d\x0d\x0d\x0d\x0d\x0d\x0d\x00")
+	protocol.CalculateChecksum(data)
+	m, err := protocol.ConvertMonthlyEnergy(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if m.Date.Year() != 2026 || m.Date.Month() != time.October || m.Date.Day() != 1 {
+		t.Fatalf("Wrong date: %v\n", m.Date)
+	}
+	assert(t, "Energy", 312.5, m.Energy)
+
+	if !bytes.Equal(protocol.ConvertMonthlyEnergyToByte(m), data) {
+		t.Fatalf("Invalid data conversion: %x\n", protocol.ConvertMonthlyEnergyToByte(m))
+	}
+}
+
+func TestConvertMonthlyEnergyEmptySlot(t *testing.T) {
+	data := protocol.ConvertMonthlyEnergyToByte(protocol.MonthlyEnergy{})
+	m, err := protocol.ConvertMonthlyEnergy(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if !m.Date.IsZero() {
+		t.Fatalf("Expected empty slot, got %v\n", m.Date)
+	}
+}
+
+func TestConvertYearlyEnergy(t *testing.T) {
+	data := []byte("\x19\x11\x94\x0d\x0d\x0d\x0d\x0d\x0d\x0d\x0d\x0d\x00")
+	protocol.CalculateChecksum(data)
+	y, err := protocol.ConvertYearlyEnergy(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if y.Date.Year() != 2025 || y.Date.Month() != time.January || y.Date.Day() != 1 {
+		t.Fatalf("Wrong date: %v\n", y.Date)
+	}
+	assert(t, "Energy", 4500, y.Energy)
+
+	if !bytes.Equal(protocol.ConvertYearlyEnergyToByte(y), data) {
+		t.Fatalf("Invalid data conversion: %x\n", protocol.ConvertYearlyEnergyToByte(y))
+	}
+
+	empty, err := protocol.ConvertYearlyEnergy(protocol.ConvertYearlyEnergyToByte(protocol.YearlyEnergy{}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if !empty.Date.IsZero() {
+		t.Fatalf("Expected empty slot, got %v\n", empty.Date)
+	}
+
+	y2013 := protocol.YearlyEnergy{Date: time.Date(2013, time.January, 1, 0, 0, 0, 0, time.Local), Energy: 4321}
+	y, err = protocol.ConvertYearlyEnergy(protocol.ConvertYearlyEnergyToByte(y2013))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if !y.Date.Equal(y2013.Date) {
+		t.Fatalf("Wrong date for 2013: %v\n", y.Date)
+	}
+	assert(t, "Energy", 4321, y.Energy)
+}
+
+func TestLookupFault(t *testing.T) {
+	fault := protocol.LookupFault(0x11)
+	if fault.Number != 4 || fault.Severity != protocol.SeverityWarning || fault.Name() != "fault 004" {
+		t.Fatalf("Wrong fault for 0x11: %+v\n", fault)
+	}
+
+	fault = protocol.Error{Code: 0xfe}.Fault()
+	if fault.Code != 0xfe || fault.Severity != protocol.SeverityUnknown || fault.Name() != "code 0xfe" {
+		t.Fatalf("Wrong fault for unknown code: %+v\n", fault)
+	}
+}
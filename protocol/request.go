@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+// Command is the third byte of a request and selects what the inverter
+// should do.
+type Command byte
+
+const (
+	ReadErrors              Command = 0x01
+	ReadData                Command = 0x02
+	ReadMonthlyEnergy       Command = 0x03
+	ReadYearlyEnergy        Command = 0x04
+	ReadTime                Command = 0x06
+	ReadSerialNumber        Command = 0x08
+	ReadProtocolAndFirmware Command = 0x09
+	SetYear                 Command = 0x32
+	SetMonth                Command = 0x33
+	SetDay                  Command = 0x34
+	SetHour                 Command = 0x35
+	SetMinute               Command = 0x36
+)
+
+func (c Command) String() string {
+	switch c {
+	case ReadErrors:
+		return "read errors"
+	case ReadData:
+		return "read data"
+	case ReadMonthlyEnergy:
+		return "read monthly energy"
+	case ReadYearlyEnergy:
+		return "read yearly energy"
+	case ReadTime:
+		return "read time"
+	case ReadSerialNumber:
+		return "read serial number"
+	case ReadProtocolAndFirmware:
+		return "read protocol and firmware"
+	case SetYear:
+		return "set year"
+	case SetMonth:
+		return "set month"
+	case SetDay:
+		return "set day"
+	case SetHour:
+		return "set hour"
+	case SetMinute:
+		return "set minute"
+	default:
+		return fmt.Sprintf("unknown command 0x%02x", byte(c))
+	}
+}
+
+const (
+	// DefaultAddress is the address of an inverter, that is used for all
+	// read commands.
+	DefaultAddress byte = 0x01
+	// BroadcastAddress is used for the commands to set the time.
+	BroadcastAddress byte = 0xff
+)
+
+// RequestLength is the length of every request including the checksum.
+const RequestLength = 5
+
+// ResponseLength is the length of every response including the checksum.
+const ResponseLength = 13
+
+// Request is a frame, that is sent to the inverter.
+type Request struct {
+	Address   byte
+	Command   Command
+	Parameter byte
+}
+
+// NewRequest returns a request for the inverter with the default address.
+// Read commands use the parameter to select a slot, set commands use it as
+// the value.
+func NewRequest(command Command, parameter byte) Request {
+	return Request{Address: DefaultAddress, Command: command, Parameter: parameter}
+}
+
+// Bytes encodes the request including the checksum.
+func (r Request) Bytes() []byte {
+	data := []byte{0x00, r.Address, byte(r.Command), r.Parameter, 0x00}
+	CalculateChecksum(data)
+	return data
+}
+
+// ParseRequest decodes a request and verifies its checksum.
+func ParseRequest(data []byte) (Request, error) {
+	if len(data) != RequestLength {
+		return Request{}, fmt.Errorf("Invalid request, expected %d bytes, but got %d\n", RequestLength, len(data))
+	}
+	err := VerifyChecksum(data)
+	if err != nil {
+		return Request{}, err
+	}
+	return Request{Address: data[1], Command: Command(data[2]), Parameter: data[3]}, nil
+}
+
+// SetTimeRequests returns the requests to set the clock of the inverter.
+// Hour and minute need to be sent increased by one.
+func SetTimeRequests(t time.Time) []Request {
+	return []Request{
+		{Address: BroadcastAddress, Command: SetYear, Parameter: byte(t.Year() - 2000)},
+		{Address: BroadcastAddress, Command: SetMonth, Parameter: byte(t.Month())},
+		{Address: BroadcastAddress, Command: SetDay, Parameter: byte(t.Day())},
+		{Address: BroadcastAddress, Command: SetHour, Parameter: byte(t.Hour() + 1)},
+		{Address: BroadcastAddress, Command: SetMinute, Parameter: byte(t.Minute() + 1)},
+	}
+}
@@ -0,0 +1,121 @@
+package protocol_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/protocol"
+)
+
+func TestRequestBytes(t *testing.T) {
+	assertBytes(t, "\x00\x01\x02\x01\x04", protocol.NewRequest(protocol.ReadData, 0x01).Bytes())
+	assertBytes(t, "\x00\x01\x06\x01\x08", protocol.NewRequest(protocol.ReadTime, 0x01).Bytes())
+	assertBytes(t, "\x00\x01\x08\x01\x0a", protocol.NewRequest(protocol.ReadSerialNumber, 0x01).Bytes())
+	assertBytes(t, "\x00\x01\x09\x01\x0b", protocol.NewRequest(protocol.ReadProtocolAndFirmware, 0x01).Bytes())
+	assertBytes(t, "\x00\x01\x01\x03\x05", protocol.NewRequest(protocol.ReadErrors, 0x03).Bytes())
+}
+
+func TestParseRequest(t *testing.T) {
+	r, err := protocol.ParseRequest([]byte("\x00\x01\x01\x03\x05"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if r.Address != protocol.DefaultAddress || r.Command != protocol.ReadErrors || r.Parameter != 0x03 {
+		t.Fatalf("Wrong request: %+v\n", r)
+	}
+
+	_, err = protocol.ParseRequest([]byte("\x00\x01\x01\x03\x06"))
+	assertWrongChecksum(t, err)
+
+	_, err = protocol.ParseRequest([]byte("\x00\x01\x01"))
+	if err == nil {
+		t.Fatalf("Expected error for incomplete request\n")
+	}
+}
+
+func TestSetTimeRequests(t *testing.T) {
+	requests := protocol.SetTimeRequests(time.Date(2022, time.April, 10, 14, 0, 0, 0, time.Local))
+	if len(requests) != 5 {
+		t.Fatalf("Expected 5 requests, got %v\n", len(requests))
+	}
+	assertBytes(t, "\x00\xff\x32\x16\x47", requests[0].Bytes())
+	assertBytes(t, "\x00\xff\x33\x04\x36", requests[1].Bytes())
+	assertBytes(t, "\x00\xff\x34\x0a\x3d", requests[2].Bytes())
+	assertBytes(t, "\x00\xff\x35\x0f\x43", requests[3].Bytes())
+	assertBytes(t, "\x00\xff\x36\x01\x36", requests[4].Bytes())
+}
+
+func TestConvertTime(t *testing.T) {
+	date := time.Date(2022, time.April, 10, 21, 3, 0, 0, time.Local)
+	data := protocol.ConvertTimeToByte(date)
+	assertCorrectChecksum(t, protocol.VerifyChecksum(data))
+
+	converted, err := protocol.ConvertTime(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if !converted.Equal(date) {
+		t.Fatalf("Wrong time: %v\n", converted)
+	}
+}
+
+func TestConvertSerialNumber(t *testing.T) {
+	data := protocol.ConvertSerialNumberToByte("1533A5012345")
+	assertBytes(t, "1533A5012345\x71", data)
+
+	serialnumber, err := protocol.ConvertSerialNumber([]byte("1533A50123\x0d\x0d\x6b"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if serialnumber != "1533A50123" {
+		t.Fatalf("Wrong serial number: %q\n", serialnumber)
+	}
+}
+
+func TestConvertProtocolAndFirmware(t *testing.T) {
+	data := protocol.ConvertProtocolAndFirmwareToByte("11", "1-23")
+	proto, firmware, err := protocol.ConvertProtocolAndFirmware(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if proto != "11" || firmware != "1-23" {
+		t.Fatalf("Wrong protocol/firmware: %q %q\n", proto, firmware)
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+	errors := []protocol.Error{
+		{Date: time.Date(2022, time.April, 10, 20, 3, 0, 0, time.Local), Code: 0x11},
+		{Date: time.Date(2022, time.May, 1, 8, 15, 0, 0, time.Local), Code: 0x12},
+	}
+	data := protocol.ConvertErrorsToByte(errors)
+	assertBytes(t, "\x04\x0a\x14\x03\x11\x16\x05\x01\x08\x0f\x12\x16\x91", data)
+
+	converted, err := protocol.ConvertErrors(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if len(converted) != 2 {
+		t.Fatalf("Expected 2 errors, got %v\n", len(converted))
+	}
+	for i := range errors {
+		if !converted[i].Date.Equal(errors[i].Date) || converted[i].Code != errors[i].Code {
+			t.Fatalf("Wrong error %d: %+v\n", i, converted[i])
+		}
+	}
+
+	converted, err = protocol.ConvertErrors(protocol.ConvertErrorsToByte(nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if len(converted) != 0 {
+		t.Fatalf("Expected no errors, got %v\n", converted)
+	}
+}
+
+func assertBytes(t *testing.T, expected string, actual []byte) {
+	if !bytes.Equal([]byte(expected), actual) {
+		t.Fatalf("Wrong bytes: expected=%x actual=%x\n", expected, actual)
+	}
+}
@@ -0,0 +1,492 @@
+package pvoutput
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adangel/nt5000-serial/history"
+	"github.com/adangel/nt5000-serial/protocol"
+)
+
+// Options configure the uploads to PVOutput.
+type Options struct {
+	// BaseURL is the URL of the PVOutput API, https://pvoutput.org by default.
+	BaseURL  string `yaml:"url"`
+	APIKey   string `yaml:"api_key"`
+	SystemID string `yaml:"system_id"`
+	// Interval is the status interval, that is configured for the system on
+	// PVOutput: 5, 10 or 15 minutes.
+	Interval time.Duration `yaml:"interval"`
+	// Backfill is how far back missed statuses are uploaded from the history.
+	Backfill time.Duration `yaml:"backfill"`
+}
+
+// DefaultOptions are used for all options, that aren't set.
+var DefaultOptions = Options{
+	BaseURL:  "https://pvoutput.org",
+	Interval: 5 * time.Minute,
+	Backfill: 48 * time.Hour,
+}
+
+const (
+	// batchSize is the maximum number of statuses per batch request.
+	batchSize = 30
+	// maxBatches is the maximum number of batch requests per interval, so
+	// that backfilling doesn't exceed the rate limit of 60 requests per hour.
+	maxBatches = 3
+	// maxBackfill is the maximum age of statuses, that PVOutput accepts.
+	maxBackfill = 14 * 24 * time.Hour
+)
+
+// Status is one status of the system.
+type Status struct {
+	Date time.Time
+	// Energy is the energy generated today in Wh.
+	Energy float64
+	// Power is the current power in W.
+	Power       float64
+	Temperature float64
+	Voltage     float64
+}
+
+// Uploader uploads the status of the system at every interval and the
+// energy generated at the end of the day. If a history store is given,
+// statuses, that couldn't be uploaded, are uploaded later from the history.
+// All inverters are uploaded as one system: energy and power are summed up,
+// temperature and voltage are averaged.
+type Uploader struct {
+	options Options
+	client  *http.Client
+	store   *history.Store
+
+	mu        sync.Mutex
+	inverters []protocol.Inverter
+	latest    map[string]protocol.DataPoint
+	// energy is the highest daily energy of every inverter on day.
+	energy map[string]float32
+	day    string
+	// outputs is the energy of the past days, that hasn't been uploaded yet.
+	outputs map[string]float32
+	// uploaded is the date of the last status, up to which all statuses
+	// have been uploaded.
+	uploaded time.Time
+
+	done chan struct{}
+}
+
+// New returns an uploader for the given inverters. store might be nil.
+func New(options Options, inverters []protocol.Inverter, store *history.Store) (*Uploader, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	if options.BaseURL == "" {
+		options.BaseURL = DefaultOptions.BaseURL
+	}
+	if options.Interval == 0 {
+		options.Interval = DefaultOptions.Interval
+	}
+	if options.Backfill == 0 {
+		options.Backfill = DefaultOptions.Backfill
+	}
+	if options.Backfill > maxBackfill {
+		options.Backfill = maxBackfill
+	}
+	options.BaseURL = strings.TrimSuffix(options.BaseURL, "/")
+
+	return &Uploader{
+		options:   options,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		store:     store,
+		inverters: inverters,
+		latest:    make(map[string]protocol.DataPoint),
+		energy:    make(map[string]float32),
+		outputs:   make(map[string]float32),
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// Validate checks, that the API key and the system id are given and that the
+// interval is supported. A zero interval means the default.
+func (o Options) Validate() error {
+	if o.APIKey == "" || o.SystemID == "" {
+		return fmt.Errorf("PVOutput API key and system id are required\n")
+	}
+	switch o.Interval {
+	case 0, 5 * time.Minute, 10 * time.Minute, 15 * time.Minute:
+		return nil
+	}
+	return fmt.Errorf("Invalid PVOutput interval %v, use 5m, 10m or 15m\n", o.Interval)
+}
+
+// Data remembers the data point for the next status.
+func (u *Uploader) Data(inverter protocol.Inverter, data protocol.DataPoint) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.latest[inverter.Name] = data
+	day := data.Date.Local().Format("20060102")
+	if day == u.day && data.EnergyDay > u.energy[inverter.Name] {
+		u.energy[inverter.Name] = data.EnergyDay
+	}
+}
+
+// Start uploads in the background until Close is called.
+func (u *Uploader) Start() {
+	go u.run()
+}
+
+// Close stops uploading.
+func (u *Uploader) Close() error {
+	select {
+	case <-u.done:
+	default:
+		close(u.done)
+	}
+	return nil
+}
+
+func (u *Uploader) run() {
+	u.Init(time.Now())
+	for {
+		now := time.Now()
+		next := boundary(now, u.options.Interval).Add(u.options.Interval)
+		select {
+		case <-u.done:
+			return
+		case <-time.After(next.Sub(now)):
+		}
+		if err := u.Upload(next); err != nil {
+			log.Printf("Couldn't upload to PVOutput: %v\n", err)
+		}
+	}
+}
+
+// Init asks PVOutput for the last status, so that missed statuses since
+// then can be backfilled.
+func (u *Uploader) Init(now time.Time) {
+	earliest := boundary(now, u.options.Interval).Add(-u.options.Backfill)
+	last, err := u.lastStatus()
+	if err != nil {
+		log.Printf("Couldn't get last status from PVOutput: %v\n", err)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.uploaded = earliest
+	if last.After(earliest) {
+		u.uploaded = last
+	}
+	u.day = now.Local().Format("20060102")
+}
+
+// Upload uploads the status at the given time, missed statuses from the
+// history and the output of the previous day, if the day has changed. If one
+// of them fails, the others are still uploaded.
+func (u *Uploader) Upload(now time.Time) error {
+	at := boundary(now, u.options.Interval)
+	u.nextDay(at)
+
+	var errs []string
+	caughtUp, err := u.backfill(at)
+	if err != nil {
+		log.Printf("Couldn't backfill PVOutput: %v\n", err)
+		errs = append(errs, err.Error())
+	}
+
+	if status, ok := u.currentStatus(at); ok {
+		if err := u.addStatus(status); err != nil {
+			errs = append(errs, err.Error())
+		} else if caughtUp {
+			u.mu.Lock()
+			u.uploaded = at
+			u.mu.Unlock()
+		}
+	}
+
+	if err := u.endOfDay(at); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// currentStatus combines the latest data of all inverters, that is newer
+// than one interval. Inverters without new data keep their energy of today,
+// so that the energy of the system doesn't drop, if one of them misses a poll.
+func (u *Uploader) currentStatus(at time.Time) (Status, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var points []protocol.DataPoint
+	fresh := make(map[string]bool)
+	for name, data := range u.latest {
+		if data.Date.After(at.Add(-u.options.Interval)) && !data.Date.After(at) {
+			points = append(points, data)
+			fresh[name] = true
+		}
+	}
+	if len(points) == 0 {
+		return Status{}, false
+	}
+	status := combine(at, points)
+	for name, energy := range u.energy {
+		if !fresh[name] {
+			status.Energy += float64(energy) * 1000
+		}
+	}
+	return status, true
+}
+
+// backfill uploads missed statuses from the history. It returns true, if
+// all statuses up to the given time have been uploaded.
+func (u *Uploader) backfill(at time.Time) (bool, error) {
+	u.mu.Lock()
+	from := u.uploaded
+	u.mu.Unlock()
+	if u.store == nil || from.IsZero() || !from.Before(at.Add(-u.options.Interval)) {
+		return true, nil
+	}
+
+	to := at.Add(-u.options.Interval)
+	statuses, err := u.history(from, to)
+	if err != nil {
+		return false, err
+	}
+	if len(statuses) > 0 {
+		log.Printf("Backfilling %v statuses to PVOutput since %v\n", len(statuses), from.Format(time.RFC3339))
+	}
+	for batch := 0; len(statuses) > 0; batch++ {
+		if batch == maxBatches {
+			// continue at the next interval
+			return false, nil
+		}
+		n := batchSize
+		if n > len(statuses) {
+			n = len(statuses)
+		}
+		if err := u.addBatchStatus(statuses[:n]); err != nil {
+			return false, err
+		}
+		u.mu.Lock()
+		u.uploaded = statuses[n-1].Date
+		u.mu.Unlock()
+		statuses = statuses[n:]
+	}
+	// everything in the history has been uploaded, there might have been no data
+	u.mu.Lock()
+	u.uploaded = to
+	u.mu.Unlock()
+	return true, nil
+}
+
+// history returns the statuses with from < date <= to from the history.
+func (u *Uploader) history(from, to time.Time) ([]Status, error) {
+	// by unix time, times with different locations wouldn't be equal
+	byDate := make(map[int64][]protocol.DataPoint)
+	for _, inverter := range u.inverters {
+		points, err := u.store.Query(inverter.Name, from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range history.Aggregate(points, u.options.Interval, history.Average) {
+			// the status is reported at the end of the interval
+			end := p.Date.Add(u.options.Interval)
+			if end.After(from) && !end.After(to) {
+				byDate[end.Unix()] = append(byDate[end.Unix()], p)
+			}
+		}
+	}
+
+	var statuses []Status
+	for date, points := range byDate {
+		statuses = append(statuses, combine(time.Unix(date, 0), points))
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Date.Before(statuses[j].Date)
+	})
+	return statuses, nil
+}
+
+// nextDay remembers the energy of the previous day for the upload, once the
+// day has changed.
+func (u *Uploader) nextDay(at time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	day := at.Local().Format("20060102")
+	if day == u.day {
+		return
+	}
+	if u.day != "" {
+		var energy float32
+		for _, e := range u.energy {
+			energy += e
+		}
+		u.outputs[u.day] = energy
+	}
+	u.day = day
+	u.energy = make(map[string]float32)
+}
+
+// endOfDay uploads the energy of the previous days. If an upload fails, it's
+// tried again at the next interval, until PVOutput doesn't accept the day
+// anymore.
+func (u *Uploader) endOfDay(at time.Time) error {
+	earliest := at.Add(-maxBackfill).Local().Format("20060102")
+	u.mu.Lock()
+	var days []string
+	for day := range u.outputs {
+		days = append(days, day)
+	}
+	u.mu.Unlock()
+	sort.Strings(days)
+
+	for _, day := range days {
+		u.mu.Lock()
+		energy := u.outputs[day]
+		u.mu.Unlock()
+		if day < earliest {
+			log.Printf("Dropping output of %s for PVOutput, it's too old\n", day)
+		} else if err := u.uploadOutput(day, energy); err != nil {
+			return err
+		}
+		u.mu.Lock()
+		delete(u.outputs, day)
+		u.mu.Unlock()
+	}
+	return nil
+}
+
+// uploadOutput uploads the energy of the given day. With a history store,
+// the energy is taken from the history instead.
+func (u *Uploader) uploadOutput(day string, energy float32) error {
+	if u.store != nil {
+		date, _ := time.ParseInLocation("20060102", day, time.Local)
+		energy = 0
+		for _, inverter := range u.inverters {
+			daily, err := u.store.Daily(inverter.Name, date, date.AddDate(0, 0, 1))
+			if err != nil {
+				return err
+			}
+			for _, d := range daily {
+				energy += d.Energy
+			}
+		}
+	}
+	if energy == 0 {
+		return nil
+	}
+	return u.addOutput(day, float64(energy)*1000)
+}
+
+// combine sums up energy and power and averages temperature and voltage of
+// all inverters.
+func combine(date time.Time, points []protocol.DataPoint) Status {
+	status := Status{Date: date}
+	for _, p := range points {
+		status.Energy += float64(p.EnergyDay) * 1000
+		status.Power += float64(p.AC.Power) * 1000
+		status.Temperature += float64(p.Temperature)
+		status.Voltage += float64(p.AC.Voltage)
+	}
+	status.Temperature /= float64(len(points))
+	status.Voltage /= float64(len(points))
+	return status
+}
+
+// boundary returns the start of the interval in local time.
+func boundary(t time.Time, interval time.Duration) time.Time {
+	_, offset := t.Zone()
+	shift := time.Duration(offset) * time.Second
+	return t.Add(shift).Truncate(interval).Add(-shift)
+}
+
+func (s Status) values() []string {
+	local := s.Date.Local()
+	return []string{
+		local.Format("20060102"),
+		local.Format("15:04"),
+		strconv.FormatFloat(s.Energy, 'f', 0, 64),
+		strconv.FormatFloat(s.Power, 'f', 0, 64),
+		"",
+		"",
+		strconv.FormatFloat(s.Temperature, 'f', 1, 64),
+		strconv.FormatFloat(s.Voltage, 'f', 1, 64),
+	}
+}
+
+func (u *Uploader) addStatus(s Status) error {
+	v := s.values()
+	params := url.Values{}
+	params.Set("d", v[0])
+	params.Set("t", v[1])
+	params.Set("v1", v[2])
+	params.Set("v2", v[3])
+	params.Set("v5", v[6])
+	params.Set("v6", v[7])
+	_, err := u.post("/service/r2/addstatus.jsp", params)
+	return err
+}
+
+func (u *Uploader) addBatchStatus(statuses []Status) error {
+	var data []string
+	for _, s := range statuses {
+		data = append(data, strings.Join(s.values(), ","))
+	}
+	params := url.Values{}
+	params.Set("data", strings.Join(data, ";"))
+	_, err := u.post("/service/r2/addbatchstatus.jsp", params)
+	return err
+}
+
+func (u *Uploader) addOutput(day string, energy float64) error {
+	params := url.Values{}
+	params.Set("d", day)
+	params.Set("g", strconv.FormatFloat(energy, 'f', 0, 64))
+	_, err := u.post("/service/r2/addoutput.jsp", params)
+	return err
+}
+
+// lastStatus returns the date of the last status, that has been uploaded.
+func (u *Uploader) lastStatus() (time.Time, error) {
+	body, err := u.post("/service/r2/getstatus.jsp", url.Values{})
+	if err != nil {
+		return time.Time{}, err
+	}
+	fields := strings.Split(body, ",")
+	if len(fields) < 2 {
+		return time.Time{}, fmt.Errorf("Invalid status %q\n", body)
+	}
+	return time.ParseInLocation("20060102 15:04", fields[0]+" "+fields[1], time.Local)
+}
+
+func (u *Uploader) post(path string, params url.Values) (string, error) {
+	request, err := http.NewRequest(http.MethodPost, u.options.BaseURL+path, strings.NewReader(params.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("X-Pvoutput-Apikey", u.options.APIKey)
+	request.Header.Set("X-Pvoutput-SystemId", u.options.SystemID)
+
+	response, err := u.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("PVOutput returned %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return strings.TrimSpace(string(body)), nil
+}
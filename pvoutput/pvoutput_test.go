@@ -0,0 +1,318 @@
+package pvoutput_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/history"
+	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/pvoutput"
+)
+
+type request struct {
+	path   string
+	params url.Values
+}
+
+// server is a stand-in for PVOutput, that records all requests.
+type server struct {
+	mu         sync.Mutex
+	lastStatus string
+	requests   []request
+	// failOutputs is the number of outputs, that fail.
+	failOutputs int
+	// failBatches is the number of batch statuses, that fail.
+	failBatches int
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Pvoutput-Apikey") != "key" || r.Header.Get("X-Pvoutput-SystemId") != "42" {
+		http.Error(w, "Unauthorized 401: Invalid API Key", http.StatusUnauthorized)
+		return
+	}
+	r.ParseForm()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.HasSuffix(r.URL.Path, "/getstatus.jsp") {
+		if s.lastStatus == "" {
+			http.Error(w, "Bad request 400: No status found", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(s.lastStatus))
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/addoutput.jsp") && s.failOutputs > 0 {
+		s.failOutputs--
+		http.Error(w, "Forbidden 403: Exceeded number requests per hour", http.StatusForbidden)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/addbatchstatus.jsp") && s.failBatches > 0 {
+		s.failBatches--
+		http.Error(w, "Bad request 400: Date is older than 14 days", http.StatusBadRequest)
+		return
+	}
+	s.requests = append(s.requests, request{r.URL.Path, r.PostForm})
+	w.Write([]byte("OK 200: Added Status"))
+}
+
+func (s *server) find(path string) []request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []request
+	for _, r := range s.requests {
+		if r.path == path {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+func dataPoint(date time.Time, power float32, energy float32, voltage float32) protocol.DataPoint {
+	return protocol.DataPoint{
+		Date:        date,
+		AC:          protocol.Measurement{Voltage: voltage, Power: power},
+		Temperature: 20,
+		EnergyDay:   energy,
+	}
+}
+
+func TestUploadStatus(t *testing.T) {
+	s := &server{}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	inverters := []protocol.Inverter{protocol.NewInverter(1), protocol.NewInverter(2)}
+	u, err := pvoutput.New(pvoutput.Options{BaseURL: ts.URL, APIKey: "key", SystemID: "42"}, inverters, nil)
+	if err != nil {
+		t.Fatalf("Couldn't create uploader: %v\n", err)
+	}
+	at := time.Date(2022, 4, 10, 12, 5, 0, 0, time.Local)
+	u.Init(at.Add(-time.Minute))
+	u.Data(inverters[0], dataPoint(at.Add(-time.Minute), 1.5, 2.25, 230))
+	u.Data(inverters[1], dataPoint(at.Add(-2*time.Minute), 0.5, 1, 232))
+
+	err = u.Upload(at.Add(time.Second))
+	if err != nil {
+		t.Fatalf("Couldn't upload: %v\n", err)
+	}
+
+	statuses := s.find("/service/r2/addstatus.jsp")
+	if len(statuses) != 1 {
+		t.Fatalf("Expected 1 status, got %v\n", s.requests)
+	}
+	expected := url.Values{"d": {"20220410"}, "t": {"12:05"}, "v1": {"3250"}, "v2": {"2000"}, "v5": {"20.0"}, "v6": {"231.0"}}
+	if statuses[0].params.Encode() != expected.Encode() {
+		t.Fatalf("Expected %v, got %v\n", expected, statuses[0].params)
+	}
+
+	// no new data, no status
+	u.Upload(at.Add(5 * time.Minute))
+	if n := len(s.find("/service/r2/addstatus.jsp")); n != 1 {
+		t.Fatalf("Expected no new status, got %v\n", n)
+	}
+}
+
+func TestMissedPoll(t *testing.T) {
+	s := &server{}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	inverters := []protocol.Inverter{protocol.NewInverter(1), protocol.NewInverter(2)}
+	u, err := pvoutput.New(pvoutput.Options{BaseURL: ts.URL, APIKey: "key", SystemID: "42"}, inverters, nil)
+	if err != nil {
+		t.Fatalf("Couldn't create uploader: %v\n", err)
+	}
+	at := time.Date(2022, 4, 10, 12, 5, 0, 0, time.Local)
+	u.Init(at.Add(-time.Minute))
+	u.Data(inverters[0], dataPoint(at.Add(-time.Minute), 1.5, 2.25, 230))
+	u.Data(inverters[1], dataPoint(at.Add(-time.Minute), 0.5, 1, 232))
+	u.Upload(at)
+
+	// the second inverter misses the poll, its energy is kept
+	u.Data(inverters[0], dataPoint(at.Add(4*time.Minute), 1.5, 2.5, 230))
+	if err := u.Upload(at.Add(5 * time.Minute)); err != nil {
+		t.Fatalf("Couldn't upload: %v\n", err)
+	}
+	statuses := s.find("/service/r2/addstatus.jsp")
+	if len(statuses) != 2 {
+		t.Fatalf("Expected 2 statuses, got %v\n", s.requests)
+	}
+	if statuses[1].params.Get("v1") != "3500" || statuses[1].params.Get("v2") != "1500" {
+		t.Fatalf("Wrong status: %v\n", statuses[1].params)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	s := &server{lastStatus: "20220410,11:00,1000,500,NaN,NaN,20.0,230.0"}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	store, err := history.Open(t.TempDir(), history.DefaultPolicy)
+	if err != nil {
+		t.Fatalf("Couldn't open store: %v\n", err)
+	}
+	inverter := protocol.NewInverter(1)
+	start := time.Date(2022, 4, 10, 10, 30, 0, 0, time.Local)
+	for i := 0; i < 90; i++ {
+		store.Append(inverter.Name, dataPoint(start.Add(time.Duration(i)*time.Minute), float32(i)/10, float32(i), 230))
+	}
+
+	u, err := pvoutput.New(pvoutput.Options{BaseURL: ts.URL, APIKey: "key", SystemID: "42"}, []protocol.Inverter{inverter}, store)
+	if err != nil {
+		t.Fatalf("Couldn't create uploader: %v\n", err)
+	}
+	now := time.Date(2022, 4, 10, 12, 0, 0, 0, time.Local)
+	u.Init(now)
+	u.Data(inverter, dataPoint(now.Add(-time.Minute), 8.9, 89, 230))
+	err = u.Upload(now)
+	if err != nil {
+		t.Fatalf("Couldn't upload: %v\n", err)
+	}
+
+	batches := s.find("/service/r2/addbatchstatus.jsp")
+	if len(batches) != 1 {
+		t.Fatalf("Expected 1 batch, got %v\n", s.requests)
+	}
+	statuses := strings.Split(batches[0].params.Get("data"), ";")
+	// 11:05 until 11:55, 12:00 is the current status
+	if len(statuses) != 11 {
+		t.Fatalf("Expected 11 statuses, got %v\n", statuses)
+	}
+	// average of the minutes 30 to 34 for power, last value for energy
+	if statuses[0] != "20220410,11:05,34000,3200,,,20.0,230.0" {
+		t.Fatalf("Wrong first status: %v\n", statuses[0])
+	}
+	if !strings.HasPrefix(statuses[10], "20220410,11:55,") {
+		t.Fatalf("Wrong last status: %v\n", statuses[10])
+	}
+
+	if n := len(s.find("/service/r2/addstatus.jsp")); n != 1 {
+		t.Fatalf("Expected current status, got %v\n", n)
+	}
+
+	// everything has been uploaded
+	u.Upload(now.Add(5 * time.Minute))
+	if n := len(s.find("/service/r2/addbatchstatus.jsp")); n != 1 {
+		t.Fatalf("Expected no new batch, got %v\n", n)
+	}
+}
+
+func TestBackfillFailure(t *testing.T) {
+	s := &server{lastStatus: "20220410,11:00,1000,500,NaN,NaN,20.0,230.0", failBatches: 1}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	store, err := history.Open(t.TempDir(), history.DefaultPolicy)
+	if err != nil {
+		t.Fatalf("Couldn't open store: %v\n", err)
+	}
+	inverter := protocol.NewInverter(1)
+	start := time.Date(2022, 4, 10, 11, 0, 0, 0, time.Local)
+	for i := 0; i < 60; i++ {
+		store.Append(inverter.Name, dataPoint(start.Add(time.Duration(i)*time.Minute), 1, float32(i)/10, 230))
+	}
+
+	u, err := pvoutput.New(pvoutput.Options{BaseURL: ts.URL, APIKey: "key", SystemID: "42"}, []protocol.Inverter{inverter}, store)
+	if err != nil {
+		t.Fatalf("Couldn't create uploader: %v\n", err)
+	}
+	now := time.Date(2022, 4, 10, 12, 0, 0, 0, time.Local)
+	u.Init(now)
+	u.Data(inverter, dataPoint(now.Add(-time.Minute), 1, 6, 230))
+	if err := u.Upload(now); err == nil {
+		t.Fatalf("Expected the backfill to fail\n")
+	}
+	if n := len(s.find("/service/r2/addstatus.jsp")); n != 1 {
+		t.Fatalf("Expected the current status despite the failed backfill, got %v\n", n)
+	}
+
+	// the backfill is tried again
+	if err := u.Upload(now.Add(5 * time.Minute)); err != nil {
+		t.Fatalf("Couldn't upload: %v\n", err)
+	}
+	if n := len(s.find("/service/r2/addbatchstatus.jsp")); n != 1 {
+		t.Fatalf("Expected the backfill, got %v\n", s.requests)
+	}
+}
+
+func TestEndOfDay(t *testing.T) {
+	s := &server{}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	inverter := protocol.NewInverter(1)
+	u, err := pvoutput.New(pvoutput.Options{BaseURL: ts.URL, APIKey: "key", SystemID: "42", Interval: 10 * time.Minute}, []protocol.Inverter{inverter}, nil)
+	if err != nil {
+		t.Fatalf("Couldn't create uploader: %v\n", err)
+	}
+	evening := time.Date(2022, 4, 10, 23, 45, 0, 0, time.Local)
+	u.Init(evening)
+	u.Data(inverter, dataPoint(evening, 0, 12.5, 230))
+	u.Data(inverter, dataPoint(evening.Add(time.Minute), 0, 12.25, 230))
+
+	u.Upload(evening.Add(5 * time.Minute))
+	if n := len(s.find("/service/r2/addoutput.jsp")); n != 0 {
+		t.Fatalf("Expected no output before midnight, got %v\n", n)
+	}
+	u.Upload(evening.Add(15 * time.Minute))
+	outputs := s.find("/service/r2/addoutput.jsp")
+	if len(outputs) != 1 {
+		t.Fatalf("Expected 1 output, got %v\n", s.requests)
+	}
+	if outputs[0].params.Get("d") != "20220410" || outputs[0].params.Get("g") != "12500" {
+		t.Fatalf("Wrong output: %v\n", outputs[0].params)
+	}
+}
+
+func TestEndOfDayRetry(t *testing.T) {
+	s := &server{failOutputs: 2}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	inverter := protocol.NewInverter(1)
+	u, err := pvoutput.New(pvoutput.Options{BaseURL: ts.URL, APIKey: "key", SystemID: "42", Interval: 10 * time.Minute}, []protocol.Inverter{inverter}, nil)
+	if err != nil {
+		t.Fatalf("Couldn't create uploader: %v\n", err)
+	}
+	evening := time.Date(2022, 4, 10, 23, 45, 0, 0, time.Local)
+	u.Init(evening)
+	u.Data(inverter, dataPoint(evening, 0, 12.5, 230))
+
+	if err := u.Upload(evening.Add(15 * time.Minute)); err == nil {
+		t.Fatalf("Expected the output to fail\n")
+	}
+	if err := u.Upload(evening.Add(25 * time.Minute)); err == nil {
+		t.Fatalf("Expected the output to fail again\n")
+	}
+	if err := u.Upload(evening.Add(35 * time.Minute)); err != nil {
+		t.Fatalf("Couldn't upload: %v\n", err)
+	}
+	outputs := s.find("/service/r2/addoutput.jsp")
+	if len(outputs) != 1 || outputs[0].params.Get("d") != "20220410" || outputs[0].params.Get("g") != "12500" {
+		t.Fatalf("Expected the output of the previous day, got %v\n", outputs)
+	}
+
+	// uploaded outputs aren't uploaded again
+	u.Upload(evening.Add(45 * time.Minute))
+	if n := len(s.find("/service/r2/addoutput.jsp")); n != 1 {
+		t.Fatalf("Expected 1 output, got %v\n", n)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, options := range []pvoutput.Options{
+		{},
+		{APIKey: "key"},
+		{APIKey: "key", SystemID: "42", Interval: time.Minute},
+	} {
+		if _, err := pvoutput.New(options, nil, nil); err == nil {
+			t.Fatalf("Expected error for %+v\n", options)
+		}
+	}
+}
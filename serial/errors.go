@@ -0,0 +1,44 @@
+package serial
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/adangel/nt5000-serial/protocol"
+)
+
+// ErrNotConnected is returned when using a client or transport that has
+// already been closed.
+var ErrNotConnected = errors.New("not connected")
+
+// ErrTimeout is returned when the device didn't answer at all or didn't
+// send a complete frame in time.
+var ErrTimeout = errors.New("timeout while waiting for response")
+
+// ChecksumError is returned when a received frame has a wrong checksum.
+type ChecksumError = protocol.ChecksumError
+
+// PortNotFoundError is returned by Open and Connect if the serial port
+// doesn't exist, e.g. because the USB adapter has been unplugged.
+type PortNotFoundError struct {
+	Port string
+	Err  error
+}
+
+func (e *PortNotFoundError) Error() string {
+	return fmt.Sprintf("serial port %s not found: %v", e.Port, e.Err)
+}
+
+func (e *PortNotFoundError) Unwrap() error {
+	return e.Err
+}
+
+// ShortWriteError is returned if not all bytes of a frame could be sent.
+type ShortWriteError struct {
+	Sent  int
+	Total int
+}
+
+func (e *ShortWriteError) Error() string {
+	return fmt.Sprintf("couldn't send all bytes, only %v of %v bytes sent", e.Sent, e.Total)
+}
@@ -2,22 +2,27 @@ package serial
 
 import (
 	"fmt"
-	"log"
 
 	"github.com/spf13/cobra"
 	"go.bug.st/serial"
 )
 
-func ListSerialPorts(cmd *cobra.Command, args []string) {
+func ListSerialPorts(cmd *cobra.Command, args []string) error {
 	ports, err := serial.GetPortsList()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	if len(ports) == 0 {
-		log.Fatal("No serial ports found!")
+		return fmt.Errorf("No serial ports found!")
 	}
 	fmt.Printf("Found %v ports:\n", len(ports))
 	for _, port := range ports {
 		fmt.Printf("- %v\n", port)
 	}
+	return nil
+}
+
+// FindPort is not supported on macOS, as there are no USB details available.
+func FindPort(vid string, pid string, serialNumber string) (string, error) {
+	return "", fmt.Errorf("Finding serial ports by USB id is not supported on macOS")
 }
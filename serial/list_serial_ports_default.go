@@ -4,19 +4,20 @@ package serial
 
 import (
 	"fmt"
-	"log"
+	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"go.bug.st/serial/enumerator"
 )
 
-func ListSerialPorts(cmd *cobra.Command, args []string) {
+func ListSerialPorts(cmd *cobra.Command, args []string) error {
 	ports, err := enumerator.GetDetailedPortsList()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	if len(ports) == 0 {
-		log.Fatal("No serial ports found!")
+		return fmt.Errorf("No serial ports found!")
 	}
 	fmt.Printf("Found %v ports:\n", len(ports))
 	for _, port := range ports {
@@ -29,4 +30,29 @@ func ListSerialPorts(cmd *cobra.Command, args []string) {
 			}
 		}
 	}
+	return nil
+}
+
+// FindPort returns the name of the serial port that belongs to the USB device
+// with the given vendor id, product id and serial number, as shown by
+// ListSerialPorts. Empty values match any device.
+func FindPort(vid string, pid string, serialNumber string) (string, error) {
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return "", err
+	}
+	for _, port := range ports {
+		if !port.IsUSB {
+			continue
+		}
+		if (vid == "" || strings.EqualFold(port.VID, vid)) &&
+			(pid == "" || strings.EqualFold(port.PID, pid)) &&
+			(serialNumber == "" || port.SerialNumber == serialNumber) {
+			return port.Name, nil
+		}
+	}
+	return "", &PortNotFoundError{
+		Port: fmt.Sprintf("USB %s:%s %s", vid, pid, serialNumber),
+		Err:  os.ErrNotExist,
+	}
 }
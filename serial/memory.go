@@ -0,0 +1,83 @@
+package serial
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Handler computes the response for a request frame. A nil response means
+// the device doesn't answer.
+type Handler func(request []byte) []byte
+
+// MemoryTransport is a Transport that doesn't do any I/O. Every written frame
+// is passed to a Handler and its response is queued for the next read.
+// Responses are returned as they are, regardless of the requested size.
+// It's used for the emulation mode and in tests.
+type MemoryTransport struct {
+	mu      sync.Mutex
+	handler Handler
+	pending [][]byte
+	closed  bool
+	// Timeout drops responses, that took the handler longer than this, like
+	// a serial port would time out. 0 waits for every response.
+	Timeout time.Duration
+}
+
+func NewMemoryTransport(handler Handler) *MemoryTransport {
+	return &MemoryTransport{handler: handler}
+}
+
+// WriteFrame passes the frame to the handler. The handler is called without
+// holding the lock, so that a slow handler doesn't block Close.
+func (t *MemoryTransport) WriteFrame(frame []byte) error {
+	t.mu.Lock()
+	closed := t.closed
+	t.mu.Unlock()
+	if closed {
+		return ErrNotConnected
+	}
+
+	request := make([]byte, len(frame))
+	copy(request, frame)
+	start := time.Now()
+	response := t.handler(request)
+	if t.Timeout > 0 && time.Since(start) > t.Timeout {
+		log.Printf("Response took longer than %v, dropped\n", t.Timeout)
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrNotConnected
+	}
+	if response != nil {
+		t.pending = append(t.pending, response)
+	}
+	return nil
+}
+
+func (t *MemoryTransport) ReadFrame(size int) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, ErrNotConnected
+	}
+	if len(t.pending) == 0 {
+		return nil, ErrTimeout
+	}
+	response := t.pending[0]
+	t.pending = t.pending[1:]
+	return response, nil
+}
+
+func (t *MemoryTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	t.pending = nil
+	return nil
+}
@@ -0,0 +1,109 @@
+//go:build linux
+
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// PTY is a pseudo-terminal pair. The device side is served through the
+// Transport, other programs open Path like a serial port.
+type PTY struct {
+	Transport
+	// Path is the path of the slave, e.g. /dev/pts/3.
+	Path string
+}
+
+// OpenPTY creates a pseudo-terminal pair in raw mode.
+func OpenPTY() (*PTY, error) {
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open pseudo-terminal: %w", err)
+	}
+	master := os.NewFile(uintptr(fd), "/dev/ptmx")
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("couldn't unlock pseudo-terminal: %w", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("couldn't get pseudo-terminal number: %w", err)
+	}
+	path := fmt.Sprintf("/dev/pts/%d", n)
+
+	// The slave is kept open, so that reading the master doesn't fail while
+	// no program has opened it.
+	slave, err := os.OpenFile(path, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("couldn't open pseudo-terminal %s: %w", path, err)
+	}
+	if err := makeRaw(int(slave.Fd())); err != nil {
+		slave.Close()
+		master.Close()
+		return nil, fmt.Errorf("couldn't configure pseudo-terminal %s: %w", path, err)
+	}
+
+	stream := &ptyStream{master: master, slave: slave}
+	return &PTY{Transport: NewStreamTransport(stream, DefaultTimeout), Path: path}, nil
+}
+
+// makeRaw disables all processing of the terminal like cfmakeraw does.
+func makeRaw(fd int) error {
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB
+	t.Cflag |= unix.CS8
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+	return unix.IoctlSetTermios(fd, unix.TCSETS, t)
+}
+
+// ptyStream is the master of a pseudo-terminal.
+type ptyStream struct {
+	master *os.File
+	slave  *os.File
+	closed int32
+}
+
+func (s *ptyStream) Read(p []byte) (int, error) {
+	n, err := s.master.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, nil
+	}
+	return n, s.closedError(err)
+}
+
+func (s *ptyStream) Write(p []byte) (int, error) {
+	return s.master.Write(p)
+}
+
+func (s *ptyStream) SetReadTimeout(t time.Duration) error {
+	return s.closedError(s.master.SetReadDeadline(time.Now().Add(t)))
+}
+
+// closedError maps the errors after Close to ErrNotConnected.
+func (s *ptyStream) closedError(err error) error {
+	if err != nil && atomic.LoadInt32(&s.closed) == 1 {
+		return fmt.Errorf("%w: %v", ErrNotConnected, err)
+	}
+	return err
+}
+
+func (s *ptyStream) Close() error {
+	atomic.StoreInt32(&s.closed, 1)
+	s.slave.Close()
+	return s.master.Close()
+}
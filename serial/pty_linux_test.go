@@ -0,0 +1,40 @@
+package serial_test
+
+import (
+	"testing"
+
+	"github.com/adangel/nt5000-serial/emulator"
+	"github.com/adangel/nt5000-serial/serial"
+)
+
+func TestPTY(t *testing.T) {
+	pty, err := serial.OpenPTY()
+	if err != nil {
+		t.Fatalf("Couldn't open pseudo-terminal: %v\n", err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- emulator.Serve(pty)
+	}()
+
+	// the port can be opened again, after it has been closed
+	for i := 0; i < 2; i++ {
+		client, err := serial.Connect(pty.Path)
+		if err != nil {
+			t.Fatalf("Couldn't connect to %s: %v\n", pty.Path, err)
+		}
+		number, err := client.ReadSerialNumber()
+		if err != nil || number != "1533A5012345" {
+			t.Fatalf("Wrong serial number %q: %v\n", number, err)
+		}
+		if _, err := client.GetDataPoint(); err != nil {
+			t.Fatalf("Couldn't read data: %v\n", err)
+		}
+		client.Close()
+	}
+
+	pty.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("Serve failed: %v\n", err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package serial
+
+import "errors"
+
+// PTY is a pseudo-terminal pair. The device side is served through the
+// Transport, other programs open Path like a serial port.
+type PTY struct {
+	Transport
+	// Path is the path of the slave, e.g. /dev/pts/3.
+	Path string
+}
+
+// OpenPTY is only supported on Linux.
+func OpenPTY() (*PTY, error) {
+	return nil, errors.New("pseudo-terminals are only supported on Linux")
+}
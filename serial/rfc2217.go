@@ -0,0 +1,274 @@
+package serial
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// NegotiationTimeout is the time to wait for the server to accept the
+// settings of the serial port.
+var NegotiationTimeout = 5 * time.Second
+
+// Telnet commands and options used by RFC 2217.
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWill = 251
+	telnetWont = 252
+	telnetDo   = 253
+	telnetDont = 254
+	telnetIAC  = 255
+
+	optionBinary  = 0
+	optionComPort = 44
+)
+
+// COM-PORT-OPTION commands of the client. The server answers with the same
+// command plus 100.
+const (
+	comPortSetBaudRate = 1
+	comPortSetDataSize = 2
+	comPortSetParity   = 3
+	comPortSetStopSize = 4
+	comPortServer      = 100
+
+	comPortParityNone = 1
+	comPortStopSize1  = 1
+)
+
+// The states of the telnet decoder.
+const (
+	telnetData = iota
+	telnetCommand
+	telnetOption
+	telnetSub
+	telnetSubCommand
+)
+
+// telnetStream removes the telnet commands from the data received and
+// escapes the data sent. Only binary mode and the COM-PORT-OPTION are
+// supported, all other options are refused.
+type telnetStream struct {
+	Stream
+	server bool
+
+	// mu protects writes, as answers are sent while reading.
+	mu       sync.Mutex
+	state    int
+	command  byte
+	sub      []byte
+	accepted map[[2]byte]bool
+	buffer   []byte
+
+	// comPort is the answer of the server to WILL COM-PORT-OPTION, 0 until
+	// it has answered.
+	comPort byte
+	// acknowledged are the settings, that the server has acknowledged.
+	acknowledged map[byte]bool
+}
+
+// newTelnetClient configures the serial port of the server like Open does:
+// 9600 baud, 8 data bits, no parity, one stop bit. It waits until the server
+// has acknowledged all settings and fails, if it refuses the COM-PORT-OPTION.
+func newTelnetClient(stream Stream) (*telnetStream, error) {
+	t := &telnetStream{Stream: stream, accepted: make(map[[2]byte]bool), acknowledged: make(map[byte]bool)}
+	request := []byte{
+		telnetIAC, telnetWill, optionBinary,
+		telnetIAC, telnetDo, optionBinary,
+		telnetIAC, telnetWill, optionComPort,
+	}
+	baudRate := 9600
+	request = append(request, comPortCommand(comPortSetBaudRate, byte(baudRate>>24), byte(baudRate>>16), byte(baudRate>>8), byte(baudRate))...)
+	request = append(request, comPortCommand(comPortSetDataSize, 8)...)
+	request = append(request, comPortCommand(comPortSetParity, comPortParityNone)...)
+	request = append(request, comPortCommand(comPortSetStopSize, comPortStopSize1)...)
+	if err := t.writeRaw(request); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(NegotiationTimeout)
+	buffer := make([]byte, 64)
+	for !t.negotiated() {
+		if t.comPort == telnetDont {
+			return nil, fmt.Errorf("server refused COM-PORT-OPTION")
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("server didn't acknowledge the serial port settings within %v", NegotiationTimeout)
+		}
+		if err := t.SetReadTimeout(time.Until(deadline)); err != nil {
+			return nil, err
+		}
+		// the inverter only answers requests, so there is no data yet
+		if _, err := t.Read(buffer); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// negotiated returns true, once the server has accepted the COM-PORT-OPTION
+// and acknowledged all settings.
+func (t *telnetStream) negotiated() bool {
+	return t.comPort == telnetDo && t.acknowledged[comPortSetBaudRate] && t.acknowledged[comPortSetDataSize] &&
+		t.acknowledged[comPortSetParity] && t.acknowledged[comPortSetStopSize]
+}
+
+// newTelnetServer acknowledges all settings of the client.
+func newTelnetServer(stream Stream) *telnetStream {
+	return &telnetStream{Stream: stream, server: true, accepted: make(map[[2]byte]bool)}
+}
+
+// comPortCommand returns a subnegotiation of the COM-PORT-OPTION.
+func comPortCommand(command byte, value ...byte) []byte {
+	result := []byte{telnetIAC, telnetSB, optionComPort, command}
+	result = append(result, escape(value)...)
+	return append(result, telnetIAC, telnetSE)
+}
+
+// escape doubles all IAC bytes.
+func escape(data []byte) []byte {
+	result := make([]byte, 0, len(data))
+	for _, b := range data {
+		if b == telnetIAC {
+			result = append(result, telnetIAC)
+		}
+		result = append(result, b)
+	}
+	return result
+}
+
+func (t *telnetStream) Write(p []byte) (int, error) {
+	if err := t.writeRaw(escape(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *telnetStream) writeRaw(p []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n, err := t.Stream.Write(p)
+	if err != nil {
+		return err
+	}
+	if n != len(p) {
+		return &ShortWriteError{Sent: n, Total: len(p)}
+	}
+	return nil
+}
+
+// Read returns only the data. It returns 0 bytes, if only telnet commands
+// have been received.
+func (t *telnetStream) Read(p []byte) (int, error) {
+	if len(t.buffer) < len(p) {
+		t.buffer = make([]byte, len(p))
+	}
+	n, err := t.Stream.Read(t.buffer[:len(p)])
+	if err != nil {
+		return 0, err
+	}
+
+	result := 0
+	for _, b := range t.buffer[:n] {
+		switch t.state {
+		case telnetData:
+			if b == telnetIAC {
+				t.state = telnetCommand
+			} else {
+				p[result] = b
+				result++
+			}
+		case telnetCommand:
+			switch b {
+			case telnetIAC:
+				p[result] = b
+				result++
+				t.state = telnetData
+			case telnetWill, telnetWont, telnetDo, telnetDont:
+				t.command = b
+				t.state = telnetOption
+			case telnetSB:
+				t.sub = t.sub[:0]
+				t.state = telnetSub
+			default:
+				t.state = telnetData
+			}
+		case telnetOption:
+			if err := t.negotiate(t.command, b); err != nil {
+				return 0, err
+			}
+			t.state = telnetData
+		case telnetSub:
+			if b == telnetIAC {
+				t.state = telnetSubCommand
+			} else {
+				t.sub = append(t.sub, b)
+			}
+		case telnetSubCommand:
+			switch b {
+			case telnetSE:
+				if err := t.subnegotiate(t.sub); err != nil {
+					return 0, err
+				}
+				t.state = telnetData
+			case telnetIAC:
+				t.sub = append(t.sub, b)
+				t.state = telnetSub
+			default:
+				t.state = telnetSub
+			}
+		}
+	}
+	return result, nil
+}
+
+// negotiate answers the options requested by the other side. The client
+// has requested the supported options itself and only refuses the others.
+func (t *telnetStream) negotiate(command byte, option byte) error {
+	if !t.server && option == optionComPort {
+		t.comPort = command
+	}
+	if command != telnetWill && command != telnetDo {
+		return nil
+	}
+	// the client sends WILL COM-PORT-OPTION, the server DO
+	supported := option == optionBinary || (option == optionComPort && t.server == (command == telnetWill))
+	key := [2]byte{command, option}
+	var answer byte
+	switch {
+	case !supported && command == telnetWill:
+		answer = telnetDont
+	case !supported:
+		answer = telnetWont
+	case !t.server || t.accepted[key]:
+		return nil
+	case command == telnetWill:
+		answer = telnetDo
+	default:
+		answer = telnetWill
+	}
+	t.accepted[key] = true
+	return t.writeRaw([]byte{telnetIAC, answer, option})
+}
+
+// subnegotiate acknowledges the settings of the serial port on the server.
+func (t *telnetStream) subnegotiate(sub []byte) error {
+	if len(sub) < 2 || sub[0] != optionComPort {
+		return nil
+	}
+	if !t.server {
+		if sub[1] == comPortServer+comPortSetBaudRate && len(sub) == 6 {
+			log.Printf("Serial port server uses %v baud\n", int(sub[2])<<24|int(sub[3])<<16|int(sub[4])<<8|int(sub[5]))
+		}
+		if sub[1] > comPortServer {
+			t.acknowledged[sub[1]-comPortServer] = true
+		}
+		return nil
+	}
+	if sub[1] >= comPortServer {
+		return nil
+	}
+	return t.writeRaw(comPortCommand(sub[1]+comPortServer, sub[2:]...))
+}
@@ -2,251 +2,249 @@ package serial
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	"github.com/adangel/nt5000-serial/emulator"
 	"github.com/adangel/nt5000-serial/protocol"
 	"go.bug.st/serial"
 )
 
-var port serial.Port = nil
-
 func List() []string {
 	ports, _ := serial.GetPortsList()
 	return ports
 }
 
-func Connect(serialport string) {
-	mode := &serial.Mode{
-		BaudRate: 9600,
-		Parity:   serial.NoParity,
-		DataBits: 8,
-		StopBits: serial.OneStopBit,
-	}
+// Client talks to a single inverter over a Transport. Several clients with
+// different addresses can share one transport, if the inverters are
+// connected to the same RS485 bus.
+type Client struct {
+	transport Transport
+	address   byte
+}
+
+// NewClient returns a client for the inverter with the default address.
+func NewClient(transport Transport) *Client {
+	return NewClientWithAddress(transport, protocol.DefaultAddress)
+}
 
-	var err error
-	port, err = serial.Open(serialport, mode)
+func NewClientWithAddress(transport Transport, address byte) *Client {
+	return &Client{transport: transport, address: address}
+}
+
+func (c *Client) Address() byte {
+	return c.address
+}
+
+// Connect opens the given serial port and returns a client using it.
+func Connect(serialport string) (*Client, error) {
+	transport, err := Open(serialport)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	return NewClient(transport), nil
 }
 
-func Disconnect() {
-	if port != nil {
-		err := port.Close()
-		if err != nil {
-			log.Fatal(err)
-		}
+// Close closes the transport, which affects all clients sharing it. Closing
+// an already closed client does nothing.
+func (c *Client) Close() error {
+	if c.transport == nil {
+		return nil
 	}
-	port = nil
+	err := c.transport.Close()
+	c.transport = nil
+	return err
 }
 
-func isConnected() {
-	if port == nil {
-		log.Fatal("Not connected")
+func (c *Client) isConnected() error {
+	if c.transport == nil {
+		return ErrNotConnected
 	}
+	return nil
 }
 
-func Send(data []byte) {
-	isConnected()
+func (c *Client) Send(data []byte) error {
+	if err := c.isConnected(); err != nil {
+		return err
+	}
 
-	n, err := port.Write(data)
+	err := c.transport.WriteFrame(data)
 	if err != nil {
-		log.Fatal(err)
-	}
-	if n != len(data) {
-		log.Fatalf("Couldn't send all bytes, only %v of %v bytes sent\n", n, len(data))
+		return err
 	}
 
-	log.Printf("Sent %v bytes: %x\n", n, data)
+	log.Printf("Sent %v bytes: %x\n", len(data), data)
+	return nil
 }
 
-func Receive() ([]byte, error) {
-	isConnected()
+func (c *Client) Receive() ([]byte, error) {
+	if err := c.isConnected(); err != nil {
+		return nil, err
+	}
 
-	port.SetReadTimeout(time.Millisecond * 250)
+	result, err := c.transport.ReadFrame(protocol.ResponseLength)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Received %v bytes: 0x%x\n", len(result), result)
+	return result, nil
+}
 
-	result := make([]byte, 0, 26)
+// newRequest returns a request for the inverter of this client.
+func (c *Client) newRequest(command protocol.Command, parameter byte) protocol.Request {
+	return protocol.Request{Address: c.address, Command: command, Parameter: parameter}
+}
 
-	for {
-		readbuff := make([]byte, 13)
-		n, err := port.Read(readbuff)
-		if err != nil {
-			log.Fatal(err)
-			break
-		}
-		if n == 0 {
-			log.Printf("Timeout after %v bytes\n", len(result))
-			break
-		}
-		result = append(result, readbuff[:n]...)
-		log.Printf("Received %v bytes (0x%x)\n", n, readbuff[:n])
+// request sends the request and returns the response after verifying
+// the checksum.
+func (c *Client) request(r protocol.Request) ([]byte, error) {
+	err := c.Send(r.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	buff, err := c.Receive()
+	if err != nil {
+		return nil, err
+	}
+	if len(buff) != protocol.ResponseLength {
+		return nil, fmt.Errorf("%w: expected %d bytes, but got %d", ErrTimeout, protocol.ResponseLength, len(buff))
 	}
 
-	var err error = nil
-	if len(result) == 0 {
-		err = fmt.Errorf("Didn't receive any data\n")
-	} else {
-		log.Printf("Received %v bytes: 0x%x\n", len(result), result)
+	err = protocol.VerifyChecksum(buff)
+	if err != nil {
+		return nil, err
 	}
-	return result, err
+	return buff, nil
 }
 
 // see https://golangcode.com/handle-ctrl-c-exit-in-terminal/
-func SetupCloseHandler() {
-	c := make(chan os.Signal)
+func SetupCloseHandler(closers ...io.Closer) {
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		log.Printf("Ctlr+C pressed, exiting...")
-		Disconnect()
+		for _, closer := range closers {
+			if err := closer.Close(); err != nil {
+				log.Print(err)
+			}
+		}
 		os.Exit(0)
 	}()
 }
 
-func GetDataPoint(emulate bool) protocol.DataPoint {
-	var err error
-	buff := make([]byte, 13)
-
-	if emulate {
-		buff = protocol.ConvertToByte(emulator.ProduceDataPoint())
-	} else {
-		Send([]byte("\x00\x01\x02\x01\x04"))
-		buff, err = Receive()
-		if err != nil {
-			log.Print(err)
-		}
-	}
-
-	err = protocol.VerifyChecksum(buff)
+func (c *Client) GetDataPoint() (protocol.DataPoint, error) {
+	buff, err := c.request(c.newRequest(protocol.ReadData, 0x01))
 	if err != nil {
-		log.Print(err)
+		return protocol.DataPoint{}, err
 	}
 
-	d, err := protocol.Convert(buff)
-	if err != nil {
-		log.Printf("Invalid data received: %v\n", err)
-	}
-	return d
+	return protocol.Convert(buff)
 }
 
-func ReadSerialNumber(emulate bool) string {
-	var err error
-	buff := make([]byte, 13)
-
-	if emulate {
-		buff = []byte("1533A5012345\x71")
-	} else {
-		Send([]byte("\x00\x01\x08\x01\x0A"))
-		buff, err = Receive()
-		if err != nil {
-			log.Print(err)
-		}
-	}
-
-	err = protocol.VerifyChecksum(buff)
+func (c *Client) ReadSerialNumber() (string, error) {
+	buff, err := c.request(c.newRequest(protocol.ReadSerialNumber, 0x01))
 	if err != nil {
-		log.Print(err)
+		return "", err
 	}
 
-	var serialnumber string = ""
-	for i := 0; i < 12; i++ {
-		if buff[i] != 0x0d {
-			serialnumber += string(buff[i])
-		}
-	}
-	return serialnumber
+	return protocol.ConvertSerialNumber(buff)
 }
 
-func ReadProtocolAndFirmware(emulate bool) (string, string) {
-	var err error
-	buff := make([]byte, 13)
-
-	if emulate {
-		buff = []byte("111-23\x00\x00\x00\x00\x00\x00\x25")
-	} else {
-		Send([]byte("\x00\x01\x09\x01\x0B"))
-		buff, err = Receive()
-		if err != nil {
-			log.Print(err)
-		}
+func (c *Client) ReadProtocolAndFirmware() (string, string, error) {
+	buff, err := c.request(c.newRequest(protocol.ReadProtocolAndFirmware, 0x01))
+	if err != nil {
+		return "", "", err
 	}
 
-	err = protocol.VerifyChecksum(buff)
+	return protocol.ConvertProtocolAndFirmware(buff)
+}
+
+// ReadTime reads the current time of the inverter's clock.
+func (c *Client) ReadTime() (time.Time, error) {
+	buff, err := c.request(c.newRequest(protocol.ReadTime, 0x01))
 	if err != nil {
-		log.Print(err)
+		return time.Time{}, err
 	}
 
-	var protocol string = string(buff[0:2])
-	var firmware string = ""
+	return protocol.ConvertTime(buff)
+}
 
-	for i := 2; i < 11; i++ {
-		if buff[i] != 0x0d {
-			firmware += string(buff[i])
+// SetTime sets the clock of the inverter. The inverter doesn't answer.
+func (c *Client) SetTime(t time.Time) error {
+	for _, r := range protocol.SetTimeRequests(t) {
+		err := c.Send(r.Bytes())
+		if err != nil {
+			return err
 		}
 	}
-
-	return protocol, firmware
+	return nil
 }
 
-func ReadErrors(emulate bool) []protocol.Error {
+// ReadErrors reads all 5 slots of the error memory.
+func (c *Client) ReadErrors() ([]protocol.Error, error) {
 	var result []protocol.Error = make([]protocol.Error, 0, 10)
 
-	for i := 1; i <= 5; i++ {
-		result = append(result, readSingleError(emulate, uint8(i))...)
+	for slot := 1; slot <= 5; slot++ {
+		buff, err := c.request(c.newRequest(protocol.ReadErrors, byte(slot)))
+		if err != nil {
+			return result, err
+		}
+
+		errors, err := protocol.ConvertErrors(buff)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, errors...)
 	}
-	return result
+	return result, nil
 }
 
-func readSingleError(emulate bool, slot uint8) []protocol.Error {
-	var err error
-	buff := make([]byte, 13)
-	if emulate {
-		for i := 0; i < 12; i++ {
-			buff[i] = 0x0d
-		}
-		if slot == 1 {
-			now := time.Now().Local()
-			buff[0] = byte(now.Month())
-			buff[1] = byte(now.Day())
-			buff[2] = 20   // hour
-			buff[3] = 3    // minute
-			buff[4] = 0x11 // error code
-			buff[5] = byte(now.Year() - 2000)
+// ReadMonthlyEnergy reads the energy of the last 12 months, starting with the
+// current month. Months without data are left out. It's experimental, see
+// protocol.ConvertMonthlyEnergy.
+func (c *Client) ReadMonthlyEnergy() ([]protocol.MonthlyEnergy, error) {
+	result := make([]protocol.MonthlyEnergy, 0, 12)
+
+	for slot := 1; slot <= 12; slot++ {
+		buff, err := c.request(c.newRequest(protocol.ReadMonthlyEnergy, byte(slot)))
+		if err != nil {
+			return result, err
 		}
-		protocol.CalculateChecksum(buff)
-	} else {
-		req := []byte("\x00\x01\x01")
-		req = append(req, byte(slot), 0x00)
-		protocol.CalculateChecksum(req)
-		Send(req)
-		buff, err = Receive()
+
+		m, err := protocol.ConvertMonthlyEnergy(buff)
 		if err != nil {
-			log.Print(err)
+			return result, err
+		}
+		if !m.Date.IsZero() {
+			result = append(result, m)
 		}
 	}
+	return result, nil
+}
 
-	err = protocol.VerifyChecksum(buff)
-	if err != nil {
-		log.Print(err)
-	}
+// ReadYearlyEnergy reads the energy of the last 10 years, starting with the
+// current year. Years without data are left out. It's experimental, see
+// protocol.ConvertYearlyEnergy.
+func (c *Client) ReadYearlyEnergy() ([]protocol.YearlyEnergy, error) {
+	result := make([]protocol.YearlyEnergy, 0, 10)
 
-	var result []protocol.Error
-	if buff[0] != 0x0d {
-		result = append(result, protocol.Error{
-			Date: time.Date(int(buff[5])+2000, time.Month(buff[0]), int(buff[1]), int(buff[2]), int(buff[3]), 0, 0, time.Local),
-			Code: buff[4],
-		})
-	}
-	if buff[6] != 0x0d {
-		result = append(result, protocol.Error{
-			Date: time.Date(int(buff[11])+2000, time.Month(buff[6]), int(buff[7]), int(buff[8]), int(buff[9]), 0, 0, time.Local),
-			Code: buff[10],
-		})
+	for slot := 1; slot <= 10; slot++ {
+		buff, err := c.request(c.newRequest(protocol.ReadYearlyEnergy, byte(slot)))
+		if err != nil {
+			return result, err
+		}
+
+		y, err := protocol.ConvertYearlyEnergy(buff)
+		if err != nil {
+			return result, err
+		}
+		if !y.Date.IsZero() {
+			result = append(result, y)
+		}
 	}
-	return result
+	return result, nil
 }
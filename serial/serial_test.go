@@ -0,0 +1,251 @@
+package serial_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/emulator"
+	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/serial"
+)
+
+func TestGetDataPoint(t *testing.T) {
+	var request []byte
+	client := serial.NewClient(serial.NewMemoryTransport(func(r []byte) []byte {
+		request = r
+		return []byte("\x8e\x11\x82\x06\x46\x05\x06\x07\x08\x09\x0a\x0b\xa5")
+	}))
+	defer client.Close()
+
+	point, err := client.GetDataPoint()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if !bytes.Equal(request, []byte("\x00\x01\x02\x01\x04")) {
+		t.Fatalf("Wrong request: %x\n", request)
+	}
+	if point.DC.Voltage != 497.6 {
+		t.Fatalf("Wrong DC.Voltage: %v\n", point.DC.Voltage)
+	}
+	if point.EnergyTotal != 2057 {
+		t.Fatalf("Wrong EnergyTotal: %v\n", point.EnergyTotal)
+	}
+}
+
+func TestReadSerialNumber(t *testing.T) {
+	client := serial.NewClient(serial.NewMemoryTransport(func(r []byte) []byte {
+		response := []byte("1533A50123\x0d\x0d\x00")
+		protocol.CalculateChecksum(response)
+		return response
+	}))
+	defer client.Close()
+
+	serialnumber, err := client.ReadSerialNumber()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if serialnumber != "1533A50123" {
+		t.Fatalf("Wrong serial number: %q\n", serialnumber)
+	}
+}
+
+func TestReadProtocolAndFirmware(t *testing.T) {
+	client := serial.NewClient(serial.NewMemoryTransport(func(r []byte) []byte {
+		response := []byte("111-23\x0d\x0d\x0d\x0d\x0d\x0d\x00")
+		protocol.CalculateChecksum(response)
+		return response
+	}))
+	defer client.Close()
+
+	proto, firmware, err := client.ReadProtocolAndFirmware()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if proto != "11" || firmware != "1-23" {
+		t.Fatalf("Wrong protocol/firmware: %q %q\n", proto, firmware)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	client := serial.NewClient(serial.NewMemoryTransport(emulator.Respond))
+	defer client.Close()
+
+	entries, err := client.ReadErrors()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 error, got %v\n", len(entries))
+	}
+	if entries[0].Code != 0x11 {
+		t.Fatalf("Wrong error code: 0x%02x\n", entries[0].Code)
+	}
+}
+
+func TestMemoryTransportClosed(t *testing.T) {
+	transport := serial.NewMemoryTransport(emulator.Respond)
+	transport.Close()
+
+	if err := transport.WriteFrame([]byte("\x00\x01\x02\x01\x04")); !errors.Is(err, serial.ErrNotConnected) {
+		t.Fatalf("Expected ErrNotConnected when writing to closed transport, got %v\n", err)
+	}
+	if _, err := transport.ReadFrame(13); !errors.Is(err, serial.ErrNotConnected) {
+		t.Fatalf("Expected ErrNotConnected when reading from closed transport, got %v\n", err)
+	}
+}
+
+func TestMemoryTransportCloseWhileHandling(t *testing.T) {
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	transport := serial.NewMemoryTransport(func(request []byte) []byte {
+		close(handling)
+		<-release
+		return emulator.Respond(request)
+	})
+	written := make(chan error)
+	go func() {
+		written <- transport.WriteFrame(protocol.NewRequest(protocol.ReadData, 0).Bytes())
+	}()
+	<-handling
+
+	closed := make(chan struct{})
+	go func() {
+		transport.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close blocked by a slow handler\n")
+	}
+	close(release)
+	if err := <-written; !errors.Is(err, serial.ErrNotConnected) {
+		t.Fatalf("Expected ErrNotConnected for a response after closing, got %v\n", err)
+	}
+}
+
+func TestClientClosed(t *testing.T) {
+	client := serial.NewClient(serial.NewMemoryTransport(emulator.Respond))
+	client.Close()
+
+	_, err := client.GetDataPoint()
+	if !errors.Is(err, serial.ErrNotConnected) {
+		t.Fatalf("Expected ErrNotConnected, got %v\n", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("Closing twice should not fail: %v\n", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	client := serial.NewClient(serial.NewMemoryTransport(func(r []byte) []byte {
+		return nil
+	}))
+	defer client.Close()
+
+	_, err := client.GetDataPoint()
+	if !errors.Is(err, serial.ErrTimeout) {
+		t.Fatalf("Expected ErrTimeout, got %v\n", err)
+	}
+}
+
+func TestIncompleteResponse(t *testing.T) {
+	client := serial.NewClient(serial.NewMemoryTransport(func(r []byte) []byte {
+		return []byte("\x8e\x11\x82")
+	}))
+	defer client.Close()
+
+	_, err := client.GetDataPoint()
+	if !errors.Is(err, serial.ErrTimeout) {
+		t.Fatalf("Expected ErrTimeout, got %v\n", err)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	client := serial.NewClient(serial.NewMemoryTransport(func(r []byte) []byte {
+		return []byte("\x8e\x11\x82\x06\x46\x05\x06\x07\x08\x09\x0a\x0b\x00")
+	}))
+	defer client.Close()
+
+	_, err := client.GetDataPoint()
+	var checksumErr *serial.ChecksumError
+	if !errors.As(err, &checksumErr) {
+		t.Fatalf("Expected ChecksumError, got %v\n", err)
+	}
+	if checksumErr.Expected != 0xa5 || checksumErr.Actual != 0x00 {
+		t.Fatalf("Wrong checksums in error: %v\n", checksumErr)
+	}
+}
+
+func TestPortNotFound(t *testing.T) {
+	_, err := serial.Connect("/dev/does-not-exist")
+	var notFound *serial.PortNotFoundError
+	if !errors.As(err, &notFound) {
+		t.Fatalf("Expected PortNotFoundError, got %v\n", err)
+	}
+}
+
+func TestReadMonthlyEnergy(t *testing.T) {
+	client := serial.NewClient(serial.NewMemoryTransport(emulator.Respond))
+	defer client.Close()
+
+	months, err := client.ReadMonthlyEnergy()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if len(months) != 12 {
+		t.Fatalf("Expected 12 months, got %v\n", len(months))
+	}
+	if !months[1].Date.Before(months[0].Date) {
+		t.Fatalf("Expected months in descending order: %v %v\n", months[0].Date, months[1].Date)
+	}
+}
+
+func TestReadYearlyEnergy(t *testing.T) {
+	client := serial.NewClient(serial.NewMemoryTransport(emulator.Respond))
+	defer client.Close()
+
+	years, err := client.ReadYearlyEnergy()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if len(years) != 10 {
+		t.Fatalf("Expected 10 years, got %v\n", len(years))
+	}
+	if years[0].Date.Year() != years[1].Date.Year()+1 {
+		t.Fatalf("Expected years in descending order: %v %v\n", years[0].Date, years[1].Date)
+	}
+}
+
+func TestReadAndSetTime(t *testing.T) {
+	// the emulated clock is set below
+	emulator.SetDevice(emulator.NewDevice())
+	t.Cleanup(func() { emulator.SetDevice(emulator.NewDevice()) })
+	var requests [][]byte
+	client := serial.NewClient(serial.NewMemoryTransport(func(r []byte) []byte {
+		requests = append(requests, r)
+		return emulator.Respond(r)
+	}))
+	defer client.Close()
+
+	now, err := client.ReadTime()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if time.Since(now) > 2*time.Minute {
+		t.Fatalf("Wrong time: %v\n", now)
+	}
+
+	err = client.SetTime(time.Date(2022, time.April, 10, 14, 0, 0, 0, time.Local))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if len(requests) != 6 {
+		t.Fatalf("Expected 6 requests, got %v\n", len(requests))
+	}
+	if !bytes.Equal(requests[4], []byte("\x00\xff\x35\x0f\x43")) {
+		t.Fatalf("Wrong request to set the hour: %x\n", requests[4])
+	}
+}
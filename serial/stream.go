@@ -0,0 +1,112 @@
+package serial
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// DefaultTimeout is the time to wait for a complete frame.
+const DefaultTimeout = time.Second
+
+// Stream is a byte oriented connection like a serial port. Read returns
+// 0 bytes without an error, if nothing has been received within the read
+// timeout.
+type Stream interface {
+	io.ReadWriteCloser
+	SetReadTimeout(t time.Duration) error
+}
+
+// streamTransport cuts the bytes received from a Stream into frames.
+type streamTransport struct {
+	stream  Stream
+	timeout time.Duration
+	pending []byte
+}
+
+// NewStreamTransport returns a Transport, that waits at most timeout for
+// a complete frame on the given stream.
+func NewStreamTransport(stream Stream, timeout time.Duration) Transport {
+	return &streamTransport{stream: stream, timeout: timeout}
+}
+
+func (t *streamTransport) WriteFrame(frame []byte) error {
+	n, err := t.stream.Write(frame)
+	if err != nil {
+		return portError(err)
+	}
+	if n != len(frame) {
+		return &ShortWriteError{Sent: n, Total: len(frame)}
+	}
+	return nil
+}
+
+// ReadFrame returns as soon as a frame with the given size and a valid
+// checksum has been received. Bytes before that frame are dropped. Bytes
+// after the frame are kept for the next call.
+func (t *streamTransport) ReadFrame(size int) ([]byte, error) {
+	deadline := time.Now().Add(t.timeout)
+	readbuff := make([]byte, 64)
+
+	for {
+		start, found := findFrame(t.pending, size)
+		if start > 0 {
+			log.Printf("Skipped %v bytes: 0x%x\n", start, t.pending[:start])
+			t.pending = t.pending[start:]
+		}
+		if found {
+			frame := make([]byte, size)
+			copy(frame, t.pending)
+			t.pending = t.pending[size:]
+			if len(t.pending) > 0 {
+				log.Printf("Received %v bytes after the frame: 0x%x\n", len(t.pending), t.pending)
+			}
+			return frame, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			received := len(t.pending)
+			t.pending = nil
+			if received == 0 {
+				return nil, ErrTimeout
+			}
+			return nil, fmt.Errorf("%w: received only %v of %v bytes", ErrTimeout, received, size)
+		}
+
+		err := t.stream.SetReadTimeout(remaining)
+		if err != nil {
+			return nil, portError(err)
+		}
+		n, err := t.stream.Read(readbuff)
+		if err != nil {
+			return nil, portError(err)
+		}
+		t.pending = append(t.pending, readbuff[:n]...)
+	}
+}
+
+// Close closes the stream. It may be called while ReadFrame is waiting,
+// which then fails with ErrNotConnected.
+func (t *streamTransport) Close() error {
+	return t.stream.Close()
+}
+
+// findFrame searches data for a frame with the given size, whose last byte
+// is the checksum of the other bytes. It returns the start of the frame, if
+// one has been found. Otherwise it returns the number of bytes at the start,
+// that can't be part of a frame.
+func findFrame(data []byte, size int) (int, bool) {
+	start := 0
+	for ; start+size <= len(data); start++ {
+		var checksum byte
+		for _, b := range data[start : start+size-1] {
+			checksum += b
+		}
+		if checksum == data[start+size-1] {
+			return start, true
+		}
+	}
+	return start, false
+}
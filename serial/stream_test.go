@@ -0,0 +1,114 @@
+package serial_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/serial"
+)
+
+// fakeStream returns one chunk per read and times out when all chunks
+// have been read.
+type fakeStream struct {
+	chunks  [][]byte
+	timeout time.Duration
+	written []byte
+}
+
+func (s *fakeStream) Read(p []byte) (int, error) {
+	if len(s.chunks) == 0 {
+		time.Sleep(s.timeout)
+		return 0, nil
+	}
+	n := copy(p, s.chunks[0])
+	s.chunks[0] = s.chunks[0][n:]
+	if len(s.chunks[0]) == 0 {
+		s.chunks = s.chunks[1:]
+	}
+	return n, nil
+}
+
+func (s *fakeStream) Write(p []byte) (int, error) {
+	s.written = append(s.written, p...)
+	return len(p), nil
+}
+
+func (s *fakeStream) SetReadTimeout(t time.Duration) error {
+	s.timeout = t
+	return nil
+}
+
+func (s *fakeStream) Close() error {
+	return nil
+}
+
+const dataFrame = "\x8e\x11\x82\x06\x46\x05\x06\x07\x08\x09\x0a\x0b\xa5"
+
+func TestReadFrameInChunks(t *testing.T) {
+	stream := &fakeStream{chunks: [][]byte{[]byte(dataFrame[:4]), []byte(dataFrame[4:10]), []byte(dataFrame[10:])}}
+	transport := serial.NewStreamTransport(stream, time.Second)
+
+	start := time.Now()
+	frame, err := transport.ReadFrame(13)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if !bytes.Equal(frame, []byte(dataFrame)) {
+		t.Fatalf("Wrong frame: %x\n", frame)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatalf("Reading a complete frame should not wait for a timeout\n")
+	}
+}
+
+func TestReadFrameSkipsGarbage(t *testing.T) {
+	stream := &fakeStream{chunks: [][]byte{[]byte("\x01\x02\x03" + dataFrame)}}
+	transport := serial.NewStreamTransport(stream, time.Second)
+
+	frame, err := transport.ReadFrame(13)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if !bytes.Equal(frame, []byte(dataFrame)) {
+		t.Fatalf("Wrong frame: %x\n", frame)
+	}
+}
+
+func TestReadFrameKeepsLeftover(t *testing.T) {
+	stream := &fakeStream{chunks: [][]byte{[]byte("\x00\xff\x32\x16\x47\x00\xff\x33\x0a")}, timeout: time.Millisecond}
+	transport := serial.NewStreamTransport(stream, 50*time.Millisecond)
+
+	frame, err := transport.ReadFrame(5)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if !bytes.Equal(frame, []byte("\x00\xff\x32\x16\x47")) {
+		t.Fatalf("Wrong frame: %x\n", frame)
+	}
+
+	stream.chunks = [][]byte{[]byte("\x3c")}
+	frame, err = transport.ReadFrame(5)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if !bytes.Equal(frame, []byte("\x00\xff\x33\x0a\x3c")) {
+		t.Fatalf("Wrong frame: %x\n", frame)
+	}
+}
+
+func TestReadFrameTimeout(t *testing.T) {
+	stream := &fakeStream{chunks: [][]byte{[]byte(dataFrame[:5])}}
+	transport := serial.NewStreamTransport(stream, 20*time.Millisecond)
+
+	_, err := transport.ReadFrame(13)
+	if !errors.Is(err, serial.ErrTimeout) {
+		t.Fatalf("Expected ErrTimeout, got %v\n", err)
+	}
+
+	_, err = transport.ReadFrame(13)
+	if !errors.Is(err, serial.ErrTimeout) {
+		t.Fatalf("Expected ErrTimeout, got %v\n", err)
+	}
+}
@@ -0,0 +1,127 @@
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// DialTimeout is the time to wait for a TCP connection.
+const DialTimeout = 5 * time.Second
+
+// isNetwork returns true, if the port is a URL like tcp://host:port or
+// rfc2217://host:port instead of a serial port.
+func isNetwork(port string) bool {
+	return strings.HasPrefix(port, "tcp://") || strings.HasPrefix(port, "rfc2217://")
+}
+
+// parseNetwork returns the host and port of a tcp:// or rfc2217:// URL and
+// whether RFC 2217 is used.
+func parseNetwork(address string) (string, bool, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", false, err
+	}
+	if u.Scheme != "tcp" && u.Scheme != "rfc2217" {
+		return "", false, fmt.Errorf("unsupported scheme %s, use tcp or rfc2217", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return "", false, fmt.Errorf("invalid address %s: %w", address, err)
+	}
+	return u.Host, u.Scheme == "rfc2217", nil
+}
+
+// openNetwork connects to a serial port server like ser2net. With
+// rfc2217://, the serial port is configured like Open does.
+func openNetwork(address string) (Transport, error) {
+	host, rfc2217, err := parseNetwork(address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", host, DialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to %s: %w", address, err)
+	}
+	var stream Stream = netStream{conn}
+	if rfc2217 {
+		t, err := newTelnetClient(stream)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("couldn't configure %s: %w", address, err)
+		}
+		stream = t
+	}
+	return NewStreamTransport(stream, DefaultTimeout), nil
+}
+
+// Listener accepts connections on tcp:// or rfc2217:// addresses, e.g. to
+// emulate a serial port server.
+type Listener struct {
+	listener net.Listener
+	rfc2217  bool
+}
+
+// Listen listens on the given address, e.g. tcp://:2000.
+func Listen(address string) (*Listener, error) {
+	host, rfc2217, err := parseNetwork(address)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{listener: l, rfc2217: rfc2217}, nil
+}
+
+// Accept waits for the next connection.
+func (l *Listener) Accept() (Transport, error) {
+	conn, err := l.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	var stream Stream = netStream{conn}
+	if l.rfc2217 {
+		stream = newTelnetServer(stream)
+	}
+	return NewStreamTransport(stream, DefaultTimeout), nil
+}
+
+// Addr returns the address, the listener is listening on.
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Close stops listening.
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
+
+// netStream is a TCP connection used like a serial port.
+type netStream struct {
+	net.Conn
+}
+
+func (s netStream) Read(p []byte) (int, error) {
+	n, err := s.Conn.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, nil
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return n, fmt.Errorf("%w: %v", ErrNotConnected, err)
+	}
+	return n, err
+}
+
+func (s netStream) SetReadTimeout(t time.Duration) error {
+	err := s.SetReadDeadline(time.Now().Add(t))
+	if errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("%w: %v", ErrNotConnected, err)
+	}
+	return err
+}
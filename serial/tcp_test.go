@@ -0,0 +1,137 @@
+package serial_test
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/emulator"
+	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/serial"
+)
+
+func listen(t *testing.T, scheme string) (*serial.Listener, string) {
+	l, err := serial.Listen(scheme + "://127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %v\n", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l, scheme + "://" + l.Addr().String()
+}
+
+func TestNetwork(t *testing.T) {
+	for _, scheme := range []string{"tcp", "rfc2217"} {
+		l, address := listen(t, scheme)
+		go func() {
+			transport, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer transport.Close()
+			emulator.Serve(transport)
+		}()
+
+		client, err := serial.Connect(address)
+		if err != nil {
+			t.Fatalf("Couldn't connect to %s: %v\n", address, err)
+		}
+		number, err := client.ReadSerialNumber()
+		if err != nil || number != "1533A5012345" {
+			t.Fatalf("Wrong serial number %q via %s: %v\n", number, scheme, err)
+		}
+		if _, err := client.GetDataPoint(); err != nil {
+			t.Fatalf("Couldn't read data via %s: %v\n", scheme, err)
+		}
+		client.Close()
+	}
+}
+
+func TestRFC2217Escaping(t *testing.T) {
+	l, address := listen(t, "rfc2217")
+	// a response full of IAC bytes
+	response := bytes.Repeat([]byte{0xff}, protocol.ResponseLength)
+	protocol.CalculateChecksum(response)
+	go func() {
+		transport, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer transport.Close()
+		if _, err := transport.ReadFrame(protocol.RequestLength); err == nil {
+			transport.WriteFrame(response)
+		}
+	}()
+
+	transport, err := serial.Open(address)
+	if err != nil {
+		t.Fatalf("Couldn't connect to %s: %v\n", address, err)
+	}
+	defer transport.Close()
+	if err := transport.WriteFrame(protocol.NewRequest(protocol.ReadData, 0xff).Bytes()); err != nil {
+		t.Fatalf("Couldn't send request: %v\n", err)
+	}
+	received, err := transport.ReadFrame(protocol.ResponseLength)
+	if err != nil || !bytes.Equal(received, response) {
+		t.Fatalf("Wrong response 0x%x: %v\n", received, err)
+	}
+}
+
+// rawServer accepts one connection and answers the first bytes received
+// with the given answer.
+func rawServer(t *testing.T, answer []byte) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %v\n", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buffer := make([]byte, 64)
+		if _, err := conn.Read(buffer); err != nil {
+			return
+		}
+		if answer != nil {
+			conn.Write(answer)
+		}
+		conn.Read(buffer)
+	}()
+	return "rfc2217://" + l.Addr().String()
+}
+
+func TestRFC2217Refused(t *testing.T) {
+	// IAC DONT COM-PORT-OPTION
+	address := rawServer(t, []byte{255, 254, 44})
+	_, err := serial.Open(address)
+	if err == nil || !strings.Contains(err.Error(), "refused COM-PORT-OPTION") {
+		t.Fatalf("Expected COM-PORT-OPTION to be refused, got %v\n", err)
+	}
+}
+
+func TestRFC2217NoAnswer(t *testing.T) {
+	timeout := serial.NegotiationTimeout
+	serial.NegotiationTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { serial.NegotiationTimeout = timeout })
+
+	address := rawServer(t, nil)
+	start := time.Now()
+	if _, err := serial.Open(address); err == nil {
+		t.Fatalf("Expected error without negotiation\n")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("Waited too long: %v\n", time.Since(start))
+	}
+}
+
+func TestInvalidNetworkAddress(t *testing.T) {
+	for _, address := range []string{"tcp://localhost", "udp://localhost:2000"} {
+		if _, err := serial.Listen(address); err == nil {
+			t.Fatalf("Expected error for %s\n", address)
+		}
+	}
+}
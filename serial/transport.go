@@ -0,0 +1,56 @@
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"go.bug.st/serial"
+)
+
+// Transport moves frames between this program and a device. Requests and
+// responses are complete frames including the checksum byte.
+type Transport interface {
+	// WriteFrame sends one frame.
+	WriteFrame(frame []byte) error
+	// ReadFrame returns the next frame with the given size, that has been
+	// received.
+	ReadFrame(size int) ([]byte, error)
+	// Close releases the underlying resources.
+	Close() error
+}
+
+// Open opens the given serial port with the settings used by the NT5000:
+// 9600 baud, 8 data bits, no parity, one stop bit. A serial port server is
+// used with tcp://host:port (raw) or rfc2217://host:port.
+func Open(serialport string) (Transport, error) {
+	if isNetwork(serialport) {
+		return openNetwork(serialport)
+	}
+
+	mode := &serial.Mode{
+		BaudRate: 9600,
+		Parity:   serial.NoParity,
+		DataBits: 8,
+		StopBits: serial.OneStopBit,
+	}
+
+	port, err := serial.Open(serialport, mode)
+	if err != nil {
+		var portErr *serial.PortError
+		if errors.Is(err, os.ErrNotExist) || (errors.As(err, &portErr) && portErr.Code() == serial.PortNotFound) {
+			return nil, &PortNotFoundError{Port: serialport, Err: err}
+		}
+		return nil, fmt.Errorf("couldn't open serial port %s: %w", serialport, err)
+	}
+	return NewStreamTransport(port, DefaultTimeout), nil
+}
+
+// portError maps the errors of closed ports to ErrNotConnected.
+func portError(err error) error {
+	var portErr *serial.PortError
+	if errors.As(err, &portErr) && portErr.Code() == serial.PortClosed {
+		return fmt.Errorf("%w: %v", ErrNotConnected, err)
+	}
+	return err
+}
@@ -0,0 +1,249 @@
+package sink
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/adangel/nt5000-serial/poller"
+	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/serial"
+)
+
+// Sink receives every data point read from the inverters.
+type Sink interface {
+	Data(inverter protocol.Inverter, data protocol.DataPoint)
+}
+
+// FailureSink is a sink, that also wants to know when an inverter didn't
+// answer.
+type FailureSink interface {
+	Failure(inverter protocol.Inverter, err error)
+}
+
+// InfoSink is a sink, that also wants the basic information about the
+// inverters.
+type InfoSink interface {
+	Info(inverter protocol.Inverter, info Info)
+}
+
+// StatusSink is a sink, that also wants the status of the connection.
+type StatusSink interface {
+	Status(status poller.Status)
+}
+
+// Info is the basic information about an inverter, that is read whenever
+// the connection has been opened. Values, that couldn't be read, are empty.
+// The error memory is also read again regularly while connected.
+type Info struct {
+	SerialNumber string
+	Protocol     string
+	Firmware     string
+	// Errors is the error memory, nil if it couldn't be read.
+	Errors []protocol.Error
+}
+
+// ReadInfo reads the basic information about the inverter.
+func ReadInfo(inverter protocol.Inverter, client *serial.Client) Info {
+	var info Info
+	var err error
+	info.SerialNumber, err = client.ReadSerialNumber()
+	if err != nil {
+		log.Printf("Couldn't read serial number of %s: %v\n", inverter.Name, err)
+	}
+	info.Protocol, info.Firmware, err = client.ReadProtocolAndFirmware()
+	if err != nil {
+		log.Printf("Couldn't read protocol and firmware of %s: %v\n", inverter.Name, err)
+	}
+	info.Errors, err = client.ReadErrors()
+	if err != nil {
+		log.Printf("Couldn't read error memory of %s: %v\n", inverter.Name, err)
+		info.Errors = nil
+	} else if info.Errors == nil {
+		info.Errors = []protocol.Error{}
+	}
+	return info
+}
+
+// QueueSize is the number of events, that are queued for each sink.
+const QueueSize = 100
+
+// CloseTimeout is how long Close waits for the sinks to handle the queued
+// events.
+var CloseTimeout = 5 * time.Second
+
+// Fanout passes all events to the sinks. Every sink has its own queue and
+// goroutine, so that a slow sink neither stalls the polling nor the other
+// sinks. If the queue of a sink is full, its events are dropped.
+type Fanout struct {
+	mu      sync.Mutex
+	workers []*worker
+	closed  bool
+	// infos is the latest basic information about each inverter.
+	infos map[protocol.Inverter]Info
+}
+
+// worker handles the events of one sink in order.
+type worker struct {
+	sink     Sink
+	queue    chan func()
+	done     chan struct{}
+	dropping bool
+}
+
+// New returns a fanout to the given sinks.
+func New(sinks ...Sink) *Fanout {
+	f := &Fanout{infos: make(map[protocol.Inverter]Info)}
+	for _, s := range sinks {
+		f.Add(s)
+	}
+	return f
+}
+
+// Add adds a sink.
+func (f *Fanout) Add(s Sink) {
+	w := &worker{sink: s, queue: make(chan func(), QueueSize), done: make(chan struct{})}
+	go w.run()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.workers = append(f.workers, w)
+}
+
+// Attach sets the callbacks of the poller, so that all its events are
+// passed to the sinks. The basic information is read whenever the
+// connection has been opened, the error memory also regularly.
+func (f *Fanout) Attach(p *poller.Poller) {
+	p.OnConnect = func(inverter protocol.Inverter, client *serial.Client) {
+		f.Info(inverter, ReadInfo(inverter, client))
+	}
+	p.OnData = f.Data
+	p.OnError = f.Failure
+	p.OnErrors = f.Errors
+	p.OnStatus = f.Status
+}
+
+// Data passes the data point to all sinks.
+func (f *Fanout) Data(inverter protocol.Inverter, data protocol.DataPoint) {
+	f.send(func(s Sink) {
+		s.Data(inverter, data)
+	})
+}
+
+// Failure passes the failure to all sinks, that implement FailureSink.
+func (f *Fanout) Failure(inverter protocol.Inverter, err error) {
+	f.send(func(s Sink) {
+		if fs, ok := s.(FailureSink); ok {
+			fs.Failure(inverter, err)
+		}
+	})
+}
+
+// Info passes the basic information to all sinks, that implement InfoSink.
+func (f *Fanout) Info(inverter protocol.Inverter, info Info) {
+	f.mu.Lock()
+	f.infos[inverter] = info
+	f.mu.Unlock()
+	f.send(func(s Sink) {
+		if is, ok := s.(InfoSink); ok {
+			is.Info(inverter, info)
+		}
+	})
+}
+
+// Errors passes the error memory, that has been read again, together with
+// the latest basic information to all sinks, that implement InfoSink.
+func (f *Fanout) Errors(inverter protocol.Inverter, errors []protocol.Error) {
+	f.mu.Lock()
+	info := f.infos[inverter]
+	f.mu.Unlock()
+	info.Errors = errors
+	f.Info(inverter, info)
+}
+
+// Status passes the status to all sinks, that implement StatusSink.
+func (f *Fanout) Status(status poller.Status) {
+	f.send(func(s Sink) {
+		if ss, ok := s.(StatusSink); ok {
+			ss.Status(status)
+		}
+	})
+}
+
+// Close waits until the queued events have been handled and closes all
+// sinks, that implement io.Closer. A sink, that doesn't finish in time, is
+// left alone, because it's still handling an event.
+func (f *Fanout) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	workers := f.workers
+	f.mu.Unlock()
+
+	deadline := time.Now().Add(CloseTimeout)
+	for _, w := range workers {
+		close(w.queue)
+	}
+	var errs []string
+	for _, w := range workers {
+		select {
+		case <-w.done:
+		case <-time.After(time.Until(deadline)):
+			log.Printf("Sink %s didn't finish in time\n", name(w.sink))
+			continue
+		}
+		if c, ok := w.sink.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Couldn't close sinks: %v\n", errs)
+	}
+	return nil
+}
+
+func (f *Fanout) send(event func(Sink)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	for _, w := range f.workers {
+		w.send(event)
+	}
+}
+
+// send queues the event. It must only be called while holding the lock of
+// the fanout.
+func (w *worker) send(event func(Sink)) {
+	select {
+	case w.queue <- func() { event(w.sink) }:
+		if w.dropping {
+			log.Printf("Sink %s caught up\n", name(w.sink))
+			w.dropping = false
+		}
+	default:
+		if !w.dropping {
+			log.Printf("Sink %s is too slow, dropping events\n", name(w.sink))
+			w.dropping = true
+		}
+	}
+}
+
+func (w *worker) run() {
+	defer close(w.done)
+	for event := range w.queue {
+		event()
+	}
+}
+
+func name(s Sink) string {
+	return fmt.Sprintf("%T", s)
+}
@@ -0,0 +1,251 @@
+package sink_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/emulator"
+	"github.com/adangel/nt5000-serial/poller"
+	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/serial"
+	"github.com/adangel/nt5000-serial/sink"
+)
+
+// recorder is a sink, that records all events.
+type recorder struct {
+	mu     sync.Mutex
+	events []string
+	info   sink.Info
+	closed bool
+	block  chan struct{}
+}
+
+func (r *recorder) record(event string) {
+	if r.block != nil {
+		<-r.block
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *recorder) Data(inverter protocol.Inverter, data protocol.DataPoint) {
+	r.record("data " + inverter.Name)
+}
+
+func (r *recorder) Failure(inverter protocol.Inverter, err error) {
+	r.record("failure " + inverter.Name)
+}
+
+func (r *recorder) Info(inverter protocol.Inverter, info sink.Info) {
+	r.mu.Lock()
+	r.info = info
+	r.mu.Unlock()
+	r.record("info " + inverter.Name)
+}
+
+func (r *recorder) Status(status poller.Status) {
+	r.record("status " + status.State.String())
+}
+
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+func (r *recorder) recorded() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+// dataOnly is a sink, that only implements Sink.
+type dataOnly struct {
+	mu    sync.Mutex
+	count int
+}
+
+func (d *dataOnly) Data(inverter protocol.Inverter, data protocol.DataPoint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.count++
+}
+
+func TestFanout(t *testing.T) {
+	r := &recorder{}
+	d := &dataOnly{}
+	f := sink.New(r, d)
+
+	inverter := protocol.NewInverter(1)
+	f.Data(inverter, protocol.DataPoint{})
+	f.Failure(inverter, errors.New("timeout"))
+	f.Info(inverter, sink.Info{SerialNumber: "1533A5012345"})
+	f.Status(poller.Status{State: poller.Connected})
+	f.Data(inverter, protocol.DataPoint{})
+	f.Close()
+
+	expected := []string{"data inverter-1", "failure inverter-1", "info inverter-1", "status connected", "data inverter-1"}
+	events := r.recorded()
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %v, got %v\n", expected, events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v\n", expected, events)
+		}
+	}
+	if !r.closed {
+		t.Fatalf("Sink not closed\n")
+	}
+	if d.count != 2 {
+		t.Fatalf("Expected 2 data points, got %v\n", d.count)
+	}
+
+	// events after closing are ignored
+	f.Data(inverter, protocol.DataPoint{})
+}
+
+func TestSlowSink(t *testing.T) {
+	slow := &recorder{block: make(chan struct{})}
+	fast := &recorder{}
+	f := sink.New(slow, fast)
+
+	inverter := protocol.NewInverter(1)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 3*sink.QueueSize; i++ {
+			f.Data(inverter, protocol.DataPoint{})
+			// the fast sink keeps up
+			for len(fast.recorded()) <= i {
+				time.Sleep(time.Microsecond)
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Slow sink stalled the fanout\n")
+	}
+
+	close(slow.block)
+	f.Close()
+	if n := len(fast.recorded()); n != 3*sink.QueueSize {
+		t.Fatalf("Expected all events for the fast sink, got %v\n", n)
+	}
+	// one event might be in progress, when the queue is full
+	if n := len(slow.recorded()); n > sink.QueueSize+1 {
+		t.Fatalf("Expected dropped events for the slow sink, got %v\n", n)
+	}
+}
+
+func TestCloseHungSinks(t *testing.T) {
+	timeout := sink.CloseTimeout
+	sink.CloseTimeout = 50 * time.Millisecond
+	defer func() { sink.CloseTimeout = timeout }()
+
+	first := &recorder{block: make(chan struct{})}
+	second := &recorder{block: make(chan struct{})}
+	defer close(second.block)
+	defer close(first.block)
+	f := sink.New(first, second)
+	f.Data(protocol.NewInverter(1), protocol.DataPoint{})
+
+	start := time.Now()
+	f.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Close waited %v for hung sinks\n", elapsed)
+	}
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	if first.closed {
+		t.Fatalf("Hung sink closed while handling an event\n")
+	}
+}
+
+func TestAttach(t *testing.T) {
+	r := &recorder{}
+	f := sink.New(r)
+	p := poller.New(func() (serial.Transport, error) {
+		return serial.NewMemoryTransport(emulator.Respond), nil
+	}, nil, time.Millisecond)
+	f.Attach(p)
+	p.Start()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events := r.recorded()
+		if len(events) > 2 && contains(events, "info inverter-1") && contains(events, "data inverter-1") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Missing events: %v\n", events)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p.Close()
+	f.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.info.SerialNumber == "" || r.info.Errors == nil {
+		t.Fatalf("Info not read: %+v\n", r.info)
+	}
+}
+
+func TestErrorsRefresh(t *testing.T) {
+	device := emulator.NewDevice()
+	emulator.SetDevice(device)
+	t.Cleanup(func() { emulator.SetDevice(emulator.NewDevice()) })
+
+	r := &recorder{}
+	f := sink.New(r)
+	p := poller.New(func() (serial.Transport, error) {
+		return serial.NewMemoryTransport(emulator.Respond), nil
+	}, nil, time.Millisecond)
+	p.ErrorInterval = time.Millisecond
+	f.Attach(p)
+	p.Start()
+	defer f.Close()
+	defer p.Close()
+
+	// the fault happens after the error memory has been read on connect
+	deadline := time.Now().Add(5 * time.Second)
+	for !contains(r.recorded(), "info inverter-1") {
+		if time.Now().After(deadline) {
+			t.Fatalf("No info received\n")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	fault := protocol.Error{Date: time.Now().Truncate(time.Minute), Code: 0x17}
+	device.AddError(fault)
+
+	for {
+		r.mu.Lock()
+		info := r.info
+		r.mu.Unlock()
+		if len(info.Errors) > 0 && info.Errors[0].Code == fault.Code {
+			if info.SerialNumber == "" {
+				t.Fatalf("Serial number lost with the error memory: %+v\n", info)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("New error not passed to the sink: %+v\n", info)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func contains(events []string, event string) bool {
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,245 @@
+package sunspec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/adangel/nt5000-serial/poller"
+	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/sink"
+)
+
+// Modbus function codes and exception codes.
+const (
+	readHoldingRegisters = 0x03
+	readInputRegisters   = 0x04
+
+	illegalFunction    = 0x01
+	illegalDataAddress = 0x02
+	illegalDataValue   = 0x03
+	targetFailed       = 0x0b
+)
+
+// maxQuantity is the maximum number of registers per read request.
+const maxQuantity = 125
+
+// Server serves the latest data of the inverters as SunSpec models via
+// Modbus TCP. The unit id selects the inverter by its address, the unit ids
+// 0 and 255 select the first inverter. All registers are read-only. While
+// the poller isn't connected or the data is older than MaxAge, the inverters
+// are reported as faulty.
+type Server struct {
+	model uint16
+	// Now returns the current time, it can be replaced in tests.
+	Now func() time.Time
+
+	mu           sync.Mutex
+	devices      []*device
+	listeners    []net.Listener
+	conns        map[net.Conn]struct{}
+	closed       bool
+	disconnected bool
+}
+
+// New returns a server for the given inverters, that serves the given
+// inverter model, either SinglePhase or ThreePhase.
+func New(inverters []protocol.Inverter, model uint16) (*Server, error) {
+	if model != SinglePhase && model != ThreePhase {
+		return nil, fmt.Errorf("Invalid SunSpec inverter model %v, use %v or %v\n", model, SinglePhase, ThreePhase)
+	}
+	s := &Server{model: model, Now: time.Now, conns: make(map[net.Conn]struct{})}
+	for _, inverter := range inverters {
+		s.devices = append(s.devices, &device{inverter: inverter})
+	}
+	return s, nil
+}
+
+// Listen returns a server, that listens on the given TCP address, e.g. ":502".
+func Listen(address string, inverters []protocol.Inverter, model uint16) (*Server, error) {
+	s, err := New(inverters, model)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Serving SunSpec via Modbus TCP on %v\n", l.Addr())
+	go func() {
+		if err := s.Serve(l); err != nil {
+			log.Printf("SunSpec server stopped: %v\n", err)
+		}
+	}()
+	return s, nil
+}
+
+// Data sets the data, that is served for the inverter.
+func (s *Server) Data(inverter protocol.Inverter, data protocol.DataPoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d := s.find(inverter.Address); d != nil {
+		d.data = data
+	}
+}
+
+// Info sets the information of the common model of the inverter.
+func (s *Server) Info(inverter protocol.Inverter, info sink.Info) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d := s.find(inverter.Address); d != nil {
+		d.serialnumber = info.SerialNumber
+		d.protocol = info.Protocol
+		d.firmware = info.Firmware
+	}
+}
+
+// Status reports the inverters as faulty, while the poller isn't connected.
+func (s *Server) Status(status poller.Status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disconnected = status.State != poller.Connected
+}
+
+// Serve accepts connections on the listener until Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	s.listeners = append(s.listeners, l)
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops all listeners and closes all connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	// MBAP header: transaction id, protocol id, length, unit id
+	header := make([]byte, 7)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		length := binary.BigEndian.Uint16(header[4:6])
+		if binary.BigEndian.Uint16(header[2:4]) != 0 || length < 2 || length > 254 {
+			log.Printf("Invalid Modbus TCP header %x from %v\n", header, conn.RemoteAddr())
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+
+		response := s.handle(header[6], pdu)
+		frame := make([]byte, 7, 7+len(response))
+		copy(frame, header)
+		binary.BigEndian.PutUint16(frame[4:6], uint16(len(response)+1))
+		if _, err := conn.Write(append(frame, response...)); err != nil {
+			return
+		}
+	}
+}
+
+// handle returns the response PDU to the request PDU.
+func (s *Server) handle(unit byte, pdu []byte) []byte {
+	function := pdu[0]
+	if function != readHoldingRegisters && function != readInputRegisters {
+		return exception(function, illegalFunction)
+	}
+	if len(pdu) != 5 {
+		return exception(function, illegalDataValue)
+	}
+	address := int(binary.BigEndian.Uint16(pdu[1:3]))
+	quantity := int(binary.BigEndian.Uint16(pdu[3:5]))
+	if quantity < 1 || quantity > maxQuantity {
+		return exception(function, illegalDataValue)
+	}
+
+	s.mu.Lock()
+	d := s.find(unit)
+	if d == nil && (unit == 0 || unit == 255) && len(s.devices) > 0 {
+		d = s.devices[0]
+	}
+	var registers []uint16
+	if d != nil {
+		fresh := !s.disconnected && s.Now().Sub(d.data.Date) <= MaxAge
+		registers = d.registers(s.model, fresh)
+	}
+	s.mu.Unlock()
+
+	if d == nil {
+		return exception(function, targetFailed)
+	}
+	if address < Base || address+quantity > Base+len(registers) {
+		return exception(function, illegalDataAddress)
+	}
+
+	response := make([]byte, 2+2*quantity)
+	response[0] = function
+	response[1] = byte(2 * quantity)
+	for i, r := range registers[address-Base : address-Base+quantity] {
+		binary.BigEndian.PutUint16(response[2+2*i:], r)
+	}
+	return response
+}
+
+func (s *Server) find(address byte) *device {
+	for _, d := range s.devices {
+		if d.inverter.Address == address {
+			return d
+		}
+	}
+	return nil
+}
+
+func exception(function byte, code byte) []byte {
+	return []byte{function | 0x80, code}
+}
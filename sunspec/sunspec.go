@@ -0,0 +1,169 @@
+package sunspec
+
+import (
+	"math"
+	"time"
+
+	"github.com/adangel/nt5000-serial/protocol"
+)
+
+// Base is the register address of the SunSpec marker "SunS". The models
+// follow directly after it.
+const Base = 40000
+
+// The inverter models, that can be served. The NT5000 feeds into one phase,
+// with ThreePhase all values are reported on phase A.
+const (
+	SinglePhase uint16 = 101
+	ThreePhase  uint16 = 103
+)
+
+// Values of registers, that aren't implemented.
+const (
+	notImplementedUint16 = 0xffff
+	notImplementedInt16  = 0x8000
+	notImplementedEnum16 = 0xffff
+	notImplementedSF     = 0x8000
+)
+
+// Operating states of the inverter model.
+const (
+	stateOff      = 1
+	stateSleeping = 2
+	stateMPPT     = 4
+	stateFault    = 7
+)
+
+// MaxAge is how old the data may be, before the inverter is reported as
+// faulty and the measurements as not implemented.
+var MaxAge = time.Minute
+
+const (
+	commonModel  = 1
+	commonLength = 66
+	// both inverter models have the same layout
+	inverterLength = 50
+	endModel       = 0xffff
+)
+
+// device is everything known about one inverter.
+type device struct {
+	inverter     protocol.Inverter
+	data         protocol.DataPoint
+	serialnumber string
+	protocol     string
+	firmware     string
+}
+
+// registers returns all registers of the device starting at Base: the
+// marker, the common model, the inverter model and the end model. If the data
+// isn't fresh, only the energy is served.
+func (d *device) registers(model uint16, fresh bool) []uint16 {
+	r := make([]uint16, 0, 2+2+commonLength+2+inverterLength+2)
+	r = append(r, 0x5375, 0x6e53) // "SunS"
+
+	// common model
+	r = append(r, commonModel, commonLength)
+	r = appendString(r, "Sunways", 16)
+	r = appendString(r, "NT5000", 16)
+	r = appendString(r, d.protocol, 8)
+	r = appendString(r, d.firmware, 8)
+	r = appendString(r, d.serialnumber, 16)
+	r = append(r, uint16(d.inverter.Address), notImplementedUint16)
+
+	// inverter model
+	data := d.data
+	current := scaleUint16(data.AC.Current, -2)
+	voltage := scaleUint16(data.AC.Voltage, -1)
+	power := scaleInt16(data.AC.Power*1000, 0)
+	dcCurrent := scaleUint16(data.DC.Current, -2)
+	dcVoltage := scaleUint16(data.DC.Voltage, -1)
+	dcPower := scaleInt16(data.DC.Power*1000, 0)
+	temperature := scaleInt16(data.Temperature, -1)
+	phaseB, phaseC := uint16(0), uint16(0)
+	if model == SinglePhase {
+		phaseB, phaseC = notImplementedUint16, notImplementedUint16
+	}
+	energy := uint32(math.Round(float64(data.EnergyTotal) * 1000))
+	state := uint16(stateSleeping)
+	switch {
+	case data.Date.IsZero():
+		state = stateOff
+	case !fresh:
+		state = stateFault
+		current, voltage, phaseB, phaseC = notImplementedUint16, notImplementedUint16, notImplementedUint16, notImplementedUint16
+		power, dcPower, temperature = notImplementedInt16, notImplementedInt16, notImplementedInt16
+		dcCurrent, dcVoltage = notImplementedUint16, notImplementedUint16
+	case data.AC.Power > 0:
+		state = stateMPPT
+	}
+
+	r = append(r, model, inverterLength)
+	r = append(r,
+		current, current, phaseB, phaseC, sf(-2), // A, AphA, AphB, AphC, A_SF
+		notImplementedUint16, notImplementedUint16, notImplementedUint16, // PPVphAB, PPVphBC, PPVphCA
+		voltage, notImplementedUint16, notImplementedUint16, sf(-1), // PhVphA, PhVphB, PhVphC, V_SF
+		power, sf(0), // W, W_SF
+		notImplementedUint16, notImplementedSF, // Hz, Hz_SF
+		notImplementedInt16, notImplementedSF, // VA, VA_SF
+		notImplementedInt16, notImplementedSF, // VAr, VAr_SF
+		notImplementedInt16, notImplementedSF, // PF, PF_SF
+		uint16(energy>>16), uint16(energy), sf(0), // WH, WH_SF
+		dcCurrent, sf(-2), // DCA, DCA_SF
+		dcVoltage, sf(-1), // DCV, DCV_SF
+		dcPower, sf(0), // DCW, DCW_SF
+		temperature, notImplementedInt16, notImplementedInt16, notImplementedInt16, sf(-1), // TmpCab, TmpSnk, TmpTrns, TmpOt, Tmp_SF
+		state, notImplementedEnum16, // St, StVnd
+		// the NT5000 doesn't report events, only its error memory
+		notImplementedUint16, notImplementedUint16, notImplementedUint16, notImplementedUint16, // Evt1, Evt2
+		notImplementedUint16, notImplementedUint16, notImplementedUint16, notImplementedUint16, // EvtVnd1, EvtVnd2
+		notImplementedUint16, notImplementedUint16, notImplementedUint16, notImplementedUint16, // EvtVnd3, EvtVnd4
+	)
+
+	return append(r, endModel, 0)
+}
+
+// appendString appends s as string of the given number of registers, padded
+// with zeros.
+func appendString(r []uint16, s string, registers int) []uint16 {
+	b := make([]byte, registers*2)
+	copy(b, s)
+	for i := 0; i < registers; i++ {
+		r = append(r, uint16(b[2*i])<<8|uint16(b[2*i+1]))
+	}
+	return r
+}
+
+// sf returns the register value of a scale factor.
+func sf(scale int16) uint16 {
+	return uint16(scale)
+}
+
+// scaleUint16 returns value / 10^scale as register value. 0xffff means "not
+// implemented", so it's never returned.
+func scaleUint16(value float32, scale int) uint16 {
+	v := math.Round(float64(value) / math.Pow10(scale))
+	if v < 0 || math.IsNaN(v) {
+		return 0
+	}
+	if v > 0xfffe {
+		return 0xfffe
+	}
+	return uint16(v)
+}
+
+// scaleInt16 returns value / 10^scale as register value. -0x8000 means "not
+// implemented", so it's never returned.
+func scaleInt16(value float32, scale int) uint16 {
+	v := math.Round(float64(value) / math.Pow10(scale))
+	if math.IsNaN(v) {
+		return 0
+	}
+	if v < -0x7fff {
+		v = -0x7fff
+	}
+	if v > 0x7fff {
+		v = 0x7fff
+	}
+	return uint16(int16(v))
+}
@@ -0,0 +1,214 @@
+package sunspec_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/poller"
+	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/sink"
+	"github.com/adangel/nt5000-serial/sunspec"
+)
+
+var data = protocol.DataPoint{
+	Date:        time.Unix(1649620983, 0),
+	DC:          protocol.Measurement{Voltage: 497.6, Current: 1.4, Power: 0.7},
+	AC:          protocol.Measurement{Voltage: 230, Current: 3.2, Power: 0.736},
+	Temperature: 21,
+	HeatFlux:    210,
+	EnergyTotal: 374,
+}
+
+func start(t *testing.T, model uint16) (*sunspec.Server, net.Conn) {
+	inverters := []protocol.Inverter{protocol.NewInverter(1), protocol.NewInverter(2)}
+	s, err := sunspec.New(inverters, model)
+	if err != nil {
+		t.Fatalf("Couldn't create server: %v\n", err)
+	}
+	s.Now = func() time.Time { return data.Date }
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %v\n", err)
+	}
+	go s.Serve(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v\n", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		s.Close()
+	})
+	s.Data(inverters[0], data)
+	s.Info(inverters[0], sink.Info{SerialNumber: "1533A5012345", Protocol: "1.2", Firmware: "3.4"})
+	return s, conn
+}
+
+// read reads holding registers and returns them, or the exception code.
+func read(t *testing.T, conn net.Conn, unit byte, address, quantity uint16) ([]uint16, byte) {
+	request := []byte{0x12, 0x34, 0, 0, 0, 6, unit, 0x03, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(request[8:], address)
+	binary.BigEndian.PutUint16(request[10:], quantity)
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("Couldn't send request: %v\n", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("Couldn't read response: %v\n", err)
+	}
+	if header[0] != 0x12 || header[1] != 0x34 || header[6] != unit {
+		t.Fatalf("Wrong response header %x\n", header)
+	}
+	pdu := make([]byte, binary.BigEndian.Uint16(header[4:6])-1)
+	if _, err := io.ReadFull(conn, pdu); err != nil {
+		t.Fatalf("Couldn't read response: %v\n", err)
+	}
+	if pdu[0] == 0x83 {
+		return nil, pdu[1]
+	}
+	registers := make([]uint16, pdu[1]/2)
+	for i := range registers {
+		registers[i] = binary.BigEndian.Uint16(pdu[2+2*i:])
+	}
+	return registers, 0
+}
+
+func str(registers []uint16) string {
+	b := make([]byte, 0, 2*len(registers))
+	for _, r := range registers {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	return strings.TrimRight(string(b), "\x00")
+}
+
+func TestCommonModel(t *testing.T) {
+	_, conn := start(t, sunspec.SinglePhase)
+
+	r, e := read(t, conn, 1, sunspec.Base, 70)
+	if e != 0 {
+		t.Fatalf("Unexpected exception %v\n", e)
+	}
+	if str(r[0:2]) != "SunS" || r[2] != 1 || r[3] != 66 {
+		t.Fatalf("Wrong header %v\n", r[0:4])
+	}
+	if str(r[4:20]) != "Sunways" || str(r[20:36]) != "NT5000" || str(r[36:44]) != "1.2" || str(r[44:52]) != "3.4" {
+		t.Fatalf("Wrong common model %q %q %q %q\n", str(r[4:20]), str(r[20:36]), str(r[36:44]), str(r[44:52]))
+	}
+	if str(r[52:68]) != "1533A5012345" || r[68] != 1 {
+		t.Fatalf("Wrong serial number or address %q %v\n", str(r[52:68]), r[68])
+	}
+}
+
+func TestInverterModel(t *testing.T) {
+	_, conn := start(t, sunspec.SinglePhase)
+
+	r, e := read(t, conn, 1, sunspec.Base+70, 54)
+	if e != 0 {
+		t.Fatalf("Unexpected exception %v\n", e)
+	}
+	if r[0] != 101 || r[1] != 50 {
+		t.Fatalf("Wrong model header %v\n", r[0:2])
+	}
+	m := r[2:52]
+	expected := map[string][2]uint16{
+		"A":      {m[0], 320},
+		"AphB":   {m[2], 0xffff},
+		"A_SF":   {m[4], 0xfffe},
+		"PhVphA": {m[8], 2300},
+		"V_SF":   {m[11], 0xffff},
+		"W":      {m[12], 736},
+		"WH":     {m[23], 374000 & 0xffff},
+		"WH.hi":  {m[22], 374000 >> 16},
+		"DCA":    {m[25], 140},
+		"DCV":    {m[27], 4976},
+		"DCW":    {m[29], 700},
+		"TmpCab": {m[31], 210},
+		"St":     {m[36], 4},
+		"Evt1":   {m[38], 0xffff},
+	}
+	for name, v := range expected {
+		if v[0] != v[1] {
+			t.Fatalf("Wrong %s: expected %v, got %v\n", name, v[1], v[0])
+		}
+	}
+	if r[52] != 0xffff || r[53] != 0 {
+		t.Fatalf("Wrong end model %v\n", r[52:54])
+	}
+}
+
+func TestThreePhase(t *testing.T) {
+	_, conn := start(t, sunspec.ThreePhase)
+
+	r, _ := read(t, conn, 1, sunspec.Base+70, 4)
+	if r[0] != 103 || r[2] != 320 || r[3] != 320 {
+		t.Fatalf("Wrong three phase model %v\n", r)
+	}
+}
+
+func TestUnits(t *testing.T) {
+	_, conn := start(t, sunspec.SinglePhase)
+
+	// the second inverter has no data yet
+	r, _ := read(t, conn, 2, sunspec.Base+70, 50)
+	if r[2] != 0 || r[38] != 1 {
+		t.Fatalf("Expected no current and state off, got %v %v\n", r[2], r[38])
+	}
+	r, _ = read(t, conn, 255, sunspec.Base+72, 1)
+	if r[0] != 320 {
+		t.Fatalf("Expected the first inverter for unit 255, got %v\n", r)
+	}
+	if _, e := read(t, conn, 3, sunspec.Base, 2); e != 0x0b {
+		t.Fatalf("Expected exception 0x0b for unknown unit, got %v\n", e)
+	}
+}
+
+func TestStaleInverter(t *testing.T) {
+	s, conn := start(t, sunspec.SinglePhase)
+	inverter := protocol.NewInverter(1)
+
+	stale := data
+	stale.Date = data.Date.Add(-2 * sunspec.MaxAge)
+	s.Data(inverter, stale)
+	r, _ := read(t, conn, 1, sunspec.Base+72, 50)
+	if r[36] != 7 || r[12] != 0x8000 || r[8] != 0xffff || r[31] != 0x8000 {
+		t.Fatalf("Expected state fault without measurements, got %v\n", r)
+	}
+	if r[23] != 374000&0xffff {
+		t.Fatalf("Expected the energy, got %v\n", r[23])
+	}
+
+	s.Data(inverter, data)
+	s.Status(poller.Status{State: poller.Reconnecting})
+	r, _ = read(t, conn, 1, sunspec.Base+72, 50)
+	if r[36] != 7 {
+		t.Fatalf("Expected state fault while reconnecting, got %v\n", r[36])
+	}
+	s.Status(poller.Status{State: poller.Connected})
+	r, _ = read(t, conn, 1, sunspec.Base+72, 50)
+	if r[36] != 4 || r[12] != 736 {
+		t.Fatalf("Expected state MPPT once connected, got %v %v\n", r[36], r[12])
+	}
+}
+
+func TestInvalidRequests(t *testing.T) {
+	_, conn := start(t, sunspec.SinglePhase)
+
+	if _, e := read(t, conn, 1, 0, 2); e != 0x02 {
+		t.Fatalf("Expected exception 0x02 below base, got %v\n", e)
+	}
+	if _, e := read(t, conn, 1, sunspec.Base+120, 10); e != 0x02 {
+		t.Fatalf("Expected exception 0x02 after end, got %v\n", e)
+	}
+	if _, e := read(t, conn, 1, sunspec.Base, 126); e != 0x03 {
+		t.Fatalf("Expected exception 0x03 for too many registers, got %v\n", e)
+	}
+	if _, err := sunspec.New(nil, 102); err == nil {
+		t.Fatalf("Expected error for model 102\n")
+	}
+}
@@ -0,0 +1,185 @@
+package web
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/adangel/nt5000-serial/history"
+	"github.com/adangel/nt5000-serial/protocol"
+)
+
+// handlerHistory serves the stored data points of an inverter.
+//
+// Parameters:
+//   - inverter: name or address, defaults to the first inverter
+//   - from, to: RFC 3339 date or day (2006-01-02), defaults to the last 24 hours.
+//     from is inclusive and to is exclusive, so a day means its start: to=2022-04-10
+//     ends before that day and from=2022-04-10&to=2022-04-11 selects the whole day.
+//   - step: interval to aggregate the data points, e.g. 15m, raw data by default
+//   - agg: avg (default), min or max
+//   - format: json (default) or csv
+func handlerHistory(w http.ResponseWriter, r *http.Request) {
+	state, ok := historyInverter(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	from, to, err := parseRange(query.Get("from"), query.Get("to"), 24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var step time.Duration
+	if query.Get("step") != "" {
+		step, err = time.ParseDuration(query.Get("step"))
+		if err != nil || step <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid step %q\n", query.Get("step")), http.StatusBadRequest)
+			return
+		}
+	}
+	aggregation := history.Average
+	if query.Get("agg") != "" {
+		aggregation, err = history.ParseAggregation(query.Get("agg"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	points, err := store.Query(state.inverter.Name, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if step > 0 {
+		points = history.Aggregate(points, step, aggregation)
+	}
+	if points == nil {
+		points = []protocol.DataPoint{}
+	}
+
+	switch query.Get("format") {
+	case "", "json":
+		writeJSON(w, points)
+	case "csv":
+		rows := [][]string{{"date", "udc", "idc", "pdc", "uac", "iac", "pac", "temp", "flux", "wd", "wtot"}}
+		for _, p := range points {
+			rows = append(rows, []string{p.Date.Format(time.RFC3339),
+				formatFloat(p.DC.Voltage), formatFloat(p.DC.Current), formatFloat(p.DC.Power),
+				formatFloat(p.AC.Voltage), formatFloat(p.AC.Current), formatFloat(p.AC.Power),
+				formatFloat(p.Temperature), formatFloat(p.HeatFlux),
+				formatFloat(p.EnergyDay), formatFloat(p.EnergyTotal)})
+		}
+		writeCSV(w, rows)
+	default:
+		http.Error(w, fmt.Sprintf("Invalid format %q, use json or csv\n", query.Get("format")), http.StatusBadRequest)
+	}
+}
+
+// dailyResponse is one day served at /api/daily.
+type dailyResponse struct {
+	Date   string
+	Energy float32
+}
+
+// handlerDaily serves the energy harvested per day. It supports the same
+// parameters as handlerHistory except for step and agg. The range defaults to
+// the last 30 days.
+func handlerDaily(w http.ResponseWriter, r *http.Request) {
+	state, ok := historyInverter(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	from, to, err := parseRange(query.Get("from"), query.Get("to"), 30*24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	daily, err := store.Daily(state.inverter.Name, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch query.Get("format") {
+	case "", "json":
+		response := make([]dailyResponse, 0, len(daily))
+		for _, d := range daily {
+			response = append(response, dailyResponse{Date: d.Date.Format("2006-01-02"), Energy: d.Energy})
+		}
+		writeJSON(w, response)
+	case "csv":
+		rows := [][]string{{"date", "energy"}}
+		for _, d := range daily {
+			rows = append(rows, []string{d.Date.Format("2006-01-02"), formatFloat(d.Energy)})
+		}
+		writeCSV(w, rows)
+	default:
+		http.Error(w, fmt.Sprintf("Invalid format %q, use json or csv\n", query.Get("format")), http.StatusBadRequest)
+	}
+}
+
+// historyInverter returns the selected inverter or writes an error, if the
+// history is disabled or the inverter is unknown.
+func historyInverter(w http.ResponseWriter, r *http.Request) (inverterState, bool) {
+	if store == nil {
+		http.Error(w, "History is disabled\n", http.StatusNotFound)
+		return inverterState{}, false
+	}
+	state, ok := selectedInverter(r)
+	if !ok {
+		http.NotFound(w, r)
+	}
+	return state, ok
+}
+
+// parseRange parses the parameters from and to, the range is from <= date < to.
+// Without to, the range ends now. Without from, the range has the given length.
+func parseRange(fromParam, toParam string, length time.Duration) (from, to time.Time, err error) {
+	to = time.Now()
+	if toParam != "" {
+		to, err = parseTime(toParam)
+		if err != nil {
+			return
+		}
+	}
+	from = to.Add(-length)
+	if fromParam != "" {
+		from, err = parseTime(fromParam)
+		if err != nil {
+			return
+		}
+	}
+	if !from.Before(to) {
+		err = fmt.Errorf("Invalid range, from %v is not before to %v\n", from, to)
+	}
+	return
+}
+
+// parseTime accepts an RFC 3339 date or a day in local time.
+func parseTime(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("Invalid date %q, use RFC 3339 or 2006-01-02\n", value)
+	}
+	return t, nil
+}
+
+func formatFloat(f float32) string {
+	return strconv.FormatFloat(float64(f), 'f', -1, 32)
+}
+
+func writeCSV(w http.ResponseWriter, rows [][]string) {
+	w.Header().Set("Content-Type", "text/csv")
+	writer := csv.NewWriter(w)
+	writer.WriteAll(rows)
+}
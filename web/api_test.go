@@ -0,0 +1,170 @@
+package web_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/emulator"
+	"github.com/adangel/nt5000-serial/history"
+	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/serial"
+	"github.com/adangel/nt5000-serial/web"
+)
+
+// startServer serves the emulated inverter with the given history.
+func startServer(t *testing.T, store *history.Store) *httptest.Server {
+	return startPolling(t, time.Hour, store)
+}
+
+// startPolling serves the emulated inverter, that is polled at the given
+// interval.
+func startPolling(t *testing.T, interval time.Duration, store *history.Store) *httptest.Server {
+	server := web.NewServer(interval, func() (serial.Transport, error) {
+		return serial.NewMemoryTransport(emulator.Respond), nil
+	}, nil, store, nil)
+	ts := httptest.NewServer(server)
+	t.Cleanup(func() {
+		ts.Close()
+		server.Close()
+	})
+	return ts
+}
+
+// get returns the status code and the body of the response.
+func get(t *testing.T, ts *httptest.Server, path string) (int, string) {
+	response, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatalf("Couldn't get %s: %v\n", path, err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("Couldn't read %s: %v\n", path, err)
+	}
+	return response.StatusCode, string(body)
+}
+
+// historyStore returns a store with one data point per hour on the 9th and
+// 10th of April 2022 for the default inverter.
+func historyStore(t *testing.T) *history.Store {
+	store, err := history.Open(t.TempDir(), history.DefaultPolicy)
+	if err != nil {
+		t.Fatalf("Couldn't open store: %v\n", err)
+	}
+	name := protocol.NewInverter(protocol.DefaultAddress).Name
+	start := time.Date(2022, 4, 9, 0, 0, 0, 0, time.Local)
+	for i := 0; i < 48; i++ {
+		data := protocol.DataPoint{
+			Date:      start.Add(time.Duration(i) * time.Hour),
+			AC:        protocol.Measurement{Power: float32(i % 24)},
+			EnergyDay: float32(i%24) / 2,
+		}
+		if err := store.Append(name, data); err != nil {
+			t.Fatalf("Couldn't append: %v\n", err)
+		}
+	}
+	return store
+}
+
+func TestHistory(t *testing.T) {
+	ts := startServer(t, historyStore(t))
+
+	status, body := get(t, ts, "/api/history?from=2022-04-10&to=2022-04-11")
+	if status != http.StatusOK {
+		t.Fatalf("Expected 200, got %v: %s\n", status, body)
+	}
+	var points []protocol.DataPoint
+	if err := json.Unmarshal([]byte(body), &points); err != nil {
+		t.Fatalf("Invalid JSON: %v\n", err)
+	}
+	if len(points) != 24 || points[0].Date.Day() != 10 || points[23].Date.Hour() != 23 {
+		t.Fatalf("Expected the 24 data points of the 10th, got %v\n", len(points))
+	}
+
+	// to is exclusive, so the day given as to isn't included
+	_, body = get(t, ts, "/api/history?from=2022-04-09&to=2022-04-10")
+	points = nil
+	json.Unmarshal([]byte(body), &points)
+	if len(points) != 24 {
+		t.Fatalf("Expected the 24 data points of the 9th, got %v\n", len(points))
+	}
+	for _, p := range points {
+		if !p.Date.Before(time.Date(2022, 4, 10, 0, 0, 0, 0, time.Local)) {
+			t.Fatalf("Data point %v after to\n", p.Date)
+		}
+	}
+
+	status, body = get(t, ts, "/api/history?from=2022-04-10&to=2022-04-11&step=6h&agg=max&format=csv")
+	if status != http.StatusOK {
+		t.Fatalf("Expected 200, got %v: %s\n", status, body)
+	}
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	if len(lines) != 5 || !strings.HasPrefix(lines[0], "date,udc,") {
+		t.Fatalf("Expected header and 4 aggregated rows, got %q\n", lines)
+	}
+	if fields := strings.Split(lines[1], ","); fields[6] != "5" {
+		t.Fatalf("Expected max power 5 in the first 6 hours, got %q\n", lines[1])
+	}
+}
+
+func TestDaily(t *testing.T) {
+	ts := startServer(t, historyStore(t))
+
+	status, body := get(t, ts, "/api/daily?from=2022-04-01&to=2022-04-11")
+	if status != http.StatusOK {
+		t.Fatalf("Expected 200, got %v: %s\n", status, body)
+	}
+	var days []struct {
+		Date   string
+		Energy float32
+	}
+	if err := json.Unmarshal([]byte(body), &days); err != nil {
+		t.Fatalf("Invalid JSON: %v\n", err)
+	}
+	if len(days) != 2 || days[0].Date != "2022-04-09" || days[1].Energy != 11.5 {
+		t.Fatalf("Wrong daily yield: %+v\n", days)
+	}
+
+	_, body = get(t, ts, "/api/daily?from=2022-04-01&to=2022-04-10&format=csv")
+	if body != "date,energy\n2022-04-09,11.5\n" {
+		t.Fatalf("Wrong CSV: %q\n", body)
+	}
+}
+
+func TestInvalidParameters(t *testing.T) {
+	ts := startServer(t, historyStore(t))
+
+	for _, path := range []string{
+		"/api/history?from=yesterday",
+		"/api/history?to=2022-13-01",
+		"/api/history?from=2022-04-11&to=2022-04-10",
+		"/api/history?step=-1m",
+		"/api/history?step=soon",
+		"/api/history?agg=median",
+		"/api/history?format=xml",
+		"/api/daily?from=2022-04-10T12",
+		"/api/daily?format=xml",
+	} {
+		if status, body := get(t, ts, path); status != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %s, got %v: %s\n", path, status, body)
+		}
+	}
+	if status, _ := get(t, ts, "/api/history?inverter=garage"); status != http.StatusNotFound {
+		t.Fatalf("Expected 404 for an unknown inverter, got %v\n", status)
+	}
+}
+
+func TestHistoryDisabled(t *testing.T) {
+	ts := startServer(t, nil)
+
+	for _, path := range []string{"/api/history", "/api/daily"} {
+		if status, _ := get(t, ts, path); status != http.StatusNotFound {
+			t.Fatalf("Expected 404 for %s, got %v\n", path, status)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/adangel/nt5000-serial/poller"
+	"github.com/adangel/nt5000-serial/protocol"
+)
+
+// keepAliveInterval is how often a comment is sent to idle clients, so that
+// proxies don't close the connection.
+const keepAliveInterval = 30 * time.Second
+
+// event is one server-sent event. Name is one of "data", "status" or "failure".
+type event struct {
+	Name string
+	Data interface{}
+}
+
+// failureEvent is sent, whenever an inverter didn't answer. It isn't called
+// "error", because that name is used by EventSource for connection errors.
+type failureEvent struct {
+	Inverter protocol.Inverter
+	Error    string
+	Date     time.Time
+}
+
+// broker distributes the events to all connected clients. Events are dropped
+// for clients, that are too slow to receive them.
+type broker struct {
+	mu      sync.Mutex
+	clients map[chan event]struct{}
+	// state is the state of the connection, that has been published last.
+	state     poller.State
+	published bool
+}
+
+func newBroker() *broker {
+	return &broker{clients: make(map[chan event]struct{})}
+}
+
+func (b *broker) subscribe() chan event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := make(chan event, 16)
+	b.clients[c] = struct{}{}
+	return c
+}
+
+func (b *broker) unsubscribe(c chan event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.clients, c)
+}
+
+func (b *broker) publish(e event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+func (b *broker) publishData(response dataResponse) {
+	b.publish(event{Name: "data", Data: response})
+}
+
+func (b *broker) publishFailure(inverter protocol.Inverter, err error) {
+	b.publish(event{Name: "failure", Data: failureEvent{Inverter: inverter, Error: err.Error(), Date: time.Now()}})
+}
+
+// publishStatus publishes the status, whenever the state of the connection
+// has changed.
+func (b *broker) publishStatus(status poller.Status) {
+	b.mu.Lock()
+	changed := !b.published || b.state != status.State
+	b.state = status.State
+	b.published = true
+	b.mu.Unlock()
+	if changed {
+		b.publish(event{Name: "status", Data: status})
+	}
+}
+
+// handler streams the events as server-sent events. Right after connecting,
+// the current status and the latest data of every inverter are sent.
+func (b *broker) handler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported\n", http.StatusInternalServerError)
+		return
+	}
+
+	c := b.subscribe()
+	defer b.unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	status := dataPoller.Status()
+	initial := []event{{Name: "status", Data: status}}
+	mu.RLock()
+	for _, state := range inverters {
+		if !state.data.Date.IsZero() {
+			initial = append(initial, event{Name: "data", Data: state.response(status)})
+		}
+	}
+	mu.RUnlock()
+	for _, e := range initial {
+		writeEvent(w, e)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-c:
+			writeEvent(w, e)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e event) {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		log.Printf("Couldn't encode event: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Name, data)
+}
@@ -0,0 +1,78 @@
+package web_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvent returns the name and the data of the next server-sent event.
+// Comments are skipped.
+func readEvent(t *testing.T, reader *bufio.Reader) (string, string) {
+	var name, data string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Couldn't read event: %v\n", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && name != "":
+			return name, data
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ts := startPolling(t, 20*time.Millisecond, nil)
+
+	// wait for the first data point, so that it's sent right after connecting
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, body := get(t, ts, "/data")
+		if !strings.Contains(body, `"Date":"0001-01-01`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("No data polled\n")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Get(ts.URL + "/api/events")
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v\n", err)
+	}
+	defer response.Body.Close()
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("Wrong content type %v\n", contentType)
+	}
+	reader := bufio.NewReader(response.Body)
+
+	name, data := readEvent(t, reader)
+	var status struct{ State string }
+	if err := json.Unmarshal([]byte(data), &status); name != "status" || err != nil || status.State != "connected" {
+		t.Fatalf("Expected status connected first, got %v %v\n", name, data)
+	}
+	name, data = readEvent(t, reader)
+	if name != "data" || !strings.Contains(data, `"Inverter"`) {
+		t.Fatalf("Expected the latest data, got %v %v\n", name, data)
+	}
+
+	// the next data points are published, the unchanged status isn't
+	for i := 0; i < 2; i++ {
+		name, data = readEvent(t, reader)
+		var published struct{ Date time.Time }
+		if err := json.Unmarshal([]byte(data), &published); name != "data" || err != nil || published.Date.IsZero() {
+			t.Fatalf("Expected a published data point, got %v %v\n", name, data)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+"use strict";
+
+// Dashboard for nt5000-serial. It doesn't use any libraries, so that it works
+// without internet access.
+
+const POLL_INTERVAL = 5000;
+const SLOW_POLL_INTERVAL = 5 * 60 * 1000;
+const HOUR = 60 * 60 * 1000;
+const DAY = 24 * HOUR;
+
+let inverters = [];
+let selected = null;
+let samples = [];
+
+function $(id) {
+	return document.getElementById(id);
+}
+
+async function getJSON(url) {
+	const response = await fetch(url);
+	if (!response.ok) {
+		throw new Error(url + ": " + response.status);
+	}
+	return response.json();
+}
+
+function query(params) {
+	const all = Object.assign({inverter: selected}, params);
+	return Object.keys(all).map(k => encodeURIComponent(k) + "=" + encodeURIComponent(all[k])).join("&");
+}
+
+function midnight(date) {
+	const d = new Date(date);
+	d.setHours(0, 0, 0, 0);
+	return d;
+}
+
+function fixed(value, digits) {
+	return value === undefined ? "-" : value.toFixed(digits);
+}
+
+// chart draws line charts into an SVG element. Each series has a name, a
+// color and points as [x, y] with x in milliseconds.
+function chart(svg, series, options) {
+	const ns = "http://www.w3.org/2000/svg";
+	const width = svg.clientWidth || 400;
+	const height = svg.clientHeight || 220;
+	const left = 45, right = 10, top = 20, bottom = 20;
+	svg.setAttribute("viewBox", "0 0 " + width + " " + height);
+	while (svg.firstChild) {
+		svg.removeChild(svg.firstChild);
+	}
+
+	function add(name, attributes, text) {
+		const e = document.createElementNS(ns, name);
+		for (const a in attributes) {
+			e.setAttribute(a, attributes[a]);
+		}
+		if (text !== undefined) {
+			e.textContent = text;
+		}
+		svg.appendChild(e);
+		return e;
+	}
+
+	const all = [].concat(...series.map(s => s.points));
+	if (all.length === 0) {
+		add("text", {x: width / 2, y: height / 2, "text-anchor": "middle", class: "empty"}, "No data");
+		return;
+	}
+
+	const xMin = options.xMin;
+	const xMax = options.xMax;
+	let yMin = Math.min(...all.map(p => p[1]));
+	let yMax = Math.max(...all.map(p => p[1]));
+	if (options.zero) {
+		yMin = Math.min(0, yMin);
+	}
+	if (yMax - yMin < 1e-6) {
+		yMax = yMin + 1;
+	}
+	const x = v => left + (v - xMin) / (xMax - xMin) * (width - left - right);
+	const y = v => height - bottom - (v - yMin) / (yMax - yMin) * (height - top - bottom);
+
+	const yTicks = 4;
+	for (let i = 0; i <= yTicks; i++) {
+		const v = yMin + (yMax - yMin) * i / yTicks;
+		add("line", {x1: left, x2: width - right, y1: y(v), y2: y(v), class: "grid"});
+		add("text", {x: left - 4, y: y(v) + 4, "text-anchor": "end"}, v.toFixed(1));
+	}
+	const hours = (xMax - xMin) / HOUR;
+	const step = hours > 12 ? 6 * HOUR : hours > 4 ? 2 * HOUR : HOUR;
+	for (let t = Math.ceil((xMin - options.xOrigin) / step) * step + options.xOrigin; t <= xMax; t += step) {
+		add("line", {x1: x(t), x2: x(t), y1: top, y2: height - bottom, class: "grid"});
+		add("text", {x: x(t), y: height - 5, "text-anchor": "middle"}, options.xLabel(t));
+	}
+	add("line", {x1: left, x2: left, y1: top, y2: height - bottom, class: "axis"});
+	add("line", {x1: left, x2: width - right, y1: height - bottom, y2: height - bottom, class: "axis"});
+
+	let legend = left;
+	series.forEach(s => {
+		if (s.points.length > 0) {
+			const d = s.points.map((p, i) => (i === 0 ? "M" : "L") + x(p[0]).toFixed(1) + "," + y(p[1]).toFixed(1)).join(" ");
+			add("path", {d: d, class: "line", stroke: s.color});
+		}
+		const label = add("text", {x: legend, y: 12, fill: s.color}, s.name + (options.unit ? " [" + options.unit + "]" : ""));
+		legend += (label.getComputedTextLength ? label.getComputedTextLength() : 60) + 15;
+	});
+}
+
+function timeLabel(t) {
+	const d = new Date(t);
+	return String(d.getHours()).padStart(2, "0") + ":" + String(d.getMinutes()).padStart(2, "0");
+}
+
+function drawLiveCharts() {
+	const now = Date.now();
+	const options = {xMin: now - DAY, xMax: now, xOrigin: midnight(now).getTime(), xLabel: timeLabel};
+	const points = f => samples.map(s => [new Date(s.Date).getTime(), f(s)]);
+
+	chart($("chart-power"), [
+		{name: "AC", color: "#c60", points: points(s => s.AC.Power)},
+		{name: "DC", color: "#06c", points: points(s => s.DC.Power)},
+	], Object.assign({unit: "kW", zero: true}, options));
+	chart($("chart-voltage"), [
+		{name: "AC", color: "#c60", points: points(s => s.AC.Voltage)},
+		{name: "DC", color: "#06c", points: points(s => s.DC.Voltage)},
+	], Object.assign({unit: "V", zero: true}, options));
+	chart($("chart-temperature"), [
+		{name: "Temperature", color: "#c33", points: points(s => s.Temperature)},
+	], Object.assign({unit: "°C"}, options));
+}
+
+async function loadHistory() {
+	const now = Date.now();
+	try {
+		samples = await getJSON("/api/history?" + query({from: new Date(now - DAY).toISOString(), step: "5m"}));
+	} catch (e) {
+		// the history is disabled, only show the data since the page has been loaded
+		samples = [];
+	}
+	drawLiveCharts();
+}
+
+async function loadYield() {
+	const today = midnight(Date.now()).getTime();
+	const yesterday = today - DAY;
+	let points = [];
+	try {
+		points = await getJSON("/api/history?" + query({from: new Date(yesterday).toISOString(), step: "15m", agg: "max"}));
+	} catch (e) {
+		// history is disabled
+	}
+	// map both days onto today, so that the curves can be compared
+	const day = (from, to) => points
+		.map(p => [new Date(p.Date).getTime(), p.EnergyDay])
+		.filter(p => p[0] >= from && p[0] < to)
+		.map(p => [p[0] - from + today, p[1]]);
+	chart($("chart-yield"), [
+		{name: "Today", color: "#c60", points: day(today, today + DAY)},
+		{name: "Yesterday", color: "#999", points: day(yesterday, today)},
+	], {unit: "kWh", zero: true, xMin: today, xMax: today + DAY, xOrigin: today, xLabel: timeLabel});
+}
+
+async function loadErrors() {
+	const tbody = $("errors");
+	let errors = [];
+	try {
+		errors = await getJSON("/errors?" + query({}));
+	} catch (e) {
+		return;
+	}
+	while (tbody.firstChild) {
+		tbody.removeChild(tbody.firstChild);
+	}
+	if (errors.length === 0) {
+		const row = tbody.insertRow();
+		const cell = row.insertCell();
+		cell.colSpan = 5;
+		cell.textContent = "No errors";
+		return;
+	}
+	errors.forEach(e => {
+		const f = e.Fault;
+		const name = f.Number ? "fault " + String(f.Number).padStart(3, "0") : "code 0x" + e.Code.toString(16).padStart(2, "0");
+		const row = tbody.insertRow();
+		[new Date(e.Date).toLocaleString(), "0x" + e.Code.toString(16).padStart(2, "0"), name, f.Severity, f.Description + ". " + f.Action]
+			.forEach(text => {
+				row.insertCell().textContent = text;
+			});
+		row.cells[3].className = f.Severity;
+	});
+}
+
+function showInfo() {
+	const info = inverters.find(i => i.Inverter.Name === selected);
+	if (!info) {
+		return;
+	}
+	$("name").textContent = info.Inverter.Name;
+	$("address").textContent = info.Inverter.Address;
+	$("serialnumber").textContent = info.SerialNumber || "-";
+	$("protocol").textContent = info.Protocol || "-";
+	$("firmware").textContent = info.Firmware || "-";
+}
+
+function showData(data) {
+	$("pac").textContent = fixed(data.AC.Power, 2);
+	$("pdc").textContent = fixed(data.DC.Power, 2);
+	$("wd").textContent = fixed(data.EnergyDay, 3);
+	$("wtot").textContent = fixed(data.EnergyTotal, 0);
+	$("temp").textContent = fixed(data.Temperature, 1);
+	$("flux").textContent = fixed(data.HeatFlux, 0);
+	$("date").textContent = new Date(data.Date).toLocaleString();
+}
+
+function showConnection(status) {
+	const connection = $("connection");
+	connection.className = "connection " + status.State;
+	connection.textContent = status.State + (status.LastError ? ": " + status.LastError : "");
+}
+
+// addSample adds a new data point to the live charts.
+function addSample(data) {
+	const date = new Date(data.Date).getTime();
+	if (date <= 0) {
+		return;
+	}
+	const last = samples.length > 0 ? new Date(samples[samples.length - 1].Date).getTime() : 0;
+	if (date <= last) {
+		return;
+	}
+	samples.push(data);
+	while (samples.length > 0 && new Date(samples[0].Date).getTime() < date - DAY) {
+		samples.shift();
+	}
+	drawLiveCharts();
+}
+
+async function poll() {
+	try {
+		const data = await getJSON("/data?" + query({}));
+		showData(data);
+		showConnection(data.Connection);
+		addSample(data);
+	} catch (e) {
+		showConnection({State: "disconnected", LastError: "web server not reachable"});
+	}
+}
+
+// listen receives the data as server-sent events. Without support for
+// EventSource, the data is polled.
+function listen() {
+	if (!window.EventSource) {
+		setInterval(poll, POLL_INTERVAL);
+		return;
+	}
+	const source = new EventSource("/api/events");
+	source.addEventListener("data", e => {
+		const data = JSON.parse(e.data);
+		if (data.Inverter.Name === selected) {
+			showData(data);
+			addSample(data);
+		}
+	});
+	source.addEventListener("status", e => showConnection(JSON.parse(e.data)));
+	source.addEventListener("failure", e => {
+		const failure = JSON.parse(e.data);
+		if (failure.Inverter.Name === selected) {
+			$("connection").textContent = failure.Inverter.Name + ": " + failure.Error;
+		}
+	});
+	source.onerror = () => {
+		// EventSource reconnects on its own
+		showConnection({State: "disconnected", LastError: "web server not reachable"});
+	};
+}
+
+async function selectInverter(name) {
+	selected = name;
+	showInfo();
+	await Promise.all([poll(), loadHistory(), loadYield(), loadErrors()]);
+}
+
+async function init() {
+	inverters = await getJSON("/api/info");
+	const select = $("inverter");
+	inverters.forEach(i => {
+		const option = document.createElement("option");
+		option.value = i.Inverter.Name;
+		option.textContent = i.Inverter.Name + " (" + i.Inverter.Address + ")";
+		select.appendChild(option);
+	});
+	select.hidden = inverters.length < 2;
+	select.addEventListener("change", () => selectInverter(select.value));
+	await selectInverter(inverters[0].Inverter.Name);
+
+	listen();
+	setInterval(async () => {
+		inverters = await getJSON("/api/info");
+		showInfo();
+		loadYield();
+		loadErrors();
+	}, SLOW_POLL_INTERVAL);
+	window.addEventListener("resize", () => {
+		drawLiveCharts();
+		loadYield();
+	});
+}
+
+init();
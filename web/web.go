@@ -1,61 +1,260 @@
 package web
 
 import (
+	"embed"
 	"encoding/json"
 	"fmt"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
-	"github.com/adangel/nt5000-serial/prometheus"
+	"github.com/adangel/nt5000-serial/history"
+	"github.com/adangel/nt5000-serial/poller"
 	"github.com/adangel/nt5000-serial/protocol"
 	"github.com/adangel/nt5000-serial/serial"
+	"github.com/adangel/nt5000-serial/sink"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/pkg/browser"
 )
 
-var currentData protocol.DataPoint
-var basicInfo struct {
+// static contains the dashboard served at /display. It's embedded, so that
+// it works without internet access.
+//
+//go:embed static
+var static embed.FS
+
+// inverterState is everything known about one inverter.
+type inverterState struct {
+	inverter     protocol.Inverter
+	data         protocol.DataPoint
 	serialnumber string
 	protocol     string
 	firmware     string
+	errors       []protocol.Error
+	status       inverterStatus
+}
+
+// inverterStatus tells, whether one inverter answers. The connection status
+// of the poller is about the bus, it's connected as long as any inverter
+// answers.
+type inverterStatus struct {
+	Answering           bool
+	ConsecutiveFailures int
+	LastError           string
+	LastSuccess         time.Time
+}
+
+var mu sync.RWMutex
+var inverters []*inverterState
+var dataPoller *poller.Poller
+var store *history.Store
+
+// dataResponse is the JSON served at /data. The fields of the data point
+// are at the top level, the inverter, its status and the connection status
+// are added as separate fields.
+type dataResponse struct {
+	protocol.DataPoint
+	Inverter   protocol.Inverter
+	Status     inverterStatus
+	Connection poller.Status
+}
+
+func (state *inverterState) response(connection poller.Status) dataResponse {
+	return dataResponse{DataPoint: state.data, Inverter: state.inverter, Status: state.status, Connection: connection}
 }
 
-func StartWebServer(port string, pollInterval uint8, serialPort string, emulate bool) {
+// StartWebServer polls the inverters and serves the data. All events are
+// passed to the sinks as well. If historyStore is not nil, its data is
+// served and it's compacted regularly. To store the data, it must be one of
+// the sinks.
+func StartWebServer(listen string, pollInterval time.Duration, open poller.Opener, inverterList []protocol.Inverter, historyStore *history.Store, sinks []sink.Sink) {
+	_, port, _ := net.SplitHostPort(listen)
 	url := fmt.Sprintf("http://localhost:%s/", port)
 	log.Printf("Starting... %v\n", url)
 
-	if !emulate {
-		log.Printf("Querying serial port %s", serialPort)
-		serial.Connect(serialPort)
+	server := NewServer(pollInterval, open, inverterList, historyStore, sinks)
+	if store != nil {
+		log.Printf("Storing history in %s\n", store.Dir())
+		go compactHistory()
 	}
-	basicInfo.serialnumber = serial.ReadSerialNumber(emulate)
-	basicInfo.protocol, basicInfo.firmware = serial.ReadProtocolAndFirmware(emulate)
-	updateDataInBackground(pollInterval, emulate)
-
-	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/display", handlerDisplay)
-	http.HandleFunc("/data", handlerData)
-	http.HandleFunc("/", handler)
 
 	go func() {
 		time.Sleep(time.Second * 2)
 		browser.OpenURL(url)
 	}()
-	serial.SetupCloseHandler()
+	serial.SetupCloseHandler(server)
 
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	log.Fatal(http.ListenAndServe(listen, server))
 }
 
-func updateDataInBackground(pollInterval uint8, emulate bool) {
-	go func() {
-		for {
-			currentData = serial.GetDataPoint(emulate)
-			prometheus.RecordPrometheusData(currentData)
-			time.Sleep(time.Second * time.Duration(pollInterval))
+// Server polls the inverters and serves their data. The state is kept in
+// package variables, so only one server can run at a time.
+type Server struct {
+	mux    *http.ServeMux
+	fanout *sink.Fanout
+}
+
+// NewServer starts polling the inverters and returns the handler for all
+// endpoints. All events are passed to the sinks as well. If historyStore is
+// not nil, its data is served.
+func NewServer(pollInterval time.Duration, open poller.Opener, inverterList []protocol.Inverter, historyStore *history.Store, sinks []sink.Sink) *Server {
+	mu.Lock()
+	store = historyStore
+	inverters = nil
+	mu.Unlock()
+
+	events := newBroker()
+	fanout := sink.New(append([]sink.Sink{webSink{events}}, sinks...)...)
+	updateDataInBackground(pollInterval, open, inverterList, fanout)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/display", handlerDisplay)
+	mux.Handle("/static/", http.FileServer(http.FS(static)))
+	mux.HandleFunc("/data", handlerData)
+	mux.HandleFunc("/data/all", handlerDataAll)
+	mux.HandleFunc("/errors", handlerErrors)
+	mux.HandleFunc("/api/history", handlerHistory)
+	mux.HandleFunc("/api/daily", handlerDaily)
+	mux.HandleFunc("/api/info", handlerInfo)
+	mux.HandleFunc("/api/events", events.handler)
+	mux.HandleFunc("/", handler)
+	return &Server{mux: mux, fanout: fanout}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Close stops polling and closes the sinks.
+func (s *Server) Close() error {
+	if err := dataPoller.Close(); err != nil {
+		log.Print(err)
+	}
+	return s.fanout.Close()
+}
+
+func updateDataInBackground(pollInterval time.Duration, open poller.Opener, inverterList []protocol.Inverter, fanout *sink.Fanout) {
+	dataPoller = poller.New(open, inverterList, pollInterval)
+	var states []*inverterState
+	for _, inverter := range dataPoller.Inverters() {
+		states = append(states, &inverterState{inverter: inverter, data: lastDataPoint(inverter)})
+	}
+	mu.Lock()
+	inverters = states
+	mu.Unlock()
+	fanout.Attach(dataPoller)
+	dataPoller.Start()
+}
+
+// webSink keeps the state of the inverters, that is served, and passes the
+// events on to the clients of /api/events.
+type webSink struct {
+	events *broker
+}
+
+func (s webSink) Data(inverter protocol.Inverter, data protocol.DataPoint) {
+	mu.Lock()
+	state := findInverter(inverter)
+	if state == nil {
+		mu.Unlock()
+		return
+	}
+	state.data = data
+	state.status = inverterStatus{Answering: true, LastSuccess: data.Date}
+	response := state.response(dataPoller.Status())
+	mu.Unlock()
+	s.events.publishData(response)
+}
+
+func (s webSink) Failure(inverter protocol.Inverter, err error) {
+	mu.Lock()
+	if state := findInverter(inverter); state != nil {
+		state.status.Answering = false
+		state.status.ConsecutiveFailures++
+		state.status.LastError = err.Error()
+	}
+	mu.Unlock()
+	s.events.publishFailure(inverter, err)
+}
+
+func (webSink) Info(inverter protocol.Inverter, info sink.Info) {
+	mu.Lock()
+	defer mu.Unlock()
+	state := findInverter(inverter)
+	if state == nil {
+		return
+	}
+	state.serialnumber = info.SerialNumber
+	state.protocol = info.Protocol
+	state.firmware = info.Firmware
+	if info.Errors != nil {
+		state.errors = info.Errors
+	}
+}
+
+func (s webSink) Status(status poller.Status) {
+	if status.State != poller.Connected {
+		mu.Lock()
+		for _, state := range inverters {
+			state.status.Answering = false
 		}
-	}()
+		mu.Unlock()
+	}
+	s.events.publishStatus(status)
+}
+
+// lastDataPoint returns the newest data point from the history, so that the
+// data is available right after a restart.
+func lastDataPoint(inverter protocol.Inverter) protocol.DataPoint {
+	if store == nil {
+		return protocol.DataPoint{}
+	}
+	data, _, err := store.Last(inverter.Name)
+	if err != nil {
+		log.Printf("Couldn't read history of %s: %v\n", inverter.Name, err)
+	}
+	return data
+}
+
+// compactHistory applies the retention policy of the history once an hour.
+func compactHistory() {
+	for {
+		if err := store.Compact(time.Now()); err != nil {
+			log.Printf("Couldn't compact history: %v\n", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+func findInverter(inverter protocol.Inverter) *inverterState {
+	for _, state := range inverters {
+		if state.inverter == inverter {
+			return state
+		}
+	}
+	return nil
+}
+
+// selectedInverter returns a copy of the state of the inverter given by the
+// query parameter "inverter", either by name or by address. Without the
+// parameter, the first inverter is selected.
+func selectedInverter(r *http.Request) (inverterState, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	selected := r.URL.Query().Get("inverter")
+	for _, state := range inverters {
+		if selected == "" || selected == state.inverter.Name || selected == strconv.Itoa(int(state.inverter.Address)) {
+			return *state, true
+		}
+	}
+	return inverterState{}, false
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
@@ -63,72 +262,96 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, `
 	<p><a href="/display">Display</a></p>
 	<p><a href='/data'>JSON data</a></p>
+	<p><a href='/data/all'>JSON data of all inverters</a></p>
+	<p><a href='/errors'>Error memory</a></p>
+	<p><a href='/api/history?step=15m'>History of the last 24 hours</a></p>
+	<p><a href='/api/daily'>Energy per day</a></p>
+	<p><a href='/api/events'>Live events</a></p>
 	<p><a href="/metrics">Metrics for Prometheus</a></p>
 	`)
 }
 
 func handlerData(w http.ResponseWriter, r *http.Request) {
+	state, ok := selectedInverter(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, state.response(dataPoller.Status()))
+}
+
+func handlerDataAll(w http.ResponseWriter, r *http.Request) {
+	status := dataPoller.Status()
+
+	mu.RLock()
+	response := make([]dataResponse, 0, len(inverters))
+	for _, state := range inverters {
+		response = append(response, state.response(status))
+	}
+	mu.RUnlock()
+
+	writeJSON(w, response)
+}
+
+// errorResponse is one entry of the error memory served at /errors.
+type errorResponse struct {
+	protocol.Error
+	Fault protocol.Fault
+}
+
+func handlerErrors(w http.ResponseWriter, r *http.Request) {
+	state, ok := selectedInverter(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	response := make([]errorResponse, 0, len(state.errors))
+	for _, e := range state.errors {
+		response = append(response, errorResponse{Error: e, Fault: e.Fault()})
+	}
+	writeJSON(w, response)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
-	bytes, err := json.Marshal(currentData)
+	bytes, err := json.Marshal(v)
 	if err != nil {
 		fmt.Println("error:", err)
 	}
-	fmt.Fprintf(w, string(bytes))
+	w.Write(bytes)
 }
 
 func handlerDisplay(w http.ResponseWriter, r *http.Request) {
-	d := currentData
+	index, err := fs.ReadFile(static, "static/index.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(index)
+}
 
-	fmt.Fprintf(w, `
-<!doctype html>
-<html>
-<head>
-	<meta name="charset" value="utf-8">
-    <meta http-equiv="refresh" content="5">
-	<style type="text/css">
-td:first-child, dt {
-	font-weight: bold;
-}
-table {
-	border: 1px solid black;
-	border-spacing: 0px;
-}
-td:first-child {
-	border-right: 1px solid black;
-}
-tr:first-child td {
-	border-bottom: 1px solid black;
-}
-	</style>
-</head>
-<body>
-<h1>nt5000-serial</h1>
-<dl>
-  <dt>Serial number:</dt><dd>%s</dd>
-  <dt>Protocol:</dt><dd>%s</dd>
-  <dt>Firmware:</dt><dd>%s</dd>
-</dl>
-
-<table>
-<tr><td>Date</td><td>%s</td></tr>
-<tr><td>udc</td><td>%f V</td></tr>
-<tr><td>idc</td><td>%f A</td></tr>
-<tr><td>pdc</td><td>%f kW</td></tr>
-<tr><td>uac</td><td>%f V</td></tr>
-<tr><td>iac</td><td>%f A</td></tr>
-<tr><td>pac</td><td>%f kW</td></tr>
-<tr><td>temp</td><td>%f °C</td></tr>
-<tr><td>flux</td><td>%f W/m^2</td></tr>
-<tr><td>wd</td><td>%f kWh</td></tr>
-<tr><td>wtot</td><td>%f kWh</td></tr>
-</table>
-</body>
-</html>
-	`, basicInfo.serialnumber, basicInfo.protocol, basicInfo.firmware,
-		d.Date,
-		d.DC.Voltage, d.DC.Current, d.DC.Power,
-		d.AC.Voltage, d.AC.Current, d.AC.Power,
-		d.Temperature, d.HeatFlux,
-		d.EnergyDay, d.EnergyTotal,
-	)
+// infoResponse is the basic information about an inverter served at /api/info.
+type infoResponse struct {
+	Inverter     protocol.Inverter
+	SerialNumber string
+	Protocol     string
+	Firmware     string
+}
+
+func handlerInfo(w http.ResponseWriter, r *http.Request) {
+	mu.RLock()
+	response := make([]infoResponse, 0, len(inverters))
+	for _, state := range inverters {
+		response = append(response, infoResponse{
+			Inverter:     state.inverter,
+			SerialNumber: state.serialnumber,
+			Protocol:     state.protocol,
+			Firmware:     state.firmware,
+		})
+	}
+	mu.RUnlock()
+
+	writeJSON(w, response)
 }
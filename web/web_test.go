@@ -0,0 +1,90 @@
+package web_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adangel/nt5000-serial/emulator"
+	"github.com/adangel/nt5000-serial/prometheus"
+	"github.com/adangel/nt5000-serial/protocol"
+	"github.com/adangel/nt5000-serial/serial"
+	"github.com/adangel/nt5000-serial/sink"
+	"github.com/adangel/nt5000-serial/web"
+)
+
+func TestInverterStatus(t *testing.T) {
+	emulator.Addresses = []byte{1}
+	defer func() {
+		emulator.Addresses = []byte{protocol.DefaultAddress}
+	}()
+
+	server := web.NewServer(10*time.Millisecond, func() (serial.Transport, error) {
+		return serial.NewMemoryTransport(emulator.Respond), nil
+	}, []protocol.Inverter{protocol.NewInverter(1), protocol.NewInverter(2)}, nil, []sink.Sink{prometheus.Sink{}})
+	ts := httptest.NewServer(server)
+	defer server.Close()
+	defer ts.Close()
+
+	type response struct {
+		Inverter protocol.Inverter
+		Status   struct {
+			Answering           bool
+			ConsecutiveFailures int
+			LastError           string
+			LastSuccess         time.Time
+		}
+		Connection struct{ State string }
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, body := get(t, ts, "/data/all")
+		if status != http.StatusOK {
+			t.Fatalf("Expected 200, got %v: %s\n", status, body)
+		}
+		var all []response
+		if err := json.Unmarshal([]byte(body), &all); err != nil {
+			t.Fatalf("Invalid JSON: %v\n", err)
+		}
+		if len(all) == 2 && all[0].Status.Answering && all[1].Status.ConsecutiveFailures > 0 {
+			if all[0].Status.LastSuccess.IsZero() || all[0].Connection.State != "connected" {
+				t.Fatalf("Wrong status of the answering inverter: %+v\n", all[0])
+			}
+			if all[1].Status.Answering || all[1].Status.LastError == "" || !all[1].Status.LastSuccess.IsZero() {
+				t.Fatalf("Wrong status of the missing inverter: %+v\n", all[1])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Status not updated: %s\n", body)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	_, body := get(t, ts, "/data?inverter=2")
+	var missing response
+	json.Unmarshal([]byte(body), &missing)
+	if missing.Inverter.Address != 2 || missing.Status.Answering {
+		t.Fatalf("Wrong status for /data: %s\n", body)
+	}
+
+	// the metrics are recorded by their own sink, that might lag behind
+	for _, metric := range []string{
+		`nt5000_inverter_up{address="1",inverter="inverter-1"} 1`,
+		`nt5000_inverter_up{address="2",inverter="inverter-2"} 0`,
+		`nt5000_inverter_last_success_timestamp_seconds{address="1",inverter="inverter-1"}`,
+	} {
+		for {
+			if _, body := get(t, ts, "/metrics"); strings.Contains(body, metric) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Missing metric %s\n", metric)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}